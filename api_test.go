@@ -0,0 +1,584 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	log = slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// An App on a memory store with two contacts, ids 1 and 2
+func new_test_app() *App {
+
+	return &App{newTemplate(), newMemoryStore([]Contact{
+		{ID: 1, First: "Carson", Last: "Gross", Email: "carson@example.com", Phone: "123-456-7890"},
+		{ID: 2, First: "Joe", Last: "Blow", Email: "joe@example.com", Phone: "555-0100"},
+	}), new_idempotency_cache(idempotency_max_keys, idempotency_ttl)}
+}
+
+func serve(app *App, method, target, content_type, body string) *httptest.ResponseRecorder {
+
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if content_type != "" {
+		r.Header.Set("Content-Type", content_type)
+	}
+	w := httptest.NewRecorder()
+	app.routes().ServeHTTP(w, r)
+	return w
+}
+
+func TestAPIStatus(t *testing.T) {
+
+	const json_type = "application/json"
+	tests := []struct {
+		name         string
+		method       string
+		target       string
+		content_type string
+		body         string
+		status       int
+	}{
+		{"list", "GET", "/api/v1/contacts", "", "", http.StatusOK},
+		{"list by cursor", "GET", "/api/v1/contacts?limit=1", "", "", http.StatusOK},
+		{"list bad query", "GET", "/api/v1/contacts?q=(", "", "", http.StatusBadRequest},
+		{"list bad sort", "GET", "/api/v1/contacts?sort=age", "", "", http.StatusBadRequest},
+		{"list bad cursor", "GET", "/api/v1/contacts?cursor=nope", "", "", http.StatusBadRequest},
+
+		{"create", "POST", "/api/v1/contacts", json_type, `{"first":"Ann","last":"Lee","email":"ann@example.com","phone":"1"}`, http.StatusCreated},
+		{"create form", "POST", "/api/v1/contacts", "application/x-www-form-urlencoded", "first_name=Ann&last_name=Lee&email=ann@example.com&phone=1", http.StatusCreated},
+		{"create invalid", "POST", "/api/v1/contacts", json_type, `{"first":"Ann"}`, http.StatusUnprocessableEntity},
+		{"create taken email", "POST", "/api/v1/contacts", json_type, `{"first":"Ann","last":"Lee","email":"joe@example.com","phone":"1"}`, http.StatusConflict},
+		{"create unknown field", "POST", "/api/v1/contacts", json_type, `{"first":"Ann","age":3}`, http.StatusUnprocessableEntity},
+		{"create bad json", "POST", "/api/v1/contacts", json_type, `{"first":`, http.StatusBadRequest},
+		{"create too large", "POST", "/api/v1/contacts", json_type, `{"first":"` + strings.Repeat("a", contact_body_max_size) + `"}`, http.StatusRequestEntityTooLarge},
+		{"create other type", "POST", "/api/v1/contacts", "text/plain", "Ann", http.StatusUnsupportedMediaType},
+
+		{"get", "GET", "/api/v1/contacts/1", "", "", http.StatusOK},
+		{"get missing", "GET", "/api/v1/contacts/99", "", "", http.StatusNotFound},
+		{"get bad id", "GET", "/api/v1/contacts/abc", "", "", http.StatusNotFound},
+
+		{"update", "PUT", "/api/v1/contacts/1", json_type, `{"first":"Carson","last":"Gross","email":"cg@example.com","phone":"1"}`, http.StatusOK},
+		{"update missing", "PUT", "/api/v1/contacts/99", json_type, `{"first":"A","last":"B","email":"ab@example.com","phone":"1"}`, http.StatusNotFound},
+		{"update invalid", "PUT", "/api/v1/contacts/1", json_type, `{"first":"","last":"Gross","email":"cg@example.com","phone":"1"}`, http.StatusUnprocessableEntity},
+		{"update taken email", "PUT", "/api/v1/contacts/1", json_type, `{"first":"Carson","last":"Gross","email":"joe@example.com","phone":"1"}`, http.StatusConflict},
+		{"update unknown field", "PUT", "/api/v1/contacts/1", json_type, `{"first":"Carson","age":3}`, http.StatusUnprocessableEntity},
+		{"update other type", "PUT", "/api/v1/contacts/1", "text/csv", "a,b", http.StatusUnsupportedMediaType},
+
+		{"merge patch", "PATCH", "/api/v1/contacts/1", merge_patch_type, `{"phone":"555-0199"}`, http.StatusOK},
+		{"json patch", "PATCH", "/api/v1/contacts/1", json_patch_type, `[{"op":"replace","path":"/phone","value":"555-0199"}]`, http.StatusOK},
+		{"patch missing", "PATCH", "/api/v1/contacts/99", merge_patch_type, `{"phone":"1"}`, http.StatusNotFound},
+		{"patch invalid", "PATCH", "/api/v1/contacts/1", merge_patch_type, `{"first":null}`, http.StatusUnprocessableEntity},
+		{"patch taken email", "PATCH", "/api/v1/contacts/1", merge_patch_type, `{"email":"joe@example.com"}`, http.StatusConflict},
+		{"patch unknown field", "PATCH", "/api/v1/contacts/1", merge_patch_type, `{"age":3}`, http.StatusUnprocessableEntity},
+		{"json patch unknown field", "PATCH", "/api/v1/contacts/1", json_patch_type, `[{"op":"add","path":"/age","value":"3"}]`, http.StatusUnprocessableEntity},
+		{"patch failed test", "PATCH", "/api/v1/contacts/1", json_patch_type, `[{"op":"test","path":"/first","value":"Joe"}]`, http.StatusConflict},
+		{"patch bad op", "PATCH", "/api/v1/contacts/1", json_patch_type, `[{"op":"remove","path":"/middle"}]`, http.StatusUnprocessableEntity},
+		{"patch op unknown member", "PATCH", "/api/v1/contacts/1", json_patch_type, `[{"op":"replace","path":"/phone","value":"1","extra":1}]`, http.StatusOK},
+		{"patch bad json", "PATCH", "/api/v1/contacts/1", json_patch_type, `[{"op":`, http.StatusBadRequest},
+		{"patch other type", "PATCH", "/api/v1/contacts/1", "application/json", `{"phone":"1"}`, http.StatusUnsupportedMediaType},
+
+		{"delete", "DELETE", "/api/v1/contacts/1", "", "", http.StatusNoContent},
+		{"delete missing", "DELETE", "/api/v1/contacts/99", "", "", http.StatusNotFound},
+		{"delete bad id", "DELETE", "/api/v1/contacts/abc", "", "", http.StatusNotFound},
+
+		{"import", "POST", "/api/v1/contacts/import", "text/csv", "first,last,email,phone\nAnn,Lee,ann@example.com,1\n", http.StatusCreated},
+		{"import dry run", "POST", "/api/v1/contacts/import?dry_run=true", "text/csv", "first,last,email,phone\nAnn,Lee,ann@example.com,1\n", http.StatusOK},
+		{"import all rejected", "POST", "/api/v1/contacts/import", "text/csv", "first,last,email,phone\nAnn,,ann@example.com,1\n", http.StatusOK},
+		{"import bad mapping", "POST", "/api/v1/contacts/import?email=mail", "text/csv", "first,last,email,phone\n", http.StatusUnprocessableEntity},
+
+		{"batch", "POST", "/api/v1/contacts:batch", json_type, `{"operations":[{"op":"delete","id":2}]}`, http.StatusOK},
+		{"batch failed", "POST", "/api/v1/contacts:batch", json_type, `{"operations":[{"op":"delete","id":99}]}`, http.StatusUnprocessableEntity},
+		{"batch best effort", "POST", "/api/v1/contacts:batch", json_type, `{"mode":"best_effort","operations":[{"op":"delete","id":99}]}`, http.StatusOK},
+		{"batch empty", "POST", "/api/v1/contacts:batch", json_type, `{"operations":[]}`, http.StatusBadRequest},
+		{"batch bad mode", "POST", "/api/v1/contacts:batch", json_type, `{"mode":"some","operations":[{"op":"delete","id":2}]}`, http.StatusBadRequest},
+		{"batch other type", "POST", "/api/v1/contacts:batch", "text/plain", "delete 2", http.StatusUnsupportedMediaType},
+		{"batch method not allowed", "GET", "/api/v1/contacts:batch", "", "", http.StatusMethodNotAllowed},
+
+		{"unknown route", "GET", "/api/v1/groups", "", "", http.StatusNotFound},
+		{"method not allowed", "PATCH", "/api/v1/contacts", "", "", http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(new_test_app(), tt.method, tt.target, tt.content_type, tt.body)
+			if w.Code != tt.status {
+				t.Errorf("%s %s: status %d, want %d\n%s", tt.method, tt.target, w.Code, tt.status, w.Body)
+			}
+		})
+	}
+}
+
+func TestAPICreateLocation(t *testing.T) {
+
+	app := new_test_app()
+	w := serve(app, "POST", "/api/v1/contacts", "application/json", `{"first":"Ann","last":"Lee","email":"ann@example.com","phone":"1"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusCreated)
+	}
+
+	var c Contact
+	err := json.Unmarshal(w.Body.Bytes(), &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ID != 3 || c.First != "Ann" {
+		t.Errorf("created %+v, want Ann with id 3", c)
+	}
+	location := w.Header().Get("Location")
+	if location != "/api/v1/contacts/3" {
+		t.Errorf("Location %q, want /api/v1/contacts/3", location)
+	}
+
+	w = serve(app, "GET", location, "", "")
+	if w.Code != http.StatusOK {
+		t.Errorf("GET %s: status %d, want %d", location, w.Code, http.StatusOK)
+	}
+}
+
+func TestAPIDeleteHasNoBody(t *testing.T) {
+
+	w := serve(new_test_app(), "DELETE", "/api/v1/contacts/2", "", "")
+	if w.Code != http.StatusNoContent || w.Body.Len() != 0 {
+		t.Errorf("status %d with %q, want %d and no body", w.Code, w.Body, http.StatusNoContent)
+	}
+}
+
+func TestAPIProblem(t *testing.T) {
+
+	app := new_test_app()
+	r := httptest.NewRequest("POST", "/api/v1/contacts", strings.NewReader(`{"first":"Ann","email":"joe@example.com"}`))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	logging(app.routes()).ServeHTTP(w, r)
+
+	if ct := w.Header().Get("Content-Type"); ct != problem_content_type {
+		t.Errorf("Content-Type %q, want %q", ct, problem_content_type)
+	}
+	var p problem
+	err := json.Unmarshal(w.Body.Bytes(), &p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Type != problem_invalid_contact.URI || p.Status != w.Code || p.Title == "" {
+		t.Errorf("problem %+v for status %d, want an invalid contact", p, w.Code)
+	}
+	if !strings.HasPrefix(p.Instance, "urn:uuid:") {
+		t.Errorf("instance %q, want the request id", p.Instance)
+	}
+	for _, field := range []string{"last", "phone", "email"} {
+		if p.Errors[field] == "" {
+			t.Errorf("no error for %s in %v", field, p.Errors)
+		}
+	}
+}
+
+func TestAPIProblemEmailTaken(t *testing.T) {
+
+	w := serve(new_test_app(), "PUT", "/api/v1/contacts/1", "application/json", `{"first":"Carson","last":"Gross","email":"joe@example.com","phone":"1"}`)
+	var p problem
+	err := json.Unmarshal(w.Body.Bytes(), &p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Type != problem_email_taken.URI || p.Errors["email"] != email_taken_message {
+		t.Errorf("problem %+v, want the email taken", p)
+	}
+}
+
+// Adding a field contacts don't have is the same 422 whether the contact is
+// sent whole or patched
+func TestAPIUnknownField(t *testing.T) {
+
+	tests := []struct {
+		method, target, content_type, body string
+		problem                            problem_type
+	}{
+		{"POST", "/api/v1/contacts", "application/json", `{"first":"Ann","last":"Lee","email":"ann@example.com","phone":"1","age":"3"}`, problem_invalid_contact},
+		{"PUT", "/api/v1/contacts/1", "application/json", `{"first":"Carson","last":"Gross","email":"carson@example.com","phone":"1","age":"3"}`, problem_invalid_contact},
+		{"PATCH", "/api/v1/contacts/1", merge_patch_type, `{"age":"3"}`, problem_invalid_patch},
+		{"PATCH", "/api/v1/contacts/1", json_patch_type, `[{"op":"add","path":"/age","value":"3"}]`, problem_invalid_patch},
+	}
+	for _, tt := range tests {
+		w := serve(new_test_app(), tt.method, tt.target, tt.content_type, tt.body)
+		var p problem
+		err := json.Unmarshal(w.Body.Bytes(), &p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != http.StatusUnprocessableEntity || p.Type != tt.problem.URI || p.Detail != `Contacts have no field "age"` {
+			t.Errorf("%s %s: status %d, problem %+v", tt.method, tt.content_type, w.Code, p)
+		}
+	}
+}
+
+// A contact as GET answers with it can be changed and sent back, its id,
+// version and errors are ignored
+func TestAPIPutWhatGetAnswers(t *testing.T) {
+
+	app := new_test_app()
+	w := serve(app, "GET", "/api/v1/contacts/1", "", "")
+	var m map[string]any
+	err := json.Unmarshal(w.Body.Bytes(), &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"id", "version", "errors"} {
+		if _, ok := m[k]; !ok {
+			t.Fatalf("GET answered %s without %s", w.Body, k)
+		}
+	}
+	m["phone"] = "555-0199"
+	m["id"] = 2
+	m["version"] = 7
+	body, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w = serve(app, "PUT", "/api/v1/contacts/1", "application/json", string(body))
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT of the GET body: status %d, want %d\n%s", w.Code, http.StatusOK, w.Body)
+	}
+	c, err := app.Store.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Phone != "555-0199" || c.Version != 2 || c.First != "Carson" {
+		t.Errorf("stored %+v", c)
+	}
+	if other, _ := app.Store.Get(2); other.First != "Joe" {
+		t.Errorf("the id in the body changed contact 2: %+v", other)
+	}
+}
+
+func TestAPIMethodNotAllowed(t *testing.T) {
+
+	w := serve(new_test_app(), "POST", "/api/v1/contacts/1", "", "")
+	if allow := w.Header().Get("Allow"); allow != "GET, PUT, PATCH, DELETE" {
+		t.Errorf("Allow %q, want GET, PUT, PATCH, DELETE", allow)
+	}
+}
+
+func TestAPIPatchKeepsOtherFields(t *testing.T) {
+
+	app := new_test_app()
+	w := serve(app, "PATCH", "/api/v1/contacts/1", merge_patch_type, `{"phone":"555-0199","first":"Carsten"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want %d\n%s", w.Code, http.StatusOK, w.Body)
+	}
+	w = serve(app, "PATCH", "/api/v1/contacts/1", json_patch_type, `[{"op":"test","path":"/first","value":"Carsten"},{"op":"copy","from":"/first","path":"/last"}]`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want %d\n%s", w.Code, http.StatusOK, w.Body)
+	}
+
+	c, err := app.Store.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Contact{ID: 1, First: "Carsten", Last: "Carsten", Email: "carson@example.com", Phone: "555-0199"}
+	if c.First != want.First || c.Last != want.Last || c.Email != want.Email || c.Phone != want.Phone {
+		t.Errorf("patched into %+v, want %+v", c, want)
+	}
+}
+
+func TestAPIConditionalRequests(t *testing.T) {
+
+	app := new_test_app()
+	send := func(method, target, header, etag, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		if header != "" {
+			r.Header.Set(header, etag)
+		}
+		w := httptest.NewRecorder()
+		app.routes().ServeHTTP(w, r)
+		return w
+	}
+	const put = `{"first":"Carson","last":"Gross","email":"cg@example.com","phone":"1"}`
+
+	w := send("GET", "/api/v1/contacts/1", "", "", "")
+	etag := w.Header().Get("ETag")
+	if etag != `"1-1"` {
+		t.Fatalf("ETag %q, want \"1-1\"", etag)
+	}
+	w = send("GET", "/api/v1/contacts/1", "If-None-Match", "W/"+etag, "")
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("If-None-Match: status %d with %q, want %d and no body", w.Code, w.Body, http.StatusNotModified)
+	}
+
+	w = send("GET", "/api/v1/contacts", "", "", "")
+	list_etag := w.Header().Get("ETag")
+	if list_etag == "" {
+		t.Error("list has no ETag")
+	}
+	w = send("GET", "/api/v1/contacts", "If-None-Match", list_etag, "")
+	if w.Code != http.StatusNotModified {
+		t.Errorf("list If-None-Match: status %d, want %d", w.Code, http.StatusNotModified)
+	}
+
+	w = send("PUT", "/api/v1/contacts/1", "If-Match", etag, put)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != `"1-2"` {
+		t.Fatalf("PUT: status %d with ETag %q, want %d and \"1-2\"", w.Code, w.Header().Get("ETag"), http.StatusOK)
+	}
+
+	// etag is out of date now
+	for _, method := range []string{"PUT", "DELETE"} {
+		w = send(method, "/api/v1/contacts/1", "If-Match", etag, put)
+		if w.Code != http.StatusPreconditionFailed {
+			t.Errorf("%s with a stale If-Match: status %d, want %d", method, w.Code, http.StatusPreconditionFailed)
+		}
+	}
+	r := httptest.NewRequest("PATCH", "/api/v1/contacts/1", strings.NewReader(`{"phone":"2"}`))
+	r.Header.Set("Content-Type", merge_patch_type)
+	r.Header.Set("If-Match", etag)
+	w = httptest.NewRecorder()
+	app.routes().ServeHTTP(w, r)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("PATCH with a stale If-Match: status %d, want %d", w.Code, http.StatusPreconditionFailed)
+	}
+	w = send("GET", "/api/v1/contacts", "If-None-Match", list_etag, "")
+	if w.Code != http.StatusOK {
+		t.Errorf("list If-None-Match after a change: status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	w = send("DELETE", "/api/v1/contacts/1", "If-Match", `"1-2"`, "")
+	if w.Code != http.StatusNoContent {
+		t.Errorf("DELETE with If-Match: status %d, want %d", w.Code, http.StatusNoContent)
+	}
+
+	// The ETag of a deleted contact names no contact created after it
+	w = send("DELETE", "/api/v1/contacts/2", "If-Match", `"2-1"`, "")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE the last contact: status %d, want %d", w.Code, http.StatusNoContent)
+	}
+	w = send("POST", "/api/v1/contacts", "", "", `{"first":"Ann","last":"Lee","email":"ann@example.com","phone":"1"}`)
+	if w.Header().Get("ETag") == `"2-1"` {
+		t.Error("a new contact has the ETag of the deleted one")
+	}
+	w = send("PUT", "/api/v1/contacts/2", "If-Match", `"2-1"`, put)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("PUT with the deleted contact's ETag: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestEditConflict(t *testing.T) {
+
+	app := new_test_app()
+	_, err := app.Store.Update(Contact{ID: 1, First: "Carsten", Last: "Gross", Email: "carson@example.com", Phone: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The form was filled in from version 1
+	form := "version=1&first_name=Carson&last_name=Gross&email=carson@example.com&phone=2"
+	w := serve(app, "POST", "/contacts/1/edit", "application/x-www-form-urlencoded", form)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusConflict)
+	}
+	for _, s := range []string{"Carsten", `name="version" value="2"`, `name="phone" value="2"`} {
+		if !strings.Contains(w.Body.String(), s) {
+			t.Errorf("conflict page does not have %s", s)
+		}
+	}
+
+	c, err := app.Store.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.First != "Carsten" || c.Version != 2 {
+		t.Errorf("stored %+v, want the other change at version 2", c)
+	}
+}
+
+func TestAPIBatch(t *testing.T) {
+
+	// Joe's email goes to Carson once Joe is deleted, the emails are
+	// checked as the operations before leave them
+	const batch = `{"mode":%q,"operations":[
+		{"op":"create","contact":{"first":"Ann","last":"Lee","email":"ann@example.com","phone":"1"}},
+		{"op":"delete","id":2},
+		{"op":"update","id":1,"version":1,"contact":{"first":"Carson","last":"Gross","email":"joe@example.com","phone":"1"}},
+		{"op":"update","id":1,"version":1,"contact":{"first":"Carson","last":"Gross","email":"cg@example.com","phone":"1"}},
+		{"op":"create","contact":{"first":"Bob","last":"","email":"bob@example.com","phone":"1"}}
+	]}`
+	statuses := func(results []batch_result) []int {
+		var out []int
+		for _, res := range results {
+			out = append(out, res.Status)
+		}
+		return out
+	}
+
+	// The second update expects the version the first one replaces, the
+	// last create has no last name
+	app := new_test_app()
+	w := serve(app, "POST", "/api/v1/contacts:batch", "application/json", fmt.Sprintf(batch, batch_atomic))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("atomic: status %d, want %d\n%s", w.Code, http.StatusUnprocessableEntity, w.Body)
+	}
+	var p problem
+	err := json.Unmarshal(w.Body.Bytes(), &p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []int{424, 424, 424, 412, 422}
+	if got := statuses(p.Results); !slices.Equal(got, want) {
+		t.Errorf("atomic: statuses %v, want %v", got, want)
+	}
+	if n, _ := app.Store.Count(); n != 2 {
+		t.Errorf("atomic: %d contacts after a failed batch, want 2", n)
+	}
+
+	w = serve(app, "POST", "/api/v1/contacts:batch", "application/json", fmt.Sprintf(batch, batch_best_effort))
+	if w.Code != http.StatusOK {
+		t.Fatalf("best effort: status %d, want %d\n%s", w.Code, http.StatusOK, w.Body)
+	}
+	var res batch_response
+	err = json.Unmarshal(w.Body.Bytes(), &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []int{201, 204, 200, 412, 422}
+	if got := statuses(res.Results); !slices.Equal(got, want) || res.Applied != 3 {
+		t.Errorf("best effort: statuses %v with %d applied, want %v with 3", got, res.Applied, want)
+	}
+	c, err := app.Store.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Email != "joe@example.com" || c.Version != 2 {
+		t.Errorf("best effort: stored %+v, want Joe's email at version 2", c)
+	}
+}
+
+func TestAPIIdempotencyKey(t *testing.T) {
+
+	app := new_test_app()
+	send := func(method, target, key, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set(idempotency_header, key)
+		w := httptest.NewRecorder()
+		app.routes().ServeHTTP(w, r)
+		return w
+	}
+	const ann = `{"first":"Ann","last":"Lee","email":"ann@example.com","phone":"1"}`
+
+	first := send("POST", "/api/v1/contacts", "test-create-ann", ann)
+	retry := send("POST", "/api/v1/contacts", "test-create-ann", ann)
+	if first.Code != http.StatusCreated || retry.Code != http.StatusCreated {
+		t.Fatalf("statuses %d and %d, want %d for both", first.Code, retry.Code, http.StatusCreated)
+	}
+	if retry.Body.String() != first.Body.String() || retry.Header().Get("Location") != first.Header().Get("Location") {
+		t.Errorf("retry answered %q, want the first answer %q", retry.Body, first.Body)
+	}
+	if retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("retry is not marked as replayed")
+	}
+	if n, _ := app.Store.Count(); n != 3 {
+		t.Errorf("%d contacts after a retried create, want 3", n)
+	}
+
+	w := send("POST", "/api/v1/contacts", "test-create-ann", strings.Replace(ann, "Ann", "Anne", 1))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("key reused for another body: status %d, want %d", w.Code, http.StatusUnprocessableEntity)
+	}
+
+	for range 2 {
+		w = send("DELETE", "/api/v1/contacts/2", "test-delete-joe", "")
+		if w.Code != http.StatusNoContent {
+			t.Errorf("DELETE: status %d, want %d", w.Code, http.StatusNoContent)
+		}
+	}
+	// Without a key it is a new request
+	w = send("DELETE", "/api/v1/contacts/2", "", "")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("DELETE without key: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestAPIIdempotencyKeyScope(t *testing.T) {
+
+	app := new_test_app()
+	send := func(remote, credential, target, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", target, strings.NewReader(body))
+		r.RemoteAddr = remote
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set(idempotency_header, "same-key")
+		switch {
+		case strings.HasPrefix(credential, "Bearer "):
+			r.Header.Set("Authorization", credential)
+		case credential != "":
+			r.AddCookie(&http.Cookie{Name: session_cookie, Value: credential})
+		}
+		w := httptest.NewRecorder()
+		app.routes().ServeHTTP(w, r)
+		return w
+	}
+	const ann = `{"first":"Ann","last":"Lee","email":"ann@example.com","phone":"1"}`
+	const bob = `{"first":"Bob","last":"Lee","email":"bob@example.com","phone":"1"}`
+	const session = "0b6a2f0e-3c1d-4e5f-8a9b-0c1d2e3f4a5b"
+
+	first := send("192.0.2.1:1000", session, "/api/v1/contacts", ann)
+	if first.Code != http.StatusCreated {
+		t.Fatalf("status %d, want %d\n%s", first.Code, http.StatusCreated, first.Body)
+	}
+	// The retry comes from another address after a network change
+	w := send("198.51.100.7:4000", session, "/api/v1/contacts", ann)
+	if w.Code != http.StatusCreated || w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("retry from another address: status %d replayed %q, want the first answer", w.Code, w.Header().Get("Idempotent-Replayed"))
+	}
+	if n, _ := app.Store.Count(); n != 3 {
+		t.Errorf("%d contacts after a retry from another address, want 3", n)
+	}
+
+	// Another session or token with the same key is not answered with Ann,
+	// even from the same address
+	for _, credential := range []string{"7d1e4c2a-9b8f-4a6e-b5d3-2c1f0e9d8a7b", "Bearer other-client"} {
+		w = send("192.0.2.1:1000", credential, "/api/v1/contacts", bob)
+		if w.Header().Get("Idempotent-Replayed") != "" {
+			t.Errorf("credential %q got the answer for another one", credential)
+		}
+	}
+	// Nor the same session at another path
+	w = send("192.0.2.1:1000", session, "/api/v1/contacts:batch", `{"operations":[{"op":"delete","id":2}]}`)
+	if w.Code != http.StatusOK {
+		t.Errorf("another path: status %d, want %d\n%s", w.Code, http.StatusOK, w.Body)
+	}
+
+	w = send("192.0.2.3:1000", "", "/api/v1/contacts", `{"first":"`+strings.Repeat("a", contact_body_max_size)+`"}`)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("body over the route's limit: status %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestIdempotencyCacheLimits(t *testing.T) {
+
+	c := new_idempotency_cache(2, time.Hour)
+	for _, key := range []string{"a", "b", "c"} {
+		c.start(key, [32]byte{})
+	}
+	if _, ok := c.requests["a"]; ok || c.order.Len() != 2 {
+		t.Errorf("%d requests kept with a limit of 2, the oldest should go", c.order.Len())
+	}
+
+	c = new_idempotency_cache(10, time.Millisecond)
+	c.start("a", [32]byte{})
+	time.Sleep(5 * time.Millisecond)
+	if first, _ := c.start("a", [32]byte{1}); !first {
+		t.Error("an expired key is still claimed")
+	}
+	if c.order.Len() != 1 {
+		t.Errorf("%d requests kept, want the expired one dropped", c.order.Len())
+	}
+}
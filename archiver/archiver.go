@@ -0,0 +1,334 @@
+package archiver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Directory the archive files are written to, the system temp dir if empty
+var Dir string
+
+type Status string
+
+const (
+	StatusWaiting  Status = "Waiting"
+	StatusRunning  Status = "Running"
+	StatusComplete Status = "Complete"
+	StatusFailed   Status = "Failed"
+)
+
+// Job describes the archive to build
+type Job struct {
+	// Name the file is downloaded as
+	FileName string
+	// Served as the file's Content-Type
+	ContentType string
+	// Write produces the archive content. It reports how far it got as a value
+	// between 0 and 1 and must give up once ctx is cancelled
+	Write func(ctx context.Context, w io.Writer, progress func(float64)) error
+}
+
+// Snapshot is a copy of an archiver's state at one point in time, it can be
+// rendered while the job keeps running
+type Snapshot struct {
+	Status      Status
+	Progress    float64
+	FilePath    string
+	FileName    string
+	ContentType string
+	Error       string
+}
+
+// Archiver runs one archive job at a time. All its methods are safe for
+// concurrent use
+type Archiver struct {
+	mu          sync.Mutex
+	status      Status
+	progress    float64
+	filePath    string
+	fileName    string
+	contentType string
+	err         string
+
+	// Cancels the running job, nil when there is none
+	cancel context.CancelFunc
+	// Incremented on every Run and Reset, a job only reports back while it is
+	// still the current generation so a cancelled job can't overwrite state
+	gen int
+
+	// Receive a Snapshot after every change, see Subscribe
+	subscribers map[chan Snapshot]struct{}
+}
+
+func New() *Archiver {
+	return &Archiver{status: StatusWaiting}
+}
+
+// Start the archiving process asynchronously, does nothing unless the
+// archiver is waiting
+func (a *Archiver) Run(job Job) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.status != StatusWaiting {
+		return
+	}
+	a.status = StatusRunning
+	a.progress = 0
+	a.err = ""
+	a.gen++
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a.cancel = cancel
+	go a.doArchive(ctx, a.gen, job)
+	a.notify()
+}
+
+// Stop the running job, if any, and go back to waiting
+func (a *Archiver) Cancel() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.status != StatusRunning {
+		return
+	}
+	a.stop()
+	a.status = StatusWaiting
+	a.progress = 0
+	a.notify()
+}
+
+// Cancel any running job and forget the result of the last one
+func (a *Archiver) Reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.stop()
+	if a.filePath != "" {
+		os.Remove(a.filePath)
+	}
+	a.status = StatusWaiting
+	a.progress = 0
+	a.filePath = ""
+	a.fileName = ""
+	a.contentType = ""
+	a.err = ""
+	a.notify()
+}
+
+func (a *Archiver) Snapshot() Snapshot {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.snapshot()
+}
+
+// Subscribe returns a channel that receives the archiver's state after every
+// change, starting with the current one. A slow reader only misses
+// intermediate states, never the latest. Call unsubscribe when done
+func (a *Archiver) Subscribe() (updates <-chan Snapshot, unsubscribe func()) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ch := make(chan Snapshot, 1)
+	ch <- a.snapshot()
+	if a.subscribers == nil {
+		a.subscribers = make(map[chan Snapshot]struct{})
+	}
+	a.subscribers[ch] = struct{}{}
+
+	return ch, func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		delete(a.subscribers, ch)
+	}
+}
+
+// Expects a.mu to be held
+func (a *Archiver) snapshot() Snapshot {
+	return Snapshot{
+		Status:      a.status,
+		Progress:    a.progress,
+		FilePath:    a.filePath,
+		FileName:    a.fileName,
+		ContentType: a.contentType,
+		Error:       a.err,
+	}
+}
+
+func (a *Archiver) ArchiveFile() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.status != StatusComplete {
+		return ""
+	}
+	return a.filePath
+}
+
+// Expects a.mu to be held. Sends never block: a subscriber that has not read
+// the previous snapshot gets it replaced by the new one. Only notify sends, and
+// always under a.mu, so the buffer is free after draining it
+func (a *Archiver) notify() {
+	s := a.snapshot()
+	for ch := range a.subscribers {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- s
+	}
+}
+
+// Expects a.mu to be held
+func (a *Archiver) stop() {
+	if a.cancel != nil {
+		a.cancel()
+		a.cancel = nil
+	}
+	a.gen++
+}
+
+// Is not diretly imported
+func (a *Archiver) doArchive(ctx context.Context, gen int, job Job) {
+
+	f, err := os.CreateTemp(Dir, "archive-*")
+	if err != nil {
+		a.finish(gen, "", job, fmt.Errorf("could not create archive file: %w", err))
+		return
+	}
+
+	err = job.Write(ctx, f, func(p float64) { a.setProgress(gen, p) })
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		a.finish(gen, "", job, err)
+		return
+	}
+
+	if !a.finish(gen, f.Name(), job, nil) {
+		// Cancelled or reset after the file was written
+		os.Remove(f.Name())
+	}
+}
+
+func (a *Archiver) setProgress(gen int, progress float64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.gen != gen {
+		return
+	}
+	a.progress = progress
+	a.notify()
+}
+
+// Record the outcome of job gen, a non nil err marks it as failed. Reports
+// whether gen was still the current job
+func (a *Archiver) finish(gen int, path string, job Job, err error) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.gen != gen {
+		return false
+	}
+	// Releases the context, the job is done with it
+	a.cancel()
+	a.cancel = nil
+	if err != nil {
+		a.status = StatusFailed
+		a.err = err.Error()
+		a.notify()
+		return true
+	}
+	a.status = StatusComplete
+	a.progress = 1
+	a.filePath = path
+	a.fileName = job.FileName
+	a.contentType = job.ContentType
+	a.notify()
+	return true
+}
+
+type userArchiver struct {
+	archiver *Archiver
+	lastUsed time.Time
+}
+
+var (
+	userArchiversMu sync.Mutex
+	userArchivers   = make(map[string]*userArchiver)
+)
+
+func GetArchiverForUser(userID string) *Archiver {
+	userArchiversMu.Lock()
+	defer userArchiversMu.Unlock()
+
+	if u, exists := userArchivers[userID]; exists {
+		u.lastUsed = time.Now()
+		return u.archiver
+	}
+	newArchiver := New()
+	userArchivers[userID] = &userArchiver{newArchiver, time.Now()}
+	return newArchiver
+}
+
+// Drop the archivers nobody asked for in the last ttl, cancelling their jobs
+// and removing their files. Archive files in Dir older than ttl that no
+// archiver knows about (left by a previous run) are removed too
+func Expire(ttl time.Duration) {
+	userArchiversMu.Lock()
+	defer userArchiversMu.Unlock()
+
+	now := time.Now()
+	live := make(map[string]bool)
+	for id, u := range userArchivers {
+		if now.Sub(u.lastUsed) > ttl {
+			u.archiver.Reset()
+			delete(userArchivers, id)
+			continue
+		}
+		if path := u.archiver.Snapshot().FilePath; path != "" {
+			live[path] = true
+		}
+	}
+
+	// Without a Dir of our own we can't tell our files from anyone else's
+	if Dir == "" {
+		return
+	}
+	files, _ := filepath.Glob(filepath.Join(Dir, "archive-*"))
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err == nil && !live[f] && now.Sub(info.ModTime()) > ttl {
+			os.Remove(f)
+		}
+	}
+}
+
+// Shortest time between two Expire runs of StartExpiry
+const minExpiryTick = time.Second
+
+// Call Expire periodically in the background, every ttl/2 but no more often
+// than minExpiryTick
+func StartExpiry(ttl time.Duration) {
+	tick := max(ttl/2, minExpiryTick)
+	go func() {
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+		for range ticker.C {
+			Expire(ttl)
+		}
+	}()
+}
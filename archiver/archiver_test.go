@@ -0,0 +1,230 @@
+package archiver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A job that writes "done" once it is let go, reporting progress first
+func testJob(progress <-chan float64, release <-chan struct{}) Job {
+	return Job{
+		FileName:    "contacts.csv",
+		ContentType: "text/csv",
+		Write: func(ctx context.Context, w io.Writer, report func(float64)) error {
+			for {
+				select {
+				case p := <-progress:
+					report(p)
+				case <-release:
+					_, err := io.WriteString(w, "done")
+					return err
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		},
+	}
+}
+
+// Read snapshots until one has status, failing after a while
+func waitFor(t *testing.T, updates <-chan Snapshot, status Status) Snapshot {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case s := <-updates:
+			if s.Status == status {
+				return s
+			}
+		case <-timeout:
+			t.Fatalf("no %s snapshot", status)
+		}
+	}
+}
+
+func useTempDir(t *testing.T) {
+	old := Dir
+	Dir = t.TempDir()
+	t.Cleanup(func() { Dir = old })
+}
+
+func TestArchiverRun(t *testing.T) {
+	useTempDir(t)
+	a := New()
+	updates, unsubscribe := a.Subscribe()
+	defer unsubscribe()
+	if s := <-updates; s.Status != StatusWaiting {
+		t.Fatalf("starts %s, want Waiting", s.Status)
+	}
+
+	progress, release := make(chan float64), make(chan struct{})
+	a.Run(testJob(progress, release))
+	waitFor(t, updates, StatusRunning)
+	// Run does nothing while a job is running
+	a.Run(testJob(nil, nil))
+
+	progress <- 0.5
+	s := waitFor(t, updates, StatusRunning)
+	for s.Progress != 0.5 {
+		s = waitFor(t, updates, StatusRunning)
+	}
+	close(release)
+	s = waitFor(t, updates, StatusComplete)
+	if s.Progress != 1 || s.FileName != "contacts.csv" || s.ContentType != "text/csv" {
+		t.Errorf("complete snapshot %+v", s)
+	}
+	if a.ArchiveFile() != s.FilePath || filepath.Dir(s.FilePath) != Dir {
+		t.Errorf("archive file %q, snapshot has %q", a.ArchiveFile(), s.FilePath)
+	}
+	data, err := os.ReadFile(s.FilePath)
+	if err != nil || string(data) != "done" {
+		t.Errorf("archive holds %q, %v", data, err)
+	}
+
+	// Reset forgets the archive and removes its file
+	a.Reset()
+	waitFor(t, updates, StatusWaiting)
+	if _, err := os.Stat(s.FilePath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("file left after Reset: %v", err)
+	}
+	if a.ArchiveFile() != "" {
+		t.Error("ArchiveFile after Reset")
+	}
+}
+
+func TestArchiverFailed(t *testing.T) {
+	useTempDir(t)
+	a := New()
+	updates, unsubscribe := a.Subscribe()
+	defer unsubscribe()
+
+	a.Run(Job{Write: func(ctx context.Context, w io.Writer, progress func(float64)) error {
+		return errors.New("disk on fire")
+	}})
+	s := waitFor(t, updates, StatusFailed)
+	if s.Error != "disk on fire" || a.ArchiveFile() != "" {
+		t.Errorf("failed snapshot %+v", s)
+	}
+	files, _ := filepath.Glob(filepath.Join(Dir, "archive-*"))
+	if len(files) != 0 {
+		t.Errorf("files left by a failed job: %v", files)
+	}
+}
+
+// A cancelled job can't report back, not even once its Write returns, and
+// the next job runs as if it had never been
+func TestArchiverCancel(t *testing.T) {
+	useTempDir(t)
+	a := New()
+	updates, unsubscribe := a.Subscribe()
+	defer unsubscribe()
+
+	progress, release := make(chan float64), make(chan struct{})
+	stopped := make(chan struct{})
+	job := testJob(progress, release)
+	write := job.Write
+	job.Write = func(ctx context.Context, w io.Writer, report func(float64)) error {
+		defer close(stopped)
+		err := write(ctx, w, report)
+		// Too late, the archiver has moved on
+		report(0.9)
+		return err
+	}
+	a.Run(job)
+	waitFor(t, updates, StatusRunning)
+	a.Cancel()
+	waitFor(t, updates, StatusWaiting)
+	<-stopped
+
+	if s := a.Snapshot(); s.Status != StatusWaiting || s.Progress != 0 {
+		t.Errorf("snapshot after cancel %+v", s)
+	}
+	files, _ := filepath.Glob(filepath.Join(Dir, "archive-*"))
+	if len(files) != 0 {
+		t.Errorf("files left by a cancelled job: %v", files)
+	}
+
+	// Cancel does nothing unless a job runs
+	a.Cancel()
+	next := make(chan struct{})
+	close(next)
+	a.Run(testJob(nil, next))
+	waitFor(t, updates, StatusComplete)
+}
+
+// Unsubscribed channels get nothing more, and a slow subscriber only ever
+// has the latest snapshot waiting
+func TestArchiverSubscribers(t *testing.T) {
+	useTempDir(t)
+	a := New()
+	slow, unsubscribeSlow := a.Subscribe()
+	defer unsubscribeSlow()
+	gone, unsubscribe := a.Subscribe()
+	<-gone
+	unsubscribe()
+
+	progress, release := make(chan float64), make(chan struct{})
+	a.Run(testJob(progress, release))
+	for _, p := range []float64{0.1, 0.2, 0.3} {
+		progress <- p
+	}
+	close(release)
+	for a.Snapshot().Status != StatusComplete {
+		time.Sleep(time.Millisecond)
+	}
+
+	if len(slow) != 1 {
+		t.Fatalf("%d snapshots waiting, want 1", len(slow))
+	}
+	if s := <-slow; s.Status != StatusComplete {
+		t.Errorf("slow subscriber has %s, want the latest", s.Status)
+	}
+	select {
+	case s := <-gone:
+		t.Errorf("unsubscribed channel got %+v", s)
+	default:
+	}
+}
+
+func TestExpire(t *testing.T) {
+	useTempDir(t)
+	const ttl = 50 * time.Millisecond
+
+	idle := GetArchiverForUser("idle")
+	release := make(chan struct{})
+	close(release)
+	updates, unsubscribe := idle.Subscribe()
+	defer unsubscribe()
+	idle.Run(testJob(nil, release))
+	path := waitFor(t, updates, StatusComplete).FilePath
+
+	// Left by an earlier run of the program
+	stale := filepath.Join(Dir, "archive-stale")
+	err := os.WriteFile(stale, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(stale, old, old)
+
+	time.Sleep(2 * ttl)
+	active := GetArchiverForUser("active")
+	Expire(ttl)
+
+	if GetArchiverForUser("active") != active {
+		t.Error("an active archiver was dropped")
+	}
+	if GetArchiverForUser("idle") == idle {
+		t.Error("the idle archiver was kept")
+	}
+	for _, f := range []string{path, stale} {
+		if _, err := os.Stat(f); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s was kept: %v", f, err)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+// POST /api/v1/contacts:batch creates, updates and deletes many contacts in
+// one request. Every operation is validated first, against the contacts as
+// the operations before it leave them. An atomic batch (the default) is then
+// stored in one ContactStore.Apply, or not at all when any operation is
+// wrong. A best effort batch stores the operations that are right one by one
+// and reports the others
+
+// Most operations a batch takes
+const batch_max_ops = 100
+
+// Largest batch body we read
+const batch_body_max_size = 1 << 20
+
+const (
+	batch_atomic      = "atomic"
+	batch_best_effort = "best_effort"
+)
+
+type batch_request struct {
+	// batch_atomic or batch_best_effort, atomic when empty
+	Mode       string     `json:"mode"`
+	Operations []batch_op `json:"operations"`
+}
+
+// One operation of a batch. Contact is the whole contact to create or to
+// replace the one with ID with. Version, when set, is the version updates and
+// deletes must find stored, as with If-Match
+type batch_op struct {
+	Op      string        `json:"op"`
+	ID      int           `json:"id,omitempty"`
+	Version int           `json:"version,omitempty"`
+	Contact *contact_body `json:"contact,omitempty"`
+}
+
+// What happened to an operation, Status is the one the single request doing
+// it would have been answered with
+type batch_result struct {
+	Index  int    `json:"index"`
+	Op     string `json:"op"`
+	Status int    `json:"status"`
+	// The stored contact, after creates and updates
+	Contact *Contact          `json:"contact,omitempty"`
+	Detail  string            `json:"detail,omitempty"`
+	Errors  map[string]string `json:"errors,omitempty"`
+}
+
+func (res batch_result) ok() bool {
+	return res.Status < 300
+}
+
+type batch_response struct {
+	Mode string `json:"mode"`
+	// How many operations were stored
+	Applied int            `json:"applied"`
+	Results []batch_result `json:"results"`
+}
+
+// POST /api/v1/contacts:batch
+// 200 with a result for every operation when the batch was applied, as much
+// of it as could be in best effort mode. An atomic batch with a wrong
+// operation is a 422 listing the results in the problem
+func (app *App) batch_contacts_handler(w http.ResponseWriter, r *http.Request) {
+
+	r.Body = http.MaxBytesReader(w, r.Body, batch_body_max_size)
+	media_type, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if media_type != "application/json" {
+		write_problem(w, r, problem_media_type.problem("A batch is sent as application/json"))
+		return
+	}
+	var req batch_request
+	err := decode_json_body(r.Body, &req)
+	if err != nil {
+		write_body_error(w, r, err)
+		log.Error("batch_contacts_handler: error in decode_json_body", "error", err)
+		return
+	}
+
+	if req.Mode == "" {
+		req.Mode = batch_atomic
+	}
+	errs := make(map[string]string)
+	if req.Mode != batch_atomic && req.Mode != batch_best_effort {
+		errs["mode"] = "mode must be " + batch_atomic + " or " + batch_best_effort
+	}
+	if len(req.Operations) == 0 {
+		errs["operations"] = "The batch has no operations"
+	} else if len(req.Operations) > batch_max_ops {
+		errs["operations"] = fmt.Sprintf("A batch takes at most %d operations", batch_max_ops)
+	}
+	if len(errs) > 0 {
+		p := problem_invalid_batch.problem("Could not read the batch")
+		p.Errors = errs
+		write_problem(w, r, p)
+		return
+	}
+
+	results, ops, err := app.validate_batch(req.Operations)
+	if err != nil {
+		write_problem(w, r, problem_internal.problem("Error validating the batch"))
+		log.Error("batch_contacts_handler: error in app.validate_batch", "error", err)
+		return
+	}
+
+	res := batch_response{Mode: req.Mode, Results: results}
+	if req.Mode == batch_atomic {
+		failed := len(ops) < len(results)
+		if !failed {
+			stored, err := app.Store.Apply(ops)
+			var op_err *OpError
+			if errors.As(err, &op_err) && batch_store_error(&results[op_err.Index], op_err.Err) {
+				// Someone changed the contacts after we validated
+				failed = true
+			} else if err != nil {
+				write_problem(w, r, problem_internal.problem("Error, could not save contacts"))
+				log.Error("batch_contacts_handler: error in app.Store.Apply", "error", err)
+				return
+			} else {
+				for i := range results {
+					batch_stored(&results[i], stored[i])
+				}
+				res.Applied = len(ops)
+			}
+		}
+		if failed {
+			for i := range results {
+				if results[i].ok() {
+					results[i].Status = http.StatusFailedDependency
+					results[i].Detail = "Not applied, another operation of the batch failed"
+				}
+			}
+			p := problem_batch_failed.problem("Nothing was stored, see results for the operations that failed")
+			p.Results = results
+			write_problem(w, r, p)
+			log.Error("batch_contacts_handler: batch failed", "operations", len(results))
+			return
+		}
+	} else {
+		// ops only has the operations that passed validation
+		next := 0
+		for i := range results {
+			if !results[i].ok() {
+				continue
+			}
+			stored, err := app.Store.Apply(ops[next : next+1])
+			next++
+			var op_err *OpError
+			if errors.As(err, &op_err) && batch_store_error(&results[i], op_err.Err) {
+				continue
+			}
+			if err != nil {
+				results[i].Status = http.StatusInternalServerError
+				results[i].Detail = "Could not save the contact"
+				log.Error("batch_contacts_handler: error in app.Store.Apply", "index", i, "error", err)
+				continue
+			}
+			batch_stored(&results[i], stored[0])
+			res.Applied++
+		}
+	}
+
+	log.Info("Batch applied", "mode", res.Mode, "applied", res.Applied, "operations", len(results))
+	write_json(w, r, http.StatusOK, res)
+}
+
+// The contacts as a batch leaves them, so every operation is validated
+// against what the ones before it did
+type batch_state struct {
+	// Who has each email, contacts the batch creates get negative ids
+	owner map[string]int
+	// The version of every contact, as its updates leave it
+	versions map[int]int
+}
+
+// Validate every operation as if the valid ones before it had been applied.
+// Returns a result for each, with the status the operation is answered with
+// when it is applied, and the store ops for the valid ones
+func (app *App) validate_batch(batch []batch_op) ([]batch_result, []StoreOp, error) {
+
+	existing, err := app.Store.List(0, -1)
+	if err != nil {
+		return nil, nil, fmt.Errorf("validate_batch: error in app.Store.List: %w", err)
+	}
+	st := batch_state{make(map[string]int, len(existing)), make(map[int]int, len(existing))}
+	for _, c := range existing {
+		st.owner[c.Email] = c.ID
+		st.versions[c.ID] = c.Version
+	}
+
+	results := make([]batch_result, len(batch))
+	var ops []StoreOp
+	for i, op := range batch {
+		res := &results[i]
+		res.Index, res.Op = i, op.Op
+
+		id := op.ID
+		switch op.Op {
+		case OpCreate:
+			id = -1 - i
+		case OpUpdate, OpDelete:
+			version, ok := st.versions[op.ID]
+			if !ok {
+				res.Status = http.StatusNotFound
+				res.Detail = "No contact has id " + strconv.Itoa(op.ID)
+				continue
+			}
+			if op.Version != 0 && op.Version != version {
+				res.Status = http.StatusPreconditionFailed
+				res.Detail = fmt.Sprintf("Contact %d is at version %d, not %d", op.ID, version, op.Version)
+				continue
+			}
+		default:
+			res.Status = http.StatusBadRequest
+			res.Detail = "op must be " + OpCreate + ", " + OpUpdate + " or " + OpDelete
+			res.Errors = map[string]string{"op": res.Detail}
+			continue
+		}
+
+		if op.Op == OpDelete {
+			if op.Contact != nil {
+				res.Status = http.StatusBadRequest
+				res.Detail = "A delete takes no contact"
+				res.Errors = map[string]string{"contact": res.Detail}
+				continue
+			}
+			res.Status = http.StatusNoContent
+			delete(st.versions, id)
+			for email, owner := range st.owner {
+				if owner == id {
+					delete(st.owner, email)
+				}
+			}
+			ops = append(ops, StoreOp{OpDelete, Contact{ID: id, Version: op.Version}})
+			continue
+		}
+
+		if op.Contact == nil {
+			res.Status = http.StatusBadRequest
+			res.Detail = "The contact is missing"
+			res.Errors = map[string]string{"contact": res.Detail}
+			continue
+		}
+		b := op.Contact
+		c := Contact{ID: id, First: b.First, Last: b.Last, Email: b.Email, Phone: b.Phone, Errors: make(map[string]string)}
+		validate_contact(&c, check_email(c.Email, func(email string) bool {
+			other, ok := st.owner[email]
+			return ok && other != id
+		}))
+		if len(c.Errors) > 0 {
+			res.Status = http.StatusUnprocessableEntity
+			if len(c.Errors) == 1 && c.Errors["email"] == email_taken_message {
+				res.Status = http.StatusConflict
+			}
+			res.Detail = "The contact is not valid"
+			res.Errors = c.Errors
+			continue
+		}
+
+		for email, owner := range st.owner {
+			if owner == id {
+				delete(st.owner, email)
+			}
+		}
+		st.owner[c.Email] = id
+		if op.Op == OpCreate {
+			res.Status = http.StatusCreated
+			c.ID = 0
+			ops = append(ops, StoreOp{OpCreate, c})
+		} else {
+			res.Status = http.StatusOK
+			c.Version = op.Version
+			st.versions[id]++
+			ops = append(ops, StoreOp{OpUpdate, c})
+		}
+	}
+	return results, ops, nil
+}
+
+// Record in res the contact its operation stored
+func batch_stored(res *batch_result, c Contact) {
+
+	if res.Op != OpDelete {
+		res.Contact = &c
+	}
+}
+
+// Record in res why the store did not apply its operation, when it is one of
+// the errors the operation itself is to blame for
+func batch_store_error(res *batch_result, err error) bool {
+
+	switch {
+	case errors.Is(err, ErrEmailTaken):
+		res.Status = http.StatusConflict
+		res.Detail = "The contact is not valid"
+		res.Errors = map[string]string{"email": email_taken_message}
+	case errors.Is(err, ErrNotFound):
+		res.Status = http.StatusNotFound
+		res.Detail = "The contact was deleted in the meantime"
+	case errors.Is(err, ErrVersionChanged):
+		res.Status = http.StatusPreconditionFailed
+		res.Detail = "The contact was changed in the meantime"
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Largest contact the API reads from a request body
+const contact_body_max_size = 64 << 10
+
+// The fields of a contact clients send, as the Contact JSON tags name them.
+// The id comes from the URL or the store, the version from If-Match and errors
+// only ever go out, but a contact as a GET answers with it can be sent back
+// whole, so those members are taken and ignored
+type contact_body struct {
+	First string `json:"first"`
+	Last  string `json:"last"`
+	Email string `json:"email"`
+	Phone string `json:"phone"`
+
+	ID      json.RawMessage `json:"id"`
+	Version json.RawMessage `json:"version"`
+	Errors  json.RawMessage `json:"errors"`
+}
+
+// Why a request body could not be read, Type is the problem the API answers
+// with
+type body_error struct {
+	Type    problem_type
+	Message string
+}
+
+func (e *body_error) Error() string {
+	return e.Message
+}
+
+// A member of a JSON body the value it is decoded into has no field for
+type unknown_field_error struct {
+	Field string
+}
+
+func (e *unknown_field_error) Error() string {
+	return fmt.Sprintf("Body has no field %q", e.Field)
+}
+
+// The contact in r's body, either a JSON object with the Contact fields or
+// form fields named first_name, last_name, email and phone as the API took
+// them before. Errors are a *body_error
+func read_contact_body(w http.ResponseWriter, r *http.Request) (Contact, error) {
+
+	r.Body = http.MaxBytesReader(w, r.Body, contact_body_max_size)
+
+	media_type := ""
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		var err error
+		media_type, _, err = mime.ParseMediaType(ct)
+		if err != nil {
+			return Contact{}, &body_error{problem_media_type, "Content-Type is not a valid media type"}
+		}
+	}
+
+	switch media_type {
+	case "application/json":
+		var b contact_body
+		err := decode_json_body(r.Body, &b)
+		var field_err *unknown_field_error
+		if errors.As(err, &field_err) {
+			// The same as a PATCH adding the field
+			return Contact{}, &body_error{problem_invalid_contact, fmt.Sprintf("Contacts have no field %q", field_err.Field)}
+		}
+		if err != nil {
+			return Contact{}, err
+		}
+		return Contact{First: b.First, Last: b.Last, Email: b.Email, Phone: b.Phone}, nil
+
+	// Without a Content-Type the fields can still come in the URL
+	case "", "application/x-www-form-urlencoded", "multipart/form-data":
+		err := r.ParseMultipartForm(contact_body_max_size)
+		if err != nil && !errors.Is(err, http.ErrNotMultipart) {
+			return Contact{}, form_body_error(err)
+		}
+		return Contact{
+			First: r.FormValue("first_name"),
+			Last:  r.FormValue("last_name"),
+			Email: r.FormValue("email"),
+			Phone: r.FormValue("phone"),
+		}, nil
+	}
+	return Contact{}, &body_error{problem_media_type,
+		fmt.Sprintf("Content-Type %s is not supported, send application/json or application/x-www-form-urlencoded", media_type)}
+}
+
+// Decode the single JSON object in body into v, which has to have a field for
+// every member of it. A member it has none for is an *unknown_field_error,
+// other errors are a *body_error
+func decode_json_body(body io.Reader, v any) error {
+
+	dec := json.NewDecoder(body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil && dec.More() {
+		err = errors.New("body must hold a single JSON object")
+	}
+	if err == nil {
+		return nil
+	}
+
+	var max_err *http.MaxBytesError
+	var syntax_err *json.SyntaxError
+	var type_err *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &max_err):
+		return &body_error{problem_body_too_large, fmt.Sprintf("Body is larger than %d bytes", max_err.Limit)}
+	case errors.As(err, &syntax_err):
+		return &body_error{problem_invalid_body, fmt.Sprintf("Body is not valid JSON at byte %d", syntax_err.Offset)}
+	case errors.As(err, &type_err):
+		return &body_error{problem_invalid_body, fmt.Sprintf("Field %s must be a %s", type_err.Field, type_err.Type)}
+	case errors.Is(err, io.EOF):
+		return &body_error{problem_invalid_body, "Body is empty"}
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return &body_error{problem_invalid_body, "Body is cut short"}
+	}
+	// Unknown fields only come as a plain error
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		if unquoted, err := strconv.Unquote(field); err == nil {
+			field = unquoted
+		}
+		return &unknown_field_error{field}
+	}
+	return &body_error{problem_invalid_body, "Body is not valid: " + err.Error()}
+}
+
+func form_body_error(err error) error {
+
+	var max_err *http.MaxBytesError
+	if errors.As(err, &max_err) {
+		return &body_error{problem_body_too_large, fmt.Sprintf("Body is larger than %d bytes", max_err.Limit)}
+	}
+	return &body_error{problem_invalid_body, "Could not read the form"}
+}
+
+// Answer a request whose body read_contact_body could not read
+func write_body_error(w http.ResponseWriter, r *http.Request, err error) {
+
+	t := problem_invalid_body
+	var be *body_error
+	if errors.As(err, &be) {
+		t = be.Type
+	}
+	write_problem(w, r, t.problem(err.Error()))
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"cmp"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+
+	"golang.org/x/text/collate"
+)
+
+// Cursor pagination for the JSON API. A page is asked for as the contacts
+// after (or before) a cursor rather than at an offset. The cursor holds where
+// the contact it was taken from sorts in the list, so contacts created or
+// deleted between requests neither shift rows onto the next page twice nor
+// past it unseen, even when that contact itself is gone
+
+// Where a page starts or ends. Encoded it is sealed, clients can't read it or
+// change it
+type cursor struct {
+	// The page is the contacts before the position, not after it
+	Before bool `json:"b,omitempty"`
+	// The cursor's own contact is on the page
+	Incl bool `json:"n,omitempty"`
+	// Fingerprint of the query and order the cursor was taken in
+	List string `json:"l"`
+	// The contact the cursor was taken from, as the order sees it: its id,
+	// score and sort keys, never its fields
+	ID    int      `json:"i"`
+	Score int      `json:"s"`
+	Keys  [][]byte `json:"k,omitempty"`
+}
+
+var ErrBadCursor = errors.New("cursor is invalid, from before a restart, or belongs to another query or order")
+
+// Cursors are sealed with AES-GCM under a key of the running server, which
+// keeps the sort keys out of URLs and logs and, like an HMAC, rejects any
+// cursor the server did not make. The nonce is an HMAC of the cursor, so the
+// same page always has the same links and its ETag holds. A restart makes
+// earlier cursors invalid, clients start again from the first page
+var cursor_aead, cursor_nonce_key = new_cursor_keys()
+
+func new_cursor_keys() (cipher.AEAD, []byte) {
+
+	key := make([]byte, 64)
+	rand.Read(key)
+	block, err := aes.NewCipher(key[:32])
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return aead, key[32:]
+}
+
+func (c cursor) encode() string {
+
+	b, _ := json.Marshal(c)
+	mac := hmac.New(sha256.New, cursor_nonce_key)
+	mac.Write(b)
+	nonce := mac.Sum(nil)[:cursor_aead.NonceSize()]
+	return base64.RawURLEncoding.EncodeToString(cursor_aead.Seal(nonce, nonce, b, nil))
+}
+
+// Decode s, which must have been taken from the list with fingerprint list
+func decode_cursor(s string, list string) (cursor, error) {
+
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	n := cursor_aead.NonceSize()
+	if err != nil || len(b) < n {
+		return cursor{}, ErrBadCursor
+	}
+	b, err = cursor_aead.Open(nil, b[:n], b[n:], nil)
+	if err != nil {
+		return cursor{}, ErrBadCursor
+	}
+	var c cursor
+	err = json.Unmarshal(b, &c)
+	if err != nil || c.List != list {
+		return cursor{}, ErrBadCursor
+	}
+	return c, nil
+}
+
+// Identifies a query and order, so a cursor is not used with another one.
+// Sort keys depend on the language names are collated in, so it is part of
+// the order
+func list_fingerprint(text string, order *SortOrder) string {
+
+	v := url.Values{}
+	v.Set("q", text)
+	order.set_params(v)
+	if order != nil {
+		v.Set("lang", order.lang.String())
+	}
+	h := fnv.New64a()
+	h.Write([]byte(v.Encode()))
+	return strconv.FormatUint(h.Sum64(), 36)
+}
+
+// The limit parameter of r, like per_page it is kept between 1 and
+// max_per_page
+func parse_limit(r *http.Request) int {
+
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = default_per_page
+	}
+	return min(limit, max_per_page)
+}
+
+// A contact with what the cursor order compares it by
+type cursor_entry struct {
+	c     Contact
+	score int
+	keys  [][]byte
+}
+
+// The total order cursors page through: order, then best matches first, then
+// by id so no two contacts are ever equal
+type cursor_order struct {
+	order *SortOrder
+	buf   collate.Buffer
+}
+
+func (o *cursor_order) entry(c Contact, score int) cursor_entry {
+
+	e := cursor_entry{c: c, score: score}
+	if o.order != nil {
+		e.keys = o.order.sort_keys(&o.buf, c)
+	}
+	return e
+}
+
+func (o *cursor_order) compare(a, b cursor_entry) int {
+
+	if o.order != nil {
+		if n := o.order.compare_keys(a.keys, b.keys); n != 0 {
+			return n
+		}
+	}
+	if n := cmp.Compare(b.score, a.score); n != 0 {
+		return n
+	}
+	return cmp.Compare(a.c.ID, b.c.ID)
+}
+
+func new_cursor(list string, e cursor_entry, before, incl bool) *cursor {
+	return &cursor{Before: before, Incl: incl, List: list, ID: e.c.ID, Score: e.score, Keys: e.keys}
+}
+
+// A page of the contacts query matches, and how many it matches
+type cursor_page struct {
+	Contacts []Contact
+	Total    int
+	// Cursors for the pages around this one, nil at either end of the list
+	Prev *cursor
+	Next *cursor
+}
+
+// Up to limit of the contacts query matches next to cur, from the start of
+// the list when cur is nil. Only the contacts nearest the cursor are kept and
+// sorted, the others are just counted
+func (app *App) cursor_contact_list(query *Query, order *SortOrder, list string, cur *cursor, limit int) (cursor_page, error) {
+
+	o := &cursor_order{order: order}
+	backward := cur != nil && cur.Before
+	var at cursor_entry
+	if cur != nil {
+		at = cursor_entry{c: Contact{ID: cur.ID}, score: cur.Score, keys: cur.Keys}
+	}
+	// Below 0 when a is nearer the cursor than b, going the way the page goes
+	nearer := func(a, b cursor_entry) int {
+		if backward {
+			return o.compare(b, a)
+		}
+		return o.compare(a, b)
+	}
+
+	// The contacts on the page's side of the cursor, nearest first, and
+	// whether more are there than fit. behind is the nearest contact on the
+	// other side
+	var near []cursor_entry
+	var behind *cursor_entry
+	more := false
+	total := 0
+	err := app.Store.Matches(query, func(c Contact, score int) {
+		total++
+		e := o.entry(c, score)
+		if cur != nil {
+			// The cursor's own contact compares equal while it exists unchanged
+			n := nearer(at, e)
+			if n > 0 || n == 0 && !cur.Incl {
+				if behind == nil || nearer(e, *behind) < 0 {
+					e.c = clone_contact(c)
+					behind = &e
+				}
+				return
+			}
+		}
+		i, _ := slices.BinarySearchFunc(near, e, nearer)
+		if i == limit {
+			more = true
+			return
+		}
+		if len(near) == limit {
+			near = near[:limit-1]
+			more = true
+		}
+		e.c = clone_contact(c)
+		near = slices.Insert(near, i, e)
+	})
+	if err != nil {
+		return cursor_page{}, err
+	}
+
+	page := cursor_page{Total: total, Contacts: make([]Contact, len(near))}
+	if backward {
+		slices.Reverse(near)
+	}
+	for i, e := range near {
+		page.Contacts[i] = e.c
+	}
+
+	// Taken from the page's own contacts, so anything created next to the
+	// page since is on the next one. An empty page has none, the contact
+	// behind the cursor is kept instead
+	has_prev, has_next := behind != nil, more
+	if backward {
+		has_prev, has_next = more, behind != nil
+	}
+	switch {
+	case !has_prev:
+	case len(near) > 0:
+		page.Prev = new_cursor(list, near[0], true, false)
+	default:
+		page.Prev = new_cursor(list, *behind, true, true)
+	}
+	switch {
+	case !has_next:
+	case len(near) > 0:
+		page.Next = new_cursor(list, near[len(near)-1], false, false)
+	default:
+		page.Next = new_cursor(list, *behind, false, true)
+	}
+	return page, nil
+}
+
+//------------------------------------------------------------------------------
+// JSON API
+//------------------------------------------------------------------------------
+
+// A page of the contact list in the JSON API, when it is asked for by cursor
+type contact_cursor_response struct {
+	Data  []Contact             `json:"data"`
+	Total int                   `json:"total"`
+	Limit int                   `json:"limit"`
+	Links cursor_links_response `json:"links"`
+}
+
+// Prev and Next are left out at either end of the list
+type cursor_links_response struct {
+	Self  string `json:"self"`
+	First string `json:"first"`
+	Prev  string `json:"prev,omitempty"`
+	Next  string `json:"next,omitempty"`
+}
+
+// Links to the pages around the one at u, keeping its other parameters
+func cursor_links(u *url.URL, page cursor_page, limit int) cursor_links_response {
+
+	link := func(c *cursor) string {
+		v := u.Query()
+		v.Del("page")
+		v.Del("per_page")
+		v.Del("cursor")
+		if c != nil {
+			v.Set("cursor", c.encode())
+		}
+		v.Set("limit", strconv.Itoa(limit))
+		return u.Path + "?" + v.Encode()
+	}
+	links := cursor_links_response{Self: u.RequestURI(), First: link(nil)}
+	if page.Prev != nil {
+		links.Prev = link(page.Prev)
+	}
+	if page.Next != nil {
+		links.Next = link(page.Next)
+	}
+	return links
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/language"
+)
+
+// Page through the contacts by cursor, forward to the end and back again,
+// while contacts are created and deleted between pages. Every contact there
+// from start to end is seen exactly once each way, the others at most once
+func TestCursorPagingWhileChanging(t *testing.T) {
+
+	names := []string{"Ann", "Bob", "Cem", "Dana", "Eve", "Finn", "Gus"}
+	orders := []struct{ sort, dir string }{{"", ""}, {"last", "asc"}, {"first,last", "desc,asc"}}
+	for _, tt := range orders {
+		t.Run(tt.sort+" "+tt.dir, func(t *testing.T) {
+			rnd := rand.New(rand.NewSource(1))
+			created := 0
+			create := func(s ContactStore) Contact {
+				created++
+				c, err := s.Create(Contact{
+					First: names[rnd.Intn(len(names))],
+					Last:  names[rnd.Intn(len(names))],
+					Email: fmt.Sprintf("c%d@example.com", created),
+					Phone: "555-0100",
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return c
+			}
+
+			s := newMemoryStore(nil)
+			app := &App{Store: s}
+			for range 60 {
+				create(s)
+			}
+			query, err := parse_query("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			order, err := parse_sort(tt.sort, tt.dir, language.English)
+			if err != nil {
+				t.Fatal(err)
+			}
+			list := list_fingerprint("", order)
+
+			// Take a page, then create two contacts and delete one or two,
+			// every other time the contact the next cursor is taken from
+			walk := func(start *cursor, next func(cursor_page) *cursor) map[int]int {
+				existing, err := s.List(0, -1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				survivors := make(map[int]bool)
+				for _, c := range existing {
+					survivors[c.ID] = true
+				}
+				seen := make(map[int]int)
+				cur := start
+				for i := range 100 {
+					page, err := app.cursor_contact_list(query, order, list, cur, 7)
+					if err != nil {
+						t.Fatal(err)
+					}
+					for _, c := range page.Contacts {
+						seen[c.ID]++
+					}
+					cur = next(page)
+					if cur == nil {
+						break
+					}
+					create(s)
+					create(s)
+					cs, err := s.List(0, -1)
+					if err != nil {
+						t.Fatal(err)
+					}
+					ids := []int{cs[rnd.Intn(len(cs))].ID}
+					if i%2 == 0 {
+						ids = append(ids, cur.ID)
+					}
+					for _, id := range ids {
+						if s.Delete(id) == nil {
+							delete(survivors, id)
+						}
+					}
+				}
+				if cur != nil {
+					t.Fatal("paging did not end")
+				}
+				for id, n := range seen {
+					if n > 1 {
+						t.Errorf("contact %d is on %d pages", id, n)
+					}
+				}
+				for id := range survivors {
+					if seen[id] != 1 {
+						t.Errorf("contact %d is on %d pages, want 1", id, seen[id])
+					}
+				}
+				return seen
+			}
+
+			var last *cursor
+			walk(nil, func(p cursor_page) *cursor {
+				if p.Next == nil && len(p.Contacts) > 0 {
+					// Back from the end, including this last page
+					c := p.Contacts[len(p.Contacts)-1]
+					o := &cursor_order{order: order}
+					last = new_cursor(list, o.entry(c, query.Score(c)), true, true)
+				}
+				return p.Next
+			})
+			if last == nil {
+				t.Fatal("no last page")
+			}
+			walk(last, func(p cursor_page) *cursor { return p.Prev })
+		})
+	}
+}
+
+// A cursor gives nothing of its contact away, and one the server did not make
+// as it is, or made for another list, is a 400
+func TestCursorSealed(t *testing.T) {
+
+	app := new_test_app()
+	next := func(target, lang string) (string, string) {
+		r := httptest.NewRequest("GET", target, nil)
+		r.Header.Set("Accept-Language", lang)
+		w := httptest.NewRecorder()
+		app.routes().ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d\n%s", target, w.Code, w.Body)
+		}
+		var res contact_cursor_response
+		err := json.Unmarshal(w.Body.Bytes(), &res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := url.Parse(res.Links.Next)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u.Query().Get("cursor"), w.Header().Get("ETag")
+	}
+	status := func(cursor, lang string) int {
+		r := httptest.NewRequest("GET", "/api/v1/contacts?limit=1&sort=email&cursor="+url.QueryEscape(cursor), nil)
+		r.Header.Set("Accept-Language", lang)
+		w := httptest.NewRecorder()
+		app.routes().ServeHTTP(w, r)
+		return w.Code
+	}
+
+	cur, etag := next("/api/v1/contacts?limit=1&sort=email", "en")
+	raw, err := base64.RawURLEncoding.DecodeString(cur)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"carson", "Carson", "Gross", "example"} {
+		if bytes.Contains(raw, []byte(s)) || strings.Contains(cur, s) {
+			t.Errorf("cursor %s holds %s", cur, s)
+		}
+	}
+	// The same page has the same links, so its ETag holds
+	if again, etag2 := next("/api/v1/contacts?limit=1&sort=email", "en"); again != cur || etag2 != etag {
+		t.Errorf("the same page got cursor %s and ETag %s, then %s and %s", cur, etag, again, etag2)
+	}
+
+	if code := status(cur, "en"); code != http.StatusOK {
+		t.Errorf("the cursor as given: status %d, want %d", code, http.StatusOK)
+	}
+	raw[len(raw)-1] ^= 1
+	if code := status(base64.RawURLEncoding.EncodeToString(raw), "en"); code != http.StatusBadRequest {
+		t.Errorf("a changed cursor: status %d, want %d", code, http.StatusBadRequest)
+	}
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"l":"x","i":1}`))
+	if code := status(forged, "en"); code != http.StatusBadRequest {
+		t.Errorf("a made up cursor: status %d, want %d", code, http.StatusBadRequest)
+	}
+	// Sort keys are collated for the language they were taken in
+	if code := status(cur, "sv"); code != http.StatusBadRequest {
+		t.Errorf("the cursor in another language: status %d, want %d", code, http.StatusBadRequest)
+	}
+}
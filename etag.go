@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Optimistic concurrency for the JSON API. Every GET answers with a strong
+// ETag, which If-None-Match can send back to get a 304 instead of the same
+// body again. A contact's ETag is its id and version, and stores never give a
+// deleted contact's id out again, so a PUT, PATCH or DELETE with If-Match only
+// goes through while nobody has changed the contact since it was read, and is
+// answered with a 412 otherwise
+
+// The ETag of c as it is at its version
+func contact_etag(c Contact) string {
+	return fmt.Sprintf(`"%d-%d"`, c.ID, c.Version)
+}
+
+// The ETag of a response with body, for the ones not about a single contact
+func body_etag(body []byte) string {
+
+	sum := sha256.Sum256(body)
+	return `"` + base64.RawURLEncoding.EncodeToString(sum[:16]) + `"`
+}
+
+// Whether the list of entity tags in header (an If-Match or If-None-Match)
+// names etag. "*" names any. The weak comparison ignores the W/ of weak tags,
+// the strong one never matches them
+func etag_listed(header, etag string, weak bool) bool {
+
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		if strings.HasPrefix(tag, "W/") {
+			if !weak {
+				continue
+			}
+			tag = tag[2:]
+		}
+		if tag == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Answer a GET whose If-None-Match names etag with a 304 and report true, the
+// response has been written then
+func not_modified(w http.ResponseWriter, r *http.Request, etag string) bool {
+
+	inm := r.Header.Get("If-None-Match")
+	if inm == "" || !etag_listed(inm, etag, true) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// The version of c a change must find stored, given r's If-Match. 0 when r has
+// none, or when it is "*", so it goes through whatever the version. When
+// If-Match does not name c as it is now the request is answered with a 412
+// and ok is false
+func if_match_version(w http.ResponseWriter, r *http.Request, c Contact) (int, bool) {
+
+	im := r.Header.Get("If-Match")
+	if im == "" || strings.TrimSpace(im) == "*" {
+		return 0, true
+	}
+	if !etag_listed(im, contact_etag(c), false) {
+		write_version_changed(w, r, c.ID)
+		return 0, false
+	}
+	return c.Version, true
+}
+
+// Answer a change that found the contact at another version than it expected
+func write_version_changed(w http.ResponseWriter, r *http.Request, id int) {
+	write_problem(w, r, problem_precondition_failed.problem("Contact "+strconv.Itoa(id)+" was changed since it was read, get it again and retry"))
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"hypermedia/archiver"
+	"io"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+var csv_header = []string{"id", "first", "last", "email", "phone"}
+
+// An archive format the user can pick in archive_ui
+type ExportFormat struct {
+	Name        string
+	Label       string
+	FileName    string
+	ContentType string
+	write       func(ctx context.Context, w io.Writer, contacts []Contact, opts export_options, progress func(float64)) error
+}
+
+type export_options struct {
+	// Field separator for csv
+	Delimiter rune
+}
+
+var export_formats = []ExportFormat{
+	{"zip", "ZIP (JSON, CSV and vCards)", "contacts.zip", "application/zip", write_contacts_zip},
+	{"csv", "CSV", "contacts.csv", "text/csv; charset=utf-8", write_contacts_csv},
+	{"vcard3", "vCard 3.0", "contacts.vcf", "text/vcard; charset=utf-8", write_contacts_vcard("3.0")},
+	{"vcard4", "vCard 4.0", "contacts.vcf", "text/vcard; charset=utf-8", write_contacts_vcard("4.0")},
+	{"ndjson", "JSON Lines", "contacts.ndjson", "application/x-ndjson", write_contacts_ndjson},
+	{"json", "JSON", "contacts.json", "application/json", write_contacts_json},
+}
+
+// The csv delimiters offered in archive_ui, by form value
+var csv_delimiters = map[string]rune{
+	"comma":     ',',
+	"semicolon": ';',
+	"tab":       '\t',
+	"pipe":      '|',
+}
+
+// Build the archiver job for format. contacts is a snapshot taken when the
+// archive was requested, later changes to the store do not end up half way in
+// the file
+func new_export(format string, delimiter string, contacts []Contact) (archiver.Job, error) {
+
+	// What the archive used to be before there was a choice
+	if format == "" {
+		format = "zip"
+	}
+
+	var f *ExportFormat
+	for i := range export_formats {
+		if export_formats[i].Name == format {
+			f = &export_formats[i]
+		}
+	}
+	if f == nil {
+		return archiver.Job{}, fmt.Errorf("new_export: error, unknown format %q", format)
+	}
+
+	opts := export_options{Delimiter: ','}
+	if delimiter != "" {
+		d, err := parse_delimiter(delimiter)
+		if err != nil {
+			return archiver.Job{}, fmt.Errorf("new_export: %w", err)
+		}
+		opts.Delimiter = d
+	}
+
+	return archiver.Job{
+		FileName:    f.FileName,
+		ContentType: f.ContentType,
+		Write: func(ctx context.Context, w io.Writer, progress func(float64)) error {
+			return f.write(ctx, w, contacts, opts, progress)
+		},
+	}, nil
+}
+
+// A name from csv_delimiters or the character itself
+func parse_delimiter(delimiter string) (rune, error) {
+
+	d, ok := csv_delimiters[delimiter]
+	if ok {
+		return d, nil
+	}
+	r, size := utf8.DecodeRuneInString(delimiter)
+	if size != len(delimiter) || r == '"' || r == '\r' || r == '\n' || r == utf8.RuneError {
+		return 0, fmt.Errorf("parse_delimiter: error, invalid delimiter %q", delimiter)
+	}
+	return r, nil
+}
+
+// Returns a function that reports one more of total contacts done and whether
+// the job should keep going
+func progress_counter(ctx context.Context, total int, progress func(float64)) func() error {
+
+	done := 0
+	return func() error {
+		done++
+		progress(float64(done) / float64(total))
+		return ctx.Err()
+	}
+}
+
+// A zip with every contact as contacts.json, contacts.csv and one vCard each
+func write_contacts_zip(ctx context.Context, w io.Writer, contacts []Contact, opts export_options, progress func(float64)) error {
+
+	zw := zip.NewWriter(w)
+
+	// Every contact is processed three times, once for each file it ends up in
+	step := progress_counter(ctx, 3*len(contacts), progress)
+
+	f, err := zip_create(zw, "contacts.json")
+	if err != nil {
+		return fmt.Errorf("write_contacts_zip: error creating contacts.json: %w", err)
+	}
+	err = write_contacts_json(ctx, f, contacts, opts, func(float64) { step() })
+	if err != nil {
+		return fmt.Errorf("write_contacts_zip: %w", err)
+	}
+
+	f, err = zip_create(zw, "contacts.csv")
+	if err != nil {
+		return fmt.Errorf("write_contacts_zip: error creating contacts.csv: %w", err)
+	}
+	err = write_contacts_csv(ctx, f, contacts, opts, func(float64) { step() })
+	if err != nil {
+		return fmt.Errorf("write_contacts_zip: %w", err)
+	}
+
+	for _, c := range contacts {
+		f, err = zip_create(zw, "vcards/"+strconv.Itoa(c.ID)+".vcf")
+		if err != nil {
+			return fmt.Errorf("write_contacts_zip: error creating vcard %d: %w", c.ID, err)
+		}
+		err = write_vcard(f, c, "3.0")
+		if err != nil {
+			return fmt.Errorf("write_contacts_zip: error writing vcard %d: %w", c.ID, err)
+		}
+		err = step()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = zw.Close()
+	if err != nil {
+		return fmt.Errorf("write_contacts_zip: error in zw.Close: %w", err)
+	}
+	return nil
+}
+
+// zw.Create leaves the modification time at zero, which unzip shows as 1980
+func zip_create(zw *zip.Writer, name string) (io.Writer, error) {
+	return zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+}
+
+func write_contacts_csv(ctx context.Context, w io.Writer, contacts []Contact, opts export_options, progress func(float64)) error {
+
+	step := progress_counter(ctx, len(contacts), progress)
+
+	cw := csv.NewWriter(w)
+	cw.Comma = opts.Delimiter
+	err := cw.Write(csv_header)
+	if err != nil {
+		return fmt.Errorf("write_contacts_csv: %w", err)
+	}
+	for _, c := range contacts {
+		err = cw.Write(csv_record(c))
+		if err != nil {
+			return fmt.Errorf("write_contacts_csv: %w", err)
+		}
+		err = step()
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	err = cw.Error()
+	if err != nil {
+		return fmt.Errorf("write_contacts_csv: %w", err)
+	}
+	return nil
+}
+
+func csv_record(c Contact) []string {
+	return []string{strconv.Itoa(c.ID), c.First, c.Last, c.Email, c.Phone}
+}
+
+// One .vcf holding every contact, one card after the other
+func write_contacts_vcard(version string) func(context.Context, io.Writer, []Contact, export_options, func(float64)) error {
+
+	return func(ctx context.Context, w io.Writer, contacts []Contact, opts export_options, progress func(float64)) error {
+
+		step := progress_counter(ctx, len(contacts), progress)
+
+		bw := bufio.NewWriter(w)
+		for _, c := range contacts {
+			err := write_vcard(bw, c, version)
+			if err != nil {
+				return fmt.Errorf("write_contacts_vcard: contact %d: %w", c.ID, err)
+			}
+			err = step()
+			if err != nil {
+				return err
+			}
+		}
+		err := bw.Flush()
+		if err != nil {
+			return fmt.Errorf("write_contacts_vcard: %w", err)
+		}
+		return nil
+	}
+}
+
+// One JSON object per line
+func write_contacts_ndjson(ctx context.Context, w io.Writer, contacts []Contact, opts export_options, progress func(float64)) error {
+
+	step := progress_counter(ctx, len(contacts), progress)
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for _, c := range contacts {
+		err := enc.Encode(c)
+		if err != nil {
+			return fmt.Errorf("write_contacts_ndjson: contact %d: %w", c.ID, err)
+		}
+		err = step()
+		if err != nil {
+			return err
+		}
+	}
+	err := bw.Flush()
+	if err != nil {
+		return fmt.Errorf("write_contacts_ndjson: %w", err)
+	}
+	return nil
+}
+
+// The same layout as contacts.json, streamed contact by contact so progress
+// can be reported
+func write_contacts_json(ctx context.Context, w io.Writer, contacts []Contact, opts export_options, progress func(float64)) error {
+
+	step := progress_counter(ctx, len(contacts), progress)
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString("[")
+	for i, c := range contacts {
+		data, err := json.MarshalIndent(c, "  ", "  ")
+		if err != nil {
+			return fmt.Errorf("write_contacts_json: contact %d: %w", c.ID, err)
+		}
+		if i > 0 {
+			bw.WriteString(",")
+		}
+		bw.WriteString("\n  ")
+		bw.Write(data)
+		err = step()
+		if err != nil {
+			return err
+		}
+	}
+	if len(contacts) > 0 {
+		bw.WriteString("\n")
+	}
+	bw.WriteString("]\n")
+
+	// bufio.Writer keeps the first error, Flush reports it
+	err := bw.Flush()
+	if err != nil {
+		return fmt.Errorf("write_contacts_json: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// A client that is not sure a write went through, say because the network
+// dropped the answer, can retry it safely by sending the same Idempotency-Key
+// header. The first answer for a key is kept and every retry gets it back,
+// marked with Idempotent-Replayed, without doing the write again. A key
+// belongs to the method and path it was sent to and to the credential sent
+// with it, if any, reusing it there for another request is a 422. Not to the
+// client's address, which changes when a phone changes networks
+
+const idempotency_header = "Idempotency-Key"
+
+// How long an answer is kept for retries
+const idempotency_ttl = 24 * time.Hour
+
+// Most answers kept at once, the oldest go first beyond that
+const idempotency_max_keys = 10000
+
+// Longest key we take, a UUID is 36 characters
+const idempotency_key_max_size = 255
+
+// The headers of an answer replayed along with its body
+var idempotency_replayed_headers = []string{"Content-Type", "Location", "ETag", "Allow", "Accept-Patch"}
+
+// The first request with a key and, once it is done, its answer
+type idempotent_request struct {
+	key     string
+	created time.Time
+	// Hash of the URL, content type and body
+	fingerprint [sha256.Size]byte
+	done        bool
+	status      int
+	header      http.Header
+	body        []byte
+}
+
+// The answers kept for retries. Requests are kept in the order they came in,
+// which is also the order they expire in
+type idempotency_cache struct {
+	mu       sync.Mutex
+	requests map[string]*list.Element
+	order    *list.List
+	max      int
+	ttl      time.Duration
+}
+
+func new_idempotency_cache(max int, ttl time.Duration) *idempotency_cache {
+	return &idempotency_cache{requests: make(map[string]*list.Element), order: list.New(), max: max, ttl: ttl}
+}
+
+// Replay the answer to the first request with an Idempotency-Key to its
+// retries. Bodies are read up to max_size, the limit of the route f serves
+func (app *App) idempotent(max_size int64, f http.HandlerFunc) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotency_header)
+		if key == "" {
+			f.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > idempotency_key_max_size {
+			write_problem(w, r, problem_invalid_idempotency_key.problem("Idempotency-Key is longer than 255 characters"))
+			return
+		}
+
+		// The body is read here for the fingerprint, handlers get a copy
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, max_size))
+		var max_err *http.MaxBytesError
+		if errors.As(err, &max_err) {
+			write_problem(w, r, problem_body_too_large.problem(fmt.Sprintf("Body is larger than %d bytes", max_err.Limit)))
+			return
+		}
+		if err != nil {
+			write_problem(w, r, problem_invalid_body.problem("Could not read the body"))
+			log.Error("idempotent: error in io.ReadAll(r.Body)", "error", err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		h := sha256.New()
+		for _, s := range []string{r.URL.RawQuery, r.Header.Get("Content-Type")} {
+			h.Write([]byte(s))
+			h.Write([]byte{0})
+		}
+		h.Write(body)
+		var fingerprint [sha256.Size]byte
+		h.Sum(fingerprint[:0])
+
+		scoped := idempotency_credential(r) + "\x00" + r.Method + " " + r.URL.Path + "\x00" + key
+		first, req := app.Idempotency.start(scoped, fingerprint)
+		if !first {
+			switch {
+			case req.fingerprint != fingerprint:
+				write_problem(w, r, problem_idempotency_mismatch.problem("Idempotency-Key "+key+" was sent with another request, use a new key"))
+			case !req.done:
+				write_problem(w, r, problem_idempotency_in_progress.problem("Retry once the first request with Idempotency-Key "+key+" is answered"))
+			default:
+				for k, v := range req.header {
+					w.Header()[k] = v
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(req.status)
+				_, err = w.Write(req.body)
+				if err != nil {
+					log.Error("idempotent: error in w.Write(req.body)", "error", err)
+				}
+			}
+			return
+		}
+
+		// A handler that panics leaves the key free for a retry
+		answered := false
+		defer func() {
+			if !answered {
+				app.Idempotency.forget(req)
+			}
+		}()
+		rec := &recording_writer{ResponseWriter: w, status: http.StatusOK}
+		f.ServeHTTP(rec, r)
+		answered = true
+		app.Idempotency.finish(req, rec)
+	})
+}
+
+// A hash of the credential r was sent with, its Authorization header or else
+// its session cookie, so one client's keys never replay another's answers.
+// Empty when r has none, the key alone tells the requests apart then
+func idempotency_credential(r *http.Request) string {
+
+	credential := ""
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		credential = "authorization " + auth
+	} else if cookie, err := r.Cookie(session_cookie); err == nil && uuid.Validate(cookie.Value) == nil {
+		credential = "session " + cookie.Value
+	}
+	if credential == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(credential))
+	return string(sum[:])
+}
+
+// Claim key for a request with fingerprint. first is false when another
+// request claimed it already, req is a copy of that one's then
+func (c *idempotency_cache) start(key string, fingerprint [sha256.Size]byte) (first bool, req *idempotent_request) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Only the expired requests at the front are looked at
+	now := time.Now()
+	for e := c.order.Front(); e != nil && now.Sub(e.Value.(*idempotent_request).created) > c.ttl; e = c.order.Front() {
+		c.remove(e)
+	}
+	if e, ok := c.requests[key]; ok {
+		prev := e.Value.(*idempotent_request)
+		// A copy, the first request may still be filling it in
+		return false, &idempotent_request{fingerprint: prev.fingerprint, done: prev.done, status: prev.status, header: prev.header, body: prev.body}
+	}
+	for c.order.Len() >= c.max {
+		c.remove(c.order.Front())
+	}
+	req = &idempotent_request{key: key, created: now, fingerprint: fingerprint}
+	c.requests[key] = c.order.PushBack(req)
+	return true, req
+}
+
+// Keep the answer rec recorded for req's retries. Server errors are not kept,
+// the key is let go so a retry can succeed
+func (c *idempotency_cache) finish(req *idempotent_request, rec *recording_writer) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.requests[req.key]
+	if !ok || e.Value != req {
+		// Pushed out meanwhile
+		return
+	}
+	if rec.status >= 500 {
+		c.remove(e)
+		return
+	}
+	req.header = make(http.Header)
+	for _, k := range idempotency_replayed_headers {
+		if v, ok := rec.Header()[k]; ok {
+			req.header[k] = v
+		}
+	}
+	req.status = rec.status
+	req.body = rec.body.Bytes()
+	req.done = true
+}
+
+func (c *idempotency_cache) forget(req *idempotent_request) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.requests[req.key]; ok && e.Value == req {
+		c.remove(e)
+	}
+}
+
+// Expects c.mu to be held
+func (c *idempotency_cache) remove(e *list.Element) {
+
+	delete(c.requests, e.Value.(*idempotent_request).key)
+	c.order.Remove(e)
+}
+
+// Passes an answer on and keeps a copy of its status and body
+type recording_writer struct {
+	http.ResponseWriter
+	status       int
+	wrote_status bool
+	body         bytes.Buffer
+}
+
+func (w *recording_writer) WriteHeader(status int) {
+
+	if !w.wrote_status {
+		w.status = status
+		w.wrote_status = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recording_writer) Write(b []byte) (int, error) {
+
+	w.wrote_status = true
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
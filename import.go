@@ -0,0 +1,892 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Bulk import of contacts from CSV and vCard files. An upload is parsed once
+// and kept as a pending import. For CSV the user then adjusts which column
+// feeds which field while looking at a preview, for vCards they decide what to
+// do with cards that duplicate existing contacts. Finally the rows that passed
+// validation are committed in one go
+
+// Largest file we accept
+const import_max_size = 10 << 20
+
+// Uploads not committed within this time are dropped
+const import_ttl = 30 * time.Minute
+
+// The preview table stops after this many rows, the counts cover all of them
+const import_preview_rows = 500
+
+// Contact fields a column can be mapped to, in the order they are shown
+var import_fields = []struct{ Name, Label string }{
+	{"first", "First Name"},
+	{"last", "Last Name"},
+	{"email", "Email"},
+	{"phone", "Phone"},
+}
+
+// Header names (lowercase, letters only) we map without asking
+var import_aliases = map[string]string{
+	"first":        "first",
+	"firstname":    "first",
+	"givenname":    "first",
+	"forename":     "first",
+	"last":         "last",
+	"lastname":     "last",
+	"surname":      "last",
+	"familyname":   "last",
+	"email":        "email",
+	"mail":         "email",
+	"emailaddress": "email",
+	"phone":        "phone",
+	"phonenumber":  "phone",
+	"tel":          "phone",
+	"telephone":    "phone",
+	"mobile":       "phone",
+	"cell":         "phone",
+}
+
+// Field name to column index, -1 when no column feeds the field
+type import_mapping map[string]int
+
+// An uploaded file waiting to be committed, either CSV records or vCards
+type pending_import struct {
+	session string
+	created time.Time
+	header  []string
+	records [][]string
+	cards   []Contact
+	// Line in the file each record or card starts on
+	lines []int
+}
+
+var (
+	pending_imports_mu sync.Mutex
+	pending_imports    = make(map[string]*pending_import)
+)
+
+type ImportField struct {
+	Name   string
+	Label  string
+	Column int
+}
+
+type ImportRow struct {
+	Line     int     `json:"line"`
+	Accepted bool    `json:"accepted"`
+	Contact  Contact `json:"contact"`
+}
+
+// The import page, with the preview of the file uploaded if there is one
+type ImportPage struct {
+	// Why the upload could not be read
+	Error string
+	CSV   *ImportPreview
+	VCard *VCardReview
+}
+
+// What the import page shows for a CSV file, also the body of the API's answer
+type ImportPreview struct {
+	Token    string        `json:"-"`
+	Header   []string      `json:"header"`
+	Fields   []ImportField `json:"-"`
+	Rows     []ImportRow   `json:"rows"`
+	Accepted int           `json:"accepted"`
+	Rejected int           `json:"rejected"`
+	// Rows left out of the preview table
+	Hidden int    `json:"-"`
+	DryRun bool   `json:"dry_run"`
+	Error  string `json:"-"`
+}
+
+// GET /contacts/import
+func (app *App) get_import_handler(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "text/html")
+	err := app.Templates.Render(w, "import", ImportPage{})
+	if err != nil {
+		http.Error(w, "Error, could not render page", http.StatusInternalServerError)
+		log.Error("get_import_handler: error in app.Templates.Render()", "error", err)
+		return
+	}
+}
+
+// POST /contacts/import
+func (app *App) post_import_handler(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "text/html")
+
+	r.Body = http.MaxBytesReader(w, r.Body, import_max_size)
+	f, fh, err := r.FormFile("file")
+	if err != nil {
+		render_import_error(app, w, "Please choose a CSV or vCard file of at most 10 MB")
+		log.Error("post_import_handler: error in r.FormFile", "error", err)
+		return
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		render_import_error(app, w, "Could not read the file")
+		log.Error("post_import_handler: error in io.ReadAll", "error", err)
+		return
+	}
+
+	if is_vcard(fh.Filename, data) {
+		app.post_vcard_import(w, r, data)
+		return
+	}
+
+	p, err := read_csv_import(bytes.NewReader(data), r.FormValue("delimiter"))
+	if err != nil {
+		render_import_error(app, w, import_error_message(err))
+		log.Error("post_import_handler: error in read_csv_import", "error", err)
+		return
+	}
+	p.session, _ = r.Context().Value(session_key{}).(string)
+	token := save_pending_import(p)
+
+	preview, _, err := app.import_preview(p, guess_import_mapping(p.header))
+	if err != nil {
+		http.Error(w, "Error validating contacts", http.StatusInternalServerError)
+		log.Error("post_import_handler: error in app.import_preview", "error", err)
+		return
+	}
+	preview.Token = token
+	preview.DryRun = true
+	preview = limit_import_preview(preview)
+
+	err = app.Templates.Render(w, "import", ImportPage{CSV: &preview})
+	if err != nil {
+		http.Error(w, "Error, could not render page", http.StatusInternalServerError)
+		log.Error("post_import_handler: error in app.Templates.Render()", "error", err)
+		return
+	}
+}
+
+// POST /contacts/import/{token}/preview
+// Re-validates the upload after the mapping or the duplicate actions were
+// changed
+func (app *App) import_preview_handler(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "text/html")
+
+	token := r.PathValue("token")
+	p := get_pending_import(r, token)
+	if p == nil {
+		http.Error(w, "Error, import not found or expired", http.StatusNotFound)
+		log.Error("import_preview_handler: pending import not found", "token", token)
+		return
+	}
+
+	if p.cards != nil {
+		review, _, err := app.vcard_review(p, vcard_actions_from_form(r))
+		if err != nil {
+			http.Error(w, "Error validating contacts", http.StatusInternalServerError)
+			log.Error("import_preview_handler: error in app.vcard_review", "error", err)
+			return
+		}
+		review.Token = token
+
+		err = app.Templates.Render(w, "vcard-review", review)
+		if err != nil {
+			http.Error(w, "Error, could not render page", http.StatusInternalServerError)
+			log.Error("import_preview_handler: error in app.Templates.Render()", "error", err)
+		}
+		return
+	}
+
+	preview, _, err := app.import_preview(p, import_mapping_from_form(r, len(p.header)))
+	if err != nil {
+		http.Error(w, "Error validating contacts", http.StatusInternalServerError)
+		log.Error("import_preview_handler: error in app.import_preview", "error", err)
+		return
+	}
+	preview.Token = token
+	preview.DryRun = true
+
+	err = app.Templates.Render(w, "import-preview", limit_import_preview(preview))
+	if err != nil {
+		http.Error(w, "Error, could not render page", http.StatusInternalServerError)
+		log.Error("import_preview_handler: error in app.Templates.Render()", "error", err)
+		return
+	}
+}
+
+// POST /contacts/import/{token}/commit
+func (app *App) commit_import_handler(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "text/html")
+
+	token := r.PathValue("token")
+	p := get_pending_import(r, token)
+	if p == nil {
+		http.Error(w, "Error, import not found or expired", http.StatusNotFound)
+		log.Error("commit_import_handler: pending import not found", "token", token)
+		return
+	}
+
+	if p.cards != nil {
+		app.commit_vcard_import(w, r, token, p)
+		return
+	}
+
+	// Validated again, the store may have changed since the preview
+	mapping := import_mapping_from_form(r, len(p.header))
+	preview, accepted, err := app.import_preview(p, mapping)
+	if err != nil {
+		http.Error(w, "Error validating contacts", http.StatusInternalServerError)
+		log.Error("commit_import_handler: error in app.import_preview", "error", err)
+		return
+	}
+	preview.Token = token
+	preview.DryRun = true
+
+	if len(accepted) == 0 {
+		preview.Error = "No row can be imported"
+	} else {
+		created, err := app.Store.Apply(create_ops(accepted))
+		if errors.Is(err, ErrEmailTaken) {
+			// A contact was added with one of the emails after we validated,
+			// show which rows that affects
+			preview, _, err = app.import_preview(p, mapping)
+			if err != nil {
+				http.Error(w, "Error validating contacts", http.StatusInternalServerError)
+				log.Error("commit_import_handler: error in app.import_preview", "error", err)
+				return
+			}
+			preview.Token = token
+			preview.DryRun = true
+			preview.Error = "Some emails were taken in the meantime, please review the import again"
+		} else if err != nil {
+			http.Error(w, "Error, could not save contacts", http.StatusInternalServerError)
+			log.Error("commit_import_handler: error in app.Store.Apply", "error", err)
+			return
+		} else {
+			delete_pending_import(token)
+			log.Info("Contacts imported successfully", "count", len(created))
+
+			err = app.Templates.Render(w, "sucess-import", len(created))
+			if err != nil {
+				http.Error(w, "Error, could show success message", http.StatusInternalServerError)
+				log.Error("commit_import_handler: error in app.Templates.Render(w, \"sucess-import\", n)", "error", err)
+				return
+			}
+			return
+		}
+	}
+
+	preview = limit_import_preview(preview)
+	err = app.Templates.Render(w, "import", ImportPage{CSV: &preview})
+	if err != nil {
+		http.Error(w, "Error, could not render page", http.StatusInternalServerError)
+		log.Error("commit_import_handler: error in app.Templates.Render()", "error", err)
+		return
+	}
+}
+
+// POST /api/v1/contacts/import
+// The body is the CSV file. Columns are mapped by header name with the
+// first, last, email and phone query parameters, or guessed from the header.
+// With dry_run=true nothing is stored. 201 with the report when contacts were
+// created, 200 when none were, for a dry run or when every row was rejected
+func (app *App) api_import_contacts_handler(w http.ResponseWriter, r *http.Request) {
+
+	query := r.URL.Query()
+	dry_run, _ := strconv.ParseBool(query.Get("dry_run"))
+
+	r.Body = http.MaxBytesReader(w, r.Body, import_max_size)
+	p, err := read_csv_import(r.Body, query.Get("delimiter"))
+	if err != nil {
+		t := problem_invalid_import
+		var max_err *http.MaxBytesError
+		if errors.As(err, &max_err) {
+			t = problem_body_too_large
+		}
+		write_problem(w, r, t.problem(import_error_message(err)))
+		log.Error("api_import_contacts_handler: error in read_csv_import", "error", err)
+		return
+	}
+
+	mapping := guess_import_mapping(p.header)
+	errs := make(map[string]string)
+	for _, f := range import_fields {
+		name := query.Get(f.Name)
+		if name == "" {
+			continue
+		}
+		mapping[f.Name] = -1
+		for i, h := range p.header {
+			if strings.EqualFold(strings.TrimSpace(h), name) {
+				mapping[f.Name] = i
+			}
+		}
+		if mapping[f.Name] < 0 {
+			errs[f.Name] = "No column named " + strconv.Quote(name)
+		}
+	}
+	if len(errs) > 0 {
+		p := problem_import_mapping.problem("Could not map columns")
+		p.Errors = errs
+		write_problem(w, r, p)
+		log.Error("api_import_contacts_handler: unknown columns", "errors", errs)
+		return
+	}
+
+	preview, accepted, err := app.import_preview(p, mapping)
+	if err != nil {
+		write_problem(w, r, problem_internal.problem("Error validating contacts"))
+		log.Error("api_import_contacts_handler: error in app.import_preview", "error", err)
+		return
+	}
+	preview.DryRun = dry_run
+
+	status := http.StatusOK
+	if !dry_run && len(accepted) > 0 {
+		created, err := app.Store.Apply(create_ops(accepted))
+		if errors.Is(err, ErrEmailTaken) {
+			write_problem(w, r, problem_import_conflict.problem("Some emails were taken in the meantime, nothing was imported"))
+			log.Error("api_import_contacts_handler: error in app.Store.Apply", "error", err)
+			return
+		}
+		if err != nil {
+			write_problem(w, r, problem_internal.problem("Error, could not save contacts"))
+			log.Error("api_import_contacts_handler: error in app.Store.Apply", "error", err)
+			return
+		}
+		log.Info("Contacts imported successfully", "count", len(created))
+
+		// Report the ids the store gave the accepted rows
+		i := 0
+		for j := range preview.Rows {
+			if preview.Rows[j].Accepted {
+				preview.Rows[j].Contact = created[i]
+				i++
+			}
+		}
+		status = http.StatusCreated
+	}
+
+	write_json(w, r, status, preview)
+}
+
+// Validate every record of p read through mapping, the same way
+// post_add_contact_handler validates a single contact. Emails must also be
+// unique within the file, the first valid row using one wins. Returns the
+// accepted contacts too, ready to be created
+func (app *App) import_preview(p *pending_import, mapping import_mapping) (ImportPreview, []Contact, error) {
+
+	existing, err := app.Store.List(0, -1)
+	if err != nil {
+		return ImportPreview{}, nil, fmt.Errorf("import_preview: error in app.Store.List: %w", err)
+	}
+	taken := make(map[string]bool, len(existing))
+	for _, c := range existing {
+		taken[c.Email] = true
+	}
+
+	preview := ImportPreview{Header: p.header}
+	for _, f := range import_fields {
+		preview.Fields = append(preview.Fields, ImportField{f.Name, f.Label, mapping[f.Name]})
+	}
+
+	var accepted []Contact
+	for i, record := range p.records {
+		value := func(field string) string {
+			col := mapping[field]
+			if col < 0 || col >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[col])
+		}
+		c := Contact{
+			First:  value("first"),
+			Last:   value("last"),
+			Email:  value("email"),
+			Phone:  value("phone"),
+			Errors: make(map[string]string),
+		}
+		validate_contact(&c, check_email(c.Email, func(email string) bool { return taken[email] }))
+
+		row := ImportRow{Line: p.lines[i], Accepted: len(c.Errors) == 0, Contact: c}
+		if row.Accepted {
+			taken[c.Email] = true
+			accepted = append(accepted, c)
+			preview.Accepted++
+		} else {
+			preview.Rejected++
+		}
+		preview.Rows = append(preview.Rows, row)
+	}
+	return preview, accepted, nil
+}
+
+func create_ops(cs []Contact) []StoreOp {
+
+	ops := make([]StoreOp, len(cs))
+	for i, c := range cs {
+		ops[i] = StoreOp{OpCreate, c}
+	}
+	return ops
+}
+
+// Parse an uploaded CSV file, the first record is the header. An empty
+// delimiter picks whichever of the usual ones the header uses most
+func read_csv_import(r io.Reader, delimiter string) (*pending_import, error) {
+
+	br := bufio.NewReader(r)
+	// Spreadsheet programs like to start UTF-8 files with a byte order mark
+	bom, _ := br.Peek(3)
+	if bytes.Equal(bom, []byte("\xef\xbb\xbf")) {
+		br.Discard(3)
+	}
+
+	var comma rune
+	if delimiter == "" {
+		first, _ := br.Peek(4096)
+		comma = sniff_delimiter(first)
+	} else {
+		d, err := parse_delimiter(delimiter)
+		if err != nil {
+			return nil, fmt.Errorf("read_csv_import: %w", err)
+		}
+		comma = d
+	}
+
+	cr := csv.NewReader(br)
+	cr.Comma = comma
+	// Short and long rows are dealt with by the mapping
+	cr.FieldsPerRecord = -1
+
+	header, err := cr.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("read_csv_import: error, the file is empty")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read_csv_import: error reading header: %w", err)
+	}
+
+	p := &pending_import{created: time.Now(), header: header}
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read_csv_import: %w", err)
+		}
+		line, _ := cr.FieldPos(0)
+		p.records = append(p.records, record)
+		p.lines = append(p.lines, line)
+	}
+	return p, nil
+}
+
+// What to tell the user about an error from read_csv_import or read_vcards,
+// without our function names
+func import_error_message(err error) string {
+
+	var pe *csv.ParseError
+	if errors.As(err, &pe) {
+		return "Could not read the file as CSV: " + pe.Error()
+	}
+	var ve *vcard_parse_error
+	if errors.As(err, &ve) {
+		return "Could not read the vCard file: " + ve.Error()
+	}
+	return "Could not read the file"
+}
+
+// The candidate found most often on the first line, a comma if none is
+func sniff_delimiter(data []byte) rune {
+
+	line, _, _ := bytes.Cut(data, []byte("\n"))
+	best, most := ',', 0
+	for _, d := range []rune{',', ';', '\t', '|'} {
+		n := bytes.Count(line, []byte(string(d)))
+		if n > most {
+			best, most = d, n
+		}
+	}
+	return best
+}
+
+func guess_import_mapping(header []string) import_mapping {
+
+	mapping := make(import_mapping)
+	for _, f := range import_fields {
+		mapping[f.Name] = -1
+	}
+	for i, h := range header {
+		key := strings.Map(func(r rune) rune {
+			if r >= 'a' && r <= 'z' {
+				return r
+			}
+			return -1
+		}, strings.ToLower(h))
+		field, ok := import_aliases[key]
+		// The first matching column wins
+		if ok && mapping[field] < 0 {
+			mapping[field] = i
+		}
+	}
+	return mapping
+}
+
+// The map_<field> selects of the preview form
+func import_mapping_from_form(r *http.Request, columns int) import_mapping {
+
+	mapping := make(import_mapping)
+	for _, f := range import_fields {
+		col, err := strconv.Atoi(r.FormValue("map_" + f.Name))
+		if err != nil || col < 0 || col >= columns {
+			col = -1
+		}
+		mapping[f.Name] = col
+	}
+	return mapping
+}
+
+// Keep the preview page a reasonable size for big files
+func limit_import_preview(preview ImportPreview) ImportPreview {
+
+	if len(preview.Rows) > import_preview_rows {
+		preview.Hidden = len(preview.Rows) - import_preview_rows
+		preview.Rows = preview.Rows[:import_preview_rows]
+	}
+	return preview
+}
+
+func render_import_error(app *App, w http.ResponseWriter, message string) {
+
+	err := app.Templates.Render(w, "import", ImportPage{Error: message})
+	if err != nil {
+		http.Error(w, "Error, could not render page", http.StatusInternalServerError)
+		log.Error("render_import_error: error in app.Templates.Render()", "error", err)
+	}
+}
+
+// Store p under a new token, dropping the imports nobody committed in time
+func save_pending_import(p *pending_import) string {
+
+	pending_imports_mu.Lock()
+	defer pending_imports_mu.Unlock()
+
+	for token, old := range pending_imports {
+		if time.Since(old.created) > import_ttl {
+			delete(pending_imports, token)
+		}
+	}
+	token := uuid.NewString()
+	pending_imports[token] = p
+	return token
+}
+
+// The pending import with token, nil unless it exists, has not expired and
+// was uploaded from the same browser
+func get_pending_import(r *http.Request, token string) *pending_import {
+
+	pending_imports_mu.Lock()
+	defer pending_imports_mu.Unlock()
+
+	session, _ := r.Context().Value(session_key{}).(string)
+	p, ok := pending_imports[token]
+	if !ok || p.session != session || time.Since(p.created) > import_ttl {
+		return nil
+	}
+	return p
+}
+
+func delete_pending_import(token string) {
+
+	pending_imports_mu.Lock()
+	defer pending_imports_mu.Unlock()
+
+	delete(pending_imports, token)
+}
+
+//------------------------------------------------------------------------------
+// vCard import
+//------------------------------------------------------------------------------
+
+// What to do with a card that duplicates an existing contact
+const (
+	vcard_skip      = "skip"
+	vcard_overwrite = "overwrite"
+	vcard_merge     = "merge"
+)
+
+type VCardRow struct {
+	Index int
+	Line  int
+	Card  Contact
+	// The contact the card duplicates, nil for a new one
+	Existing *Contact
+	// "email" or "phone"
+	MatchedBy string
+	// One of the vcard_ actions for duplicates, empty for new cards
+	Action string
+	// What will be stored, its Errors say why it can't be
+	Result   Contact
+	Accepted bool
+}
+
+type VCardReview struct {
+	Token      string
+	Rows       []VCardRow
+	New        int
+	Duplicates int
+	Accepted   int
+	Rejected   int
+	Error      string
+}
+
+// Parse the uploaded vCards and show the review screen
+func (app *App) post_vcard_import(w http.ResponseWriter, r *http.Request, data []byte) {
+
+	cards, lines, err := read_vcards(bytes.NewReader(data))
+	if err != nil {
+		render_import_error(app, w, import_error_message(err))
+		log.Error("post_vcard_import: error in read_vcards", "error", err)
+		return
+	}
+	p := &pending_import{created: time.Now(), cards: cards, lines: lines}
+	p.session, _ = r.Context().Value(session_key{}).(string)
+	token := save_pending_import(p)
+
+	// Duplicates are skipped unless the user says otherwise
+	review, _, err := app.vcard_review(p, nil)
+	if err != nil {
+		http.Error(w, "Error validating contacts", http.StatusInternalServerError)
+		log.Error("post_vcard_import: error in app.vcard_review", "error", err)
+		return
+	}
+	review.Token = token
+
+	err = app.Templates.Render(w, "import", ImportPage{VCard: &review})
+	if err != nil {
+		http.Error(w, "Error, could not render page", http.StatusInternalServerError)
+		log.Error("post_vcard_import: error in app.Templates.Render()", "error", err)
+		return
+	}
+}
+
+func (app *App) commit_vcard_import(w http.ResponseWriter, r *http.Request, token string, p *pending_import) {
+
+	// Validated again, the store may have changed since the review
+	actions := vcard_actions_from_form(r)
+	review, ops, err := app.vcard_review(p, actions)
+	if err != nil {
+		http.Error(w, "Error validating contacts", http.StatusInternalServerError)
+		log.Error("commit_vcard_import: error in app.vcard_review", "error", err)
+		return
+	}
+	review.Token = token
+
+	if len(ops) == 0 {
+		review.Error = "No card can be imported"
+	} else {
+		_, err = app.Store.Apply(ops)
+		if errors.Is(err, ErrEmailTaken) || errors.Is(err, ErrNotFound) || errors.Is(err, ErrVersionChanged) {
+			// Someone changed the contacts after we validated, show the
+			// review for what is there now
+			review, _, err = app.vcard_review(p, actions)
+			if err != nil {
+				http.Error(w, "Error validating contacts", http.StatusInternalServerError)
+				log.Error("commit_vcard_import: error in app.vcard_review", "error", err)
+				return
+			}
+			review.Token = token
+			review.Error = "The contacts changed in the meantime, please review the import again"
+		} else if err != nil {
+			http.Error(w, "Error, could not save contacts", http.StatusInternalServerError)
+			log.Error("commit_vcard_import: error in app.Store.Apply", "error", err)
+			return
+		} else {
+			delete_pending_import(token)
+			log.Info("Contacts imported successfully", "count", len(ops))
+
+			err = app.Templates.Render(w, "sucess-import", len(ops))
+			if err != nil {
+				http.Error(w, "Error, could show success message", http.StatusInternalServerError)
+				log.Error("commit_vcard_import: error in app.Templates.Render(w, \"sucess-import\", n)", "error", err)
+				return
+			}
+			return
+		}
+	}
+
+	err = app.Templates.Render(w, "import", ImportPage{VCard: &review})
+	if err != nil {
+		http.Error(w, "Error, could not render page", http.StatusInternalServerError)
+		log.Error("commit_vcard_import: error in app.Templates.Render()", "error", err)
+		return
+	}
+}
+
+// Match every card of p against the stored contacts, first by email and then
+// by phone number, and work out what each one turns into given the actions
+// picked for duplicates (by card index, skip when missing). Whatever is stored
+// goes through validate_contact like a contact added by hand. Returns the ops
+// that apply the review
+func (app *App) vcard_review(p *pending_import, actions map[int]string) (VCardReview, []StoreOp, error) {
+
+	existing, err := app.Store.List(0, -1)
+	if err != nil {
+		return VCardReview{}, nil, fmt.Errorf("vcard_review: error in app.Store.List: %w", err)
+	}
+
+	by_email := make(map[string]Contact)
+	by_phone := make(map[string]Contact)
+	// Which contact ends up with each email, cards created by the review get
+	// negative ids
+	owner := make(map[string]int)
+	for _, c := range existing {
+		if c.Email != "" {
+			by_email[strings.ToLower(c.Email)] = c
+		}
+		if phone := normalize_phone(c.Phone); phone != "" {
+			if _, ok := by_phone[phone]; !ok {
+				by_phone[phone] = c
+			}
+		}
+		owner[c.Email] = c.ID
+	}
+
+	var review VCardReview
+	var ops []StoreOp
+	updated := make(map[int]bool)
+	for i, card := range p.cards {
+		row := VCardRow{Index: i, Line: p.lines[i], Card: card}
+
+		match, ok := by_email[strings.ToLower(card.Email)]
+		if ok && card.Email != "" {
+			row.MatchedBy = "email"
+		} else if match, ok = by_phone[normalize_phone(card.Phone)]; ok && card.Phone != "" {
+			row.MatchedBy = "phone"
+		}
+
+		id := -1 - i
+		if row.MatchedBy == "" {
+			review.New++
+			row.Result = clone_contact(card)
+		} else {
+			review.Duplicates++
+			row.Existing = &match
+			id = match.ID
+			row.Action = actions[i]
+			switch row.Action {
+			case vcard_overwrite:
+				row.Result = clone_contact(card)
+				row.Result.ID = match.ID
+				row.Result.Version = match.Version
+			case vcard_merge:
+				row.Result = merge_contacts(match, card)
+			default:
+				row.Action = vcard_skip
+				review.Rows = append(review.Rows, row)
+				continue
+			}
+			if updated[match.ID] {
+				row.Result.Errors["contact"] = "Another card already updates this contact"
+			}
+		}
+
+		validate_contact(&row.Result, check_email(row.Result.Email, func(email string) bool {
+			other, ok := owner[email]
+			return ok && other != id
+		}))
+		row.Accepted = len(row.Result.Errors) == 0
+
+		if !row.Accepted {
+			review.Rejected++
+		} else if row.Existing != nil {
+			review.Accepted++
+			if owner[row.Existing.Email] == id {
+				delete(owner, row.Existing.Email)
+			}
+			owner[row.Result.Email] = id
+			updated[id] = true
+			ops = append(ops, StoreOp{OpUpdate, row.Result})
+		} else {
+			review.Accepted++
+			owner[row.Result.Email] = id
+			ops = append(ops, StoreOp{OpCreate, row.Result})
+		}
+		review.Rows = append(review.Rows, row)
+	}
+	return review, ops, nil
+}
+
+// The existing contact with its empty fields filled in from card
+func merge_contacts(existing Contact, card Contact) Contact {
+
+	c := clone_contact(existing)
+	c.Errors = make(map[string]string)
+	if c.First == "" {
+		c.First = card.First
+	}
+	if c.Last == "" {
+		c.Last = card.Last
+	}
+	if c.Email == "" {
+		c.Email = card.Email
+	}
+	if c.Phone == "" {
+		c.Phone = card.Phone
+	}
+	return c
+}
+
+// Only the digits, so "+1 (555) 010-2030" and "1-555-010-2030" are the same
+// number
+func normalize_phone(phone string) string {
+
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, phone)
+}
+
+// The action_<card index> selects of the review form
+func vcard_actions_from_form(r *http.Request) map[int]string {
+
+	r.ParseForm()
+	actions := make(map[int]string)
+	for key, values := range r.PostForm {
+		i, err := strconv.Atoi(strings.TrimPrefix(key, "action_"))
+		if err != nil || !strings.HasPrefix(key, "action_") || len(values) == 0 {
+			continue
+		}
+		actions[i] = values[0]
+	}
+	return actions
+}
+
+// vCards are recognised by their extension or by how they start
+func is_vcard(name string, data []byte) bool {
+
+	ext := strings.ToLower(filepath.Ext(name))
+	if ext == ".vcf" || ext == ".vcard" {
+		return true
+	}
+	data = bytes.TrimLeft(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")), " \t\r\n")
+	return len(data) >= 11 && strings.EqualFold(string(data[:11]), "BEGIN:VCARD")
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestGuessImportMapping(t *testing.T) {
+
+	tests := []struct {
+		header []string
+		want   import_mapping
+	}{
+		{[]string{"first", "last", "email", "phone"}, import_mapping{"first": 0, "last": 1, "email": 2, "phone": 3}},
+		{[]string{"Phone Number", "E-Mail Address", "Surname", "Given Name"}, import_mapping{"first": 3, "last": 2, "email": 1, "phone": 0}},
+		// The first matching column wins, unknown ones are left out
+		{[]string{"Mobile", "Tel", "Notes", "FIRST_NAME"}, import_mapping{"first": 3, "last": -1, "email": -1, "phone": 0}},
+		{nil, import_mapping{"first": -1, "last": -1, "email": -1, "phone": -1}},
+	}
+	for _, tt := range tests {
+		if got := guess_import_mapping(tt.header); !maps.Equal(got, tt.want) {
+			t.Errorf("guess_import_mapping(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestReadCSVImport(t *testing.T) {
+
+	tests := []struct {
+		name, data, delimiter string
+		header                []string
+		lines                 []int
+	}{
+		{"plain", "first,last\nAnn,Lee\nBob,Ray\n", "", []string{"first", "last"}, []int{2, 3}},
+		{"BOM", "\xef\xbb\xbffirst,last\r\nAnn,Lee\r\n", "", []string{"first", "last"}, []int{2}},
+		{"sniffed semicolons", "first;last;email\nAnn;Lee;ann@example.com\n", "", []string{"first", "last", "email"}, []int{2}},
+		{"given tabs", "first\tlast\nAnn\tLee\n", "tab", []string{"first", "last"}, []int{2}},
+		// Lines are where records start, a quoted field can span several
+		{"multiline field", "first,last\n\"Ann\nMarie\",Lee\nBob,Ray\n", "", []string{"first", "last"}, []int{2, 4}},
+		{"short and long rows", "first,last\nAnn\nBob,Ray,extra\n", "", []string{"first", "last"}, []int{2, 3}},
+	}
+	for _, tt := range tests {
+		p, err := read_csv_import(strings.NewReader(tt.data), tt.delimiter)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !slices.Equal(p.header, tt.header) || !slices.Equal(p.lines, tt.lines) || len(p.records) != len(tt.lines) {
+			t.Errorf("%s: header %q, %d records on lines %v, want %q on lines %v", tt.name, p.header, len(p.records), p.lines, tt.header, tt.lines)
+		}
+	}
+
+	_, err := read_csv_import(strings.NewReader(""), "")
+	if err == nil {
+		t.Error("empty file: no error")
+	}
+	_, err = read_csv_import(strings.NewReader("first,last\n\"Ann,Lee\n"), "")
+	var pe *csv.ParseError
+	if !errors.As(err, &pe) {
+		t.Errorf("unclosed quote: %v, want a csv.ParseError", err)
+	}
+}
+
+// Every row is validated on its own, and an email can only be used once:
+// not again in the file, nor when a contact already has it
+func TestImportPreview(t *testing.T) {
+
+	app := new_test_app()
+	p, err := read_csv_import(strings.NewReader(
+		"Email,First Name,Last Name,Phone\n"+
+			"ann@example.com,Ann,Lee,1\n"+
+			"ann@example.com,Annie,Lee,2\n"+
+			"joe@example.com,Joe,Blow,3\n"+
+			"bob@example.com,,Ray,\n"+
+			"bob@example.com,Bob,Ray,4\n"+
+			",No,Email,5\n"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	preview, accepted, err := app.import_preview(p, guess_import_mapping(p.header))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		line   int
+		errors map[string]string
+	}{
+		{2, nil},
+		{3, map[string]string{"email": email_taken_message}},
+		// joe@example.com is in the store already
+		{4, map[string]string{"email": email_taken_message}},
+		// A rejected row leaves its email to the next one
+		{5, map[string]string{"first": "First name is required", "phone": "Phone is required"}},
+		{6, nil},
+		{7, map[string]string{"email": "Email is empty"}},
+	}
+	if len(preview.Rows) != len(want) {
+		t.Fatalf("%d rows, want %d", len(preview.Rows), len(want))
+	}
+	for i, row := range preview.Rows {
+		w := want[i]
+		if row.Line != w.line || row.Accepted != (w.errors == nil) || len(row.Contact.Errors) != len(w.errors) || w.errors != nil && !maps.Equal(row.Contact.Errors, w.errors) {
+			t.Errorf("row %d: line %d accepted %t errors %v, want line %d errors %v", i, row.Line, row.Accepted, row.Contact.Errors, w.line, w.errors)
+		}
+	}
+	if preview.Accepted != 2 || preview.Rejected != 4 || len(accepted) != 2 {
+		t.Errorf("%d accepted and %d rejected, want 2 and 4", preview.Accepted, preview.Rejected)
+	}
+	if accepted[0].First != "Ann" || accepted[1].Email != "bob@example.com" {
+		t.Errorf("accepted %+v", accepted)
+	}
+}
+
+func TestAPIImportMapping(t *testing.T) {
+
+	app := new_test_app()
+	body := "Vorname;Nachname;Mail;Telefon\nAnn;Lee;ann@example.com;1\nBob;Ray;bob@example.com;\n"
+	w := serve(app, "POST", "/api/v1/contacts/import?first=vorname&last=NACHNAME&email=Mail&phone=Telefon", "text/csv", body)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status %d, want 201\n%s", w.Code, w.Body)
+	}
+	var preview ImportPreview
+	err := json.Unmarshal(w.Body.Bytes(), &preview)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preview.Accepted != 1 || preview.Rejected != 1 || preview.Rows[0].Contact.ID == 0 || preview.Rows[1].Contact.Errors["phone"] == "" {
+		t.Errorf("report %+v", preview)
+	}
+	if _, err := app.Store.FindByEmail("ann@example.com"); err != nil {
+		t.Errorf("ann@example.com was not stored: %v", err)
+	}
+	if _, err := app.Store.FindByEmail("bob@example.com"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("bob@example.com was stored: %v", err)
+	}
+}
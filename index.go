@@ -0,0 +1,451 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// Inverted index over the contacts of a MemoryStore, so searches only look at
+// contacts that can match instead of folding every field of every contact,
+// and email uniqueness is a map lookup. It is updated on every change rather
+// than rebuilt
+
+// A set of contact ids. Where a nil id_set is returned it means the index
+// cannot narrow the contacts down, any of them may match
+type id_set map[int]struct{}
+
+// Fields as they are keyed in the index
+const (
+	index_first = "f"
+	index_last  = "l"
+	index_email = "e"
+	index_phone = "p"
+)
+
+// A set of tokens
+type word_set map[string]struct{}
+
+// Longest run of characters kept in grams. Longer strings are looked up by
+// each of their runs this long
+const gram_max_length = 3
+
+type search_index struct {
+	// field + ":" + every run of up to gram_max_length characters in a token
+	// of the field, to the contacts with it. A string is only in a field if
+	// all its runs are
+	grams map[string]id_set
+	// Every three digits in a row of the phone number
+	phone_grams map[string]id_set
+	// field + ":" + every whole token, and field + ":" + the Double Metaphone
+	// codes of every token, for fuzzy matching of names and emails
+	words  map[string]id_set
+	sounds map[string]id_set
+	// field + ":" + the first typo_prefix_length characters of every token of
+	// words, to those tokens. And field + ":" + every string left by taking up
+	// to typo_key_edits characters out of such a prefix, to the prefixes. A
+	// token within a few edits of a word shares one of these strings with it,
+	// so only the tokens found through them are compared with the word
+	prefix_words  map[string]word_set
+	typo_prefixes map[string]word_set
+	// Email to the contact with it, stores never let two contacts share one
+	emails map[string]id_set
+}
+
+func new_search_index(cs []Contact) *search_index {
+
+	ix := &search_index{
+		grams:       make(map[string]id_set),
+		phone_grams: make(map[string]id_set),
+		words:       make(map[string]id_set),
+		sounds:      make(map[string]id_set),
+		emails:      make(map[string]id_set, len(cs)),
+
+		prefix_words:  make(map[string]word_set),
+		typo_prefixes: make(map[string]word_set),
+	}
+	for _, c := range cs {
+		ix.add(c)
+	}
+	return ix
+}
+
+func (ix *search_index) add(c Contact) {
+
+	for key := range index_keys(c) {
+		add_id(ix.grams, key, c.ID)
+	}
+	for gram := range phone_grams(normalize_phone(c.Phone)) {
+		add_id(ix.phone_grams, gram, c.ID)
+	}
+	words, sounds := fuzzy_keys(c)
+	for key := range words {
+		if add_id(ix.words, key, c.ID) {
+			ix.add_typo_keys(key)
+		}
+	}
+	for key := range sounds {
+		add_id(ix.sounds, key, c.ID)
+	}
+	add_id(ix.emails, c.Email, c.ID)
+}
+
+// Forget c, which must be the contact as it was indexed
+func (ix *search_index) remove(c Contact) {
+
+	for key := range index_keys(c) {
+		remove_id(ix.grams, key, c.ID)
+	}
+	for gram := range phone_grams(normalize_phone(c.Phone)) {
+		remove_id(ix.phone_grams, gram, c.ID)
+	}
+	words, sounds := fuzzy_keys(c)
+	for key := range words {
+		if remove_id(ix.words, key, c.ID) {
+			ix.remove_typo_keys(key)
+		}
+	}
+	for key := range sounds {
+		remove_id(ix.sounds, key, c.ID)
+	}
+	remove_id(ix.emails, c.Email, c.ID)
+}
+
+// Index the word key of words, which is new, for typo matching
+func (ix *search_index) add_typo_keys(key string) {
+
+	field, token, _ := strings.Cut(key, ":")
+	prefix := typo_prefix(token)
+	if !add_word(ix.prefix_words, field+":"+prefix, token) {
+		return
+	}
+	for d := range deletions(prefix, typo_key_edits(prefix)) {
+		add_word(ix.typo_prefixes, field+":"+d, prefix)
+	}
+}
+
+// Forget the word key, no contact has it anymore
+func (ix *search_index) remove_typo_keys(key string) {
+
+	field, token, _ := strings.Cut(key, ":")
+	prefix := typo_prefix(token)
+	if !remove_word(ix.prefix_words, field+":"+prefix, token) {
+		return
+	}
+	for d := range deletions(prefix, typo_key_edits(prefix)) {
+		remove_word(ix.typo_prefixes, field+":"+d, prefix)
+	}
+}
+
+// Add id to the set at key, reports whether the key is new
+func add_id(m map[string]id_set, key string, id int) bool {
+
+	ids, ok := m[key]
+	if !ok {
+		ids = make(id_set)
+		m[key] = ids
+	}
+	ids[id] = struct{}{}
+	return !ok
+}
+
+// Take id out of the set at key, reports whether that left the key empty and
+// removed it
+func remove_id(m map[string]id_set, key string, id int) bool {
+
+	ids := m[key]
+	delete(ids, id)
+	if len(ids) == 0 {
+		delete(m, key)
+		return true
+	}
+	return false
+}
+
+// As add_id, for sets of words
+func add_word(m map[string]word_set, key, word string) bool {
+
+	words, ok := m[key]
+	if !ok {
+		words = make(word_set)
+		m[key] = words
+	}
+	words[word] = struct{}{}
+	return !ok
+}
+
+// As remove_id, for sets of words
+func remove_word(m map[string]word_set, key, word string) bool {
+
+	words := m[key]
+	delete(words, word)
+	if len(words) == 0 {
+		delete(m, key)
+		return true
+	}
+	return false
+}
+
+// The id of a contact with email other than id, -1 if there is none
+func (ix *search_index) email_owner(id int, email string) int {
+
+	for other := range ix.emails[email] {
+		if other != id {
+			return other
+		}
+	}
+	return -1
+}
+
+// The contacts that may have a token containing s in one of fields: those
+// with every run of s in that field
+func (ix *search_index) containing(s string, fields ...string) id_set {
+
+	found := make(id_set)
+	for _, field := range fields {
+		var ids id_set
+		for gram := range runs(s) {
+			next := ix.grams[field+":"+gram]
+			if len(next) == 0 {
+				ids = make(id_set)
+				break
+			}
+			ids = intersect_ids(ids, next)
+		}
+		for id := range ids {
+			found[id] = struct{}{}
+		}
+	}
+	return found
+}
+
+// Contacts that may have a field (or, for fields first and last together, the
+// full name) containing value: those with every token of value in that field
+func (ix *search_index) text_candidates(value string, fields ...string) id_set {
+
+	tokens := index_tokens(value)
+	if len(tokens) == 0 {
+		return nil
+	}
+	var found id_set
+	for _, t := range tokens {
+		found = intersect_ids(found, ix.containing(t, fields...))
+	}
+	return found
+}
+
+// Contacts whose phone digits may contain digits
+func (ix *search_index) phone_candidates(digits string) id_set {
+
+	// Too short to have a trigram
+	if len(digits) < 3 {
+		return nil
+	}
+	var found id_set
+	for gram := range phone_grams(digits) {
+		ids := ix.phone_grams[gram]
+		if ids == nil {
+			return make(id_set)
+		}
+		found = intersect_ids(found, ids)
+	}
+	return found
+}
+
+// Contacts with a token in one of fields within the edits allowed for word,
+// or that sounds like it
+func (ix *search_index) fuzzy_candidates(word string, fields ...string) id_set {
+
+	found := make(id_set)
+	add := func(ids id_set) {
+		for id := range ids {
+			found[id] = struct{}{}
+		}
+	}
+	codes := sound_codes(word)
+	for _, field := range fields {
+		for _, code := range codes {
+			add(ix.sounds[field+":"+code])
+		}
+	}
+	max_edits := typo_max_edits(utf8.RuneCountInString(word))
+	if max_edits == 0 {
+		return found
+	}
+	var d typo_table
+	for _, field := range fields {
+		compared := make(word_set)
+		for del := range deletions(typo_prefix(word), max_edits) {
+			for prefix := range ix.typo_prefixes[field+":"+del] {
+				for token := range ix.prefix_words[field+":"+prefix] {
+					if _, ok := compared[token]; ok {
+						continue
+					}
+					compared[token] = struct{}{}
+					if d.distance(word, token) >= 0 {
+						add(ix.words[field+":"+token])
+					}
+				}
+			}
+		}
+	}
+	return found
+}
+
+// Both nil means every contact
+func intersect_ids(a, b id_set) id_set {
+
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	if len(b) < len(a) {
+		a, b = b, a
+	}
+	out := make(id_set, len(a))
+	for id := range a {
+		if _, ok := b[id]; ok {
+			out[id] = struct{}{}
+		}
+	}
+	return out
+}
+
+func union_ids(a, b id_set) id_set {
+
+	if a == nil || b == nil {
+		return nil
+	}
+	out := make(id_set, len(a)+len(b))
+	for id := range a {
+		out[id] = struct{}{}
+	}
+	for id := range b {
+		out[id] = struct{}{}
+	}
+	return out
+}
+
+// The gram keys of c
+func index_keys(c Contact) map[string]struct{} {
+
+	keys := make(map[string]struct{})
+	for _, field := range []struct{ name, value string }{
+		{index_first, c.First},
+		{index_last, c.Last},
+		{index_email, c.Email},
+		{index_phone, c.Phone},
+	} {
+		for _, t := range index_tokens(fold(field.value)) {
+			r := []rune(t)
+			for i := range r {
+				for j := i + 1; j <= min(i+gram_max_length, len(r)); j++ {
+					keys[field.name+":"+string(r[i:j])] = struct{}{}
+				}
+			}
+		}
+	}
+	return keys
+}
+
+// The runs of s containing gram_max_length characters, or s itself when it
+// is shorter than that
+func runs(s string) map[string]struct{} {
+
+	r := []rune(s)
+	if len(r) <= gram_max_length {
+		return map[string]struct{}{s: {}}
+	}
+	out := make(map[string]struct{}, len(r))
+	for i := 0; i+gram_max_length <= len(r); i++ {
+		out[string(r[i:i+gram_max_length])] = struct{}{}
+	}
+	return out
+}
+
+// The whole tokens and the sound codes of the fields fuzzy search looks at
+func fuzzy_keys(c Contact) (words, sounds map[string]struct{}) {
+
+	words = make(map[string]struct{})
+	sounds = make(map[string]struct{})
+	for _, field := range []struct{ name, value string }{
+		{index_first, c.First},
+		{index_last, c.Last},
+		{index_email, c.Email},
+	} {
+		for _, t := range index_tokens(fold(field.value)) {
+			words[field.name+":"+t] = struct{}{}
+			for _, code := range sound_codes(t) {
+				sounds[field.name+":"+code] = struct{}{}
+			}
+		}
+	}
+	return words, sounds
+}
+
+// Characters of a token the typo keys are made of. A longer token is only
+// keyed by its start, which keeps their number down for long tokens and for
+// tokens that differ only at the end, like numbered email addresses
+const typo_prefix_length = 6
+
+func typo_prefix(token string) string {
+
+	r := []rune(token)
+	if len(r) <= typo_prefix_length {
+		return token
+	}
+	return string(r[:typo_prefix_length])
+}
+
+// Characters taken out of the prefix of a token for its typo keys: as many as
+// the edits allowed for any word the token is long enough to be a typo of
+func typo_key_edits(prefix string) int {
+
+	n := utf8.RuneCountInString(prefix)
+	// A word of 8 characters takes 2 edits, and may be 2 longer than the token
+	if n >= 8-2 {
+		return 2
+	}
+	if n >= typo_min_length-1 {
+		return 1
+	}
+	return 0
+}
+
+// s and every string left by taking up to n characters out of it
+func deletions(s string, n int) word_set {
+
+	out := word_set{s: {}}
+	last := []string{s}
+	for range n {
+		var next []string
+		for _, w := range last {
+			r := []rune(w)
+			for i := range r {
+				d := string(slices.Concat(r[:i], r[i+1:]))
+				if _, ok := out[d]; !ok {
+					out[d] = struct{}{}
+					next = append(next, d)
+				}
+			}
+		}
+		last = next
+	}
+	return out
+}
+
+// The runs of letters and digits in s
+func index_tokens(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool { return !is_word_rune(r) })
+}
+
+func phone_grams(digits string) map[string]struct{} {
+
+	grams := make(map[string]struct{})
+	for i := 0; i+3 <= len(digits); i++ {
+		grams[digits[i:i+3]] = struct{}{}
+	}
+	return grams
+}
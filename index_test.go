@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// n made up contacts, always the same ones. Names are built from syllables so
+// there are many distinct ones, like in a real address book
+func bench_contacts(n int) []Contact {
+
+	rnd := rand.New(rand.NewSource(1))
+	syllables := []string{"ka", "ro", "son", "gre", "ben", "li", "mar", "tin", "el", "ha", "vo", "dri", "ne", "sch", "mi", "dt", "ler", "an", "us", "berg"}
+	name := func(parts int) string {
+		s := ""
+		for range parts {
+			s += syllables[rnd.Intn(len(syllables))]
+		}
+		return string(s[0]-'a'+'A') + s[1:]
+	}
+	cs := make([]Contact, n)
+	for i := range cs {
+		first, last := name(2), name(2+rnd.Intn(2))
+		cs[i] = Contact{
+			ID:    i + 1,
+			First: first,
+			Last:  last,
+			Email: fmt.Sprintf("%s.%s%d@example.com", fold(first), fold(last), i),
+			Phone: fmt.Sprintf("555-%03d-%04d", rnd.Intn(1000), rnd.Intn(10000)),
+		}
+	}
+	// One Gross in the book to find
+	cs[n/2].Last = "Gross"
+	return cs
+}
+
+var bench_sizes = []int{10000, 50000}
+
+// An unquoted word, which is also matched for typos and sounds
+const bench_query = "gross"
+
+func BenchmarkSearchIndexed(b *testing.B) {
+
+	for _, n := range bench_sizes {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			s := newMemoryStore(bench_contacts(n))
+			b.ResetTimer()
+			for range b.N {
+				query, _ := parse_query(bench_query)
+				s.Search(query, nil, 0, 10)
+			}
+		})
+	}
+}
+
+// What Search cost before the index: every contact is scored
+func BenchmarkSearchLinear(b *testing.B) {
+
+	for _, n := range bench_sizes {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			cs := bench_contacts(n)
+			b.ResetTimer()
+			for range b.N {
+				query, _ := parse_query(bench_query)
+				query.rank(cs, nil, 0, 10)
+			}
+		})
+	}
+}
+
+func BenchmarkCreate(b *testing.B) {
+
+	for _, n := range bench_sizes {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			s := newMemoryStore(bench_contacts(n))
+			b.ResetTimer()
+			for i := range b.N {
+				_, err := s.Create(Contact{First: "Bench", Last: "Mark", Email: fmt.Sprintf("bench%d@example.com", i), Phone: "555-0100"})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkUpdate(b *testing.B) {
+
+	for _, n := range bench_sizes {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			s := newMemoryStore(bench_contacts(n))
+			c, err := s.Get(n / 2)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := range b.N {
+				c.Phone = fmt.Sprintf("555-%04d", i%10000)
+				c.Version = 0
+				_, err := s.Update(c)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// The typo and sound keys find the same contacts as comparing the word with
+// every token, also after contacts are removed
+func TestFuzzyCandidates(t *testing.T) {
+
+	cs := bench_contacts(400)
+	ix := new_search_index(cs)
+	for _, c := range cs[:100] {
+		ix.remove(c)
+	}
+
+	// Every token once, and typos of them
+	rnd := rand.New(rand.NewSource(2))
+	words := make(map[string]bool)
+	for _, c := range cs[:200] {
+		for _, t := range index_tokens(fold(c.First + " " + c.Last + " " + c.Email)) {
+			words[t] = true
+			r := []rune(t)
+			i := rnd.Intn(len(r))
+			words[string(r[:i])+string(r[i+1:])] = true
+			words[string(r[:i])+"x"+string(r[i:])] = true
+			if i+1 < len(r) {
+				words[string(r[:i])+string(r[i+1])+string(r[i])+string(r[i+2:])] = true
+			}
+		}
+	}
+
+	fields := []string{index_first, index_last, index_email}
+	for word := range words {
+		want := make(id_set)
+		for key, ids := range ix.words {
+			_, token, _ := strings.Cut(key, ":")
+			if typo_distance(word, token) >= 0 {
+				maps.Copy(want, ids)
+			}
+		}
+		for _, field := range fields {
+			for _, code := range sound_codes(word) {
+				maps.Copy(want, ix.sounds[field+":"+code])
+			}
+		}
+		got := ix.fuzzy_candidates(word, fields...)
+		if !maps.Equal(got, want) {
+			t.Errorf("fuzzy_candidates(%q) found %d contacts, comparing every word %d", word, len(got), len(want))
+		}
+	}
+}
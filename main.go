@@ -1,17 +1,22 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"html/template"
 	"hypermedia/archiver"
 	"io"
 	"log/slog"
+	"mime"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
-	"sync"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -19,12 +24,11 @@ import (
 
 var log *slog.Logger
 
-var contacts []Contact
-var contacts_data []byte
-var myArchiver archiver.Archiver
-
 type App struct {
 	Templates *Templates
+	Store     ContactStore
+	// Answers to API writes kept for retries with the same Idempotency-Key
+	Idempotency *idempotency_cache
 }
 
 // Template utils
@@ -45,6 +49,12 @@ func newTemplate() *Templates {
 		"mult": func(a float64, b float64) float64 {
 			return a * b
 		},
+		"export_formats": func() []ExportFormat {
+			return export_formats
+		},
+		"highlight": func(q *Query, c Contact) Highlighted {
+			return q.Highlight(c)
+		},
 	})
 	return &Templates{
 		templates: template.Must(tmpl.ParseGlob("templates/*.html")),
@@ -53,20 +63,59 @@ func newTemplate() *Templates {
 
 func main() {
 
+	store_kind := flag.String("store", "json", "contact storage: memory, json or sqlite")
+	contacts_path := flag.String("contacts", "contacts.json", "contacts file used by the json store, and to seed the others")
+	db_path := flag.String("db", "contacts.db", "database file used by the sqlite store")
+	archive_dir := flag.String("archive-dir", filepath.Join(os.TempDir(), "hypermedia-archives"), "directory for generated archives")
+	archive_ttl := flag.Duration("archive-ttl", 30*time.Minute, "how long an idle browser's archive is kept")
+	flag.Parse()
+	if *archive_ttl <= 0 {
+		fmt.Fprintf(os.Stderr, "invalid value %q for flag -archive-ttl: must be positive\n", archive_ttl.String())
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	// Init logger
 	log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
 
-	// Load contacts
-	err := load_contacts()
+	// Open contact storage
+	store, err := open_store(*store_kind, *contacts_path, *db_path)
 	if err != nil {
-		log.Error("Error in load_contacts()", "error", err)
+		log.Error("Error in open_store()", "error", err)
+		os.Exit(1)
+	}
+	// The SQLite store holds the database open
+	if c, ok := store.(io.Closer); ok {
+		defer c.Close()
 	}
 
-	// Set default archvier status for user
-	user_id := uuid.NewString()
-	myArchiver = *archiver.GetArchiverForUser(user_id)
+	// Every browser gets its own archiver, idle ones are dropped after a while
+	err = os.MkdirAll(*archive_dir, 0700)
+	if err != nil {
+		log.Error("Error in os.MkdirAll(archive_dir)", "error", err)
+		os.Exit(1)
+	}
+	archiver.Dir = *archive_dir
+	archiver.StartExpiry(*archive_ttl)
 
-	app := App{newTemplate()}
+	app := App{newTemplate(), store, new_idempotency_cache(idempotency_max_keys, idempotency_ttl)}
+
+	// Start server
+	server := http.Server{
+		Addr:         ":8080",
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 90 * time.Second,
+		Handler:      logging(sessions(app.routes())),
+	}
+	err = server.ListenAndServe()
+	if err != nil {
+		log.Error("Error in server.ListenAndServe", "error", err)
+		return
+	}
+}
+
+// Every route of the hypermedia and the JSON api
+func (app *App) routes() http.Handler {
 
 	mux := http.NewServeMux()
 
@@ -102,31 +151,58 @@ func main() {
 
 	mux.HandleFunc("DELETE /contacts/archive", app.delete_archive_handler)
 
+	mux.HandleFunc("POST /contacts/archive/cancel", app.cancel_archive_handler)
+
+	mux.HandleFunc("GET /contacts/archive/events", app.archive_events_handler)
+
 	mux.HandleFunc("GET /contacts/archive/file", app.archive_file_handler)
 
-	// json api
-	mux.HandleFunc("GET /api/v1/contacts", get_contacts_handler)
+	mux.HandleFunc("GET /contacts/import", app.get_import_handler)
 
-	mux.HandleFunc("POST /api/v1/contacts", post_contacts_handler)
+	mux.HandleFunc("POST /contacts/import", app.post_import_handler)
 
-	mux.HandleFunc("GET /api/v1/contacts/{id}", get_contact_handler)
+	mux.HandleFunc("POST /contacts/import/{token}/preview", app.import_preview_handler)
 
-	mux.HandleFunc("PUT /api/v1/contacts/{id}", put_contact_handler)
+	mux.HandleFunc("POST /contacts/import/{token}/commit", app.commit_import_handler)
 
-	mux.HandleFunc("DELETE /api/v1/contacts/{id}", delete_contact_handler)
+	// json api, on its own mux so "GET /" does not catch what it has no
+	// route for
+	api := http.NewServeMux()
 
-	// Start server
-	server := http.Server{
-		Addr:         ":8080",
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 90 * time.Second,
-		Handler:      logging(mux),
-	}
-	err = server.ListenAndServe()
-	if err != nil {
-		log.Error("Error in server.ListenAndServe", "error", err)
-		return
-	}
+	api.HandleFunc("GET /api/v1/contacts", app.get_contacts_handler)
+
+	// Writes can be retried with an Idempotency-Key, bodies are read up to
+	// the limit of each route
+	api.Handle("POST /api/v1/contacts", app.idempotent(contact_body_max_size, app.post_contacts_handler))
+
+	api.HandleFunc("GET /api/v1/contacts/{id}", app.get_contact_handler)
+
+	api.Handle("PUT /api/v1/contacts/{id}", app.idempotent(contact_body_max_size, app.put_contact_handler))
+
+	api.Handle("PATCH /api/v1/contacts/{id}", app.idempotent(contact_body_max_size, app.patch_contact_handler))
+
+	api.Handle("DELETE /api/v1/contacts/{id}", app.idempotent(contact_body_max_size, app.api_delete_contact_handler))
+
+	api.Handle("POST /api/v1/contacts/import", app.idempotent(import_max_size, app.api_import_contacts_handler))
+
+	api.Handle("POST /api/v1/contacts:batch", app.idempotent(batch_body_max_size, app.batch_contacts_handler))
+
+	// Anything else under the json api gets a problem rather than plain text
+	api.HandleFunc("/", api_not_found_handler)
+
+	api.HandleFunc("/api/v1/contacts", api_method_not_allowed("GET, POST"))
+
+	api.HandleFunc("/api/v1/contacts/{id}", api_method_not_allowed("GET, PUT, PATCH, DELETE"))
+
+	api.HandleFunc("/api/v1/contacts:batch", api_method_not_allowed("POST"))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			api.ServeHTTP(w, r)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
 }
 
 //------------------------------------------------------------------------------
@@ -138,68 +214,87 @@ func redirect_handler(w http.ResponseWriter, r *http.Request) {
 }
 
 type Contact struct {
-	ID     int               `json:"id"`
-	First  string            `json:"first"`
-	Last   string            `json:"last"`
-	Email  string            `json:"email"`
-	Phone  string            `json:"phone"`
-	Errors map[string]string `json:"errors"`
+	ID    int    `json:"id"`
+	First string `json:"first"`
+	Last  string `json:"last"`
+	Email string `json:"email"`
+	Phone string `json:"phone"`
+	// Incremented by every change to the contact, from 1 when it is created
+	Version int               `json:"version"`
+	Errors  map[string]string `json:"errors"`
 }
 
 type PageData struct {
 	Contacts []Contact
 	Query    string
 	Page     int
-	Archiver archiver.Archiver
+	Archiver archiver.Snapshot
+	// Why Query could not be parsed, shown under the search box
+	QueryError *QueryError
+	// Query parsed, to highlight what it found in the rows
+	Search *Query
+	// Nil when the list is in its default order
+	Sort *SortOrder
+	// Contacts per page, and how many there are in all the pages
+	PerPage int
+	Total   int
+	// The next page is loaded when the end of the rows is scrolled to,
+	// instead of showing page links
+	Scroll bool
 }
 
-// /contacts?q={id}
+// /contacts?q={query}&sort={fields}&dir={asc|desc}&page={n}&per_page={n}
+// Without q every contact is listed, 10 per page unless per_page says
+// otherwise. See query.go for what q can say and sort.go for sort and dir
 func (app *App) contact_query_handler(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "text/html")
 
-	id_string := r.URL.Query().Get("q")
+	text := strings.TrimSpace(r.URL.Query().Get("q"))
 
-	if id_string == "" {
-
-		// Show first 10 contacts
-		page_string := r.URL.Query().Get("page")
-		page, _ := strconv.Atoi(page_string)
+	page, per_page := parse_page(r)
 
-		if page <= 0 {
-			page = 1
-		}
+	data := PageData{Query: text, Page: page, Archiver: user_archiver(r).Snapshot(), PerPage: per_page}
+	data.Scroll = list_mode(w, r) == list_scroll
+	// A bad sort from a hand made URL just leaves the default order
+	data.Sort, _ = parse_sort(r.URL.Query().Get("sort"), r.URL.Query().Get("dir"), request_language(r))
 
-		err := app.Templates.Render(w, "index", PageData{get_contact_list(page), "", page, myArchiver})
+	query, err := parse_query(text)
+	if err != nil {
+		// Shown with the search box, there are no results to list
+		data.QueryError, _ = err.(*QueryError)
+	} else {
+		data.Search = query
+		data.Contacts, data.Total, err = app.search_contact_list(query, data.Sort, page, per_page)
 		if err != nil {
-			http.Error(w, "Error providing contact information", http.StatusInternalServerError)
-			log.Error("contact_query_handler: error in app.Templates.Render() default", "error", err)
+			http.Error(w, "Error loading contacts", http.StatusInternalServerError)
+			log.Error("contact_query_handler: error in app.search_contact_list", "error", err)
 			return
 		}
-		return
 	}
 
-	// Parse id
-	id_int, err := strconv.Atoi(id_string)
-	if err != nil {
-		http.Error(w, "Error, id must be an integer", http.StatusBadRequest)
-		log.Error("contact_query_handler: error in strconv.Atoi(id)", "error", err)
-		return
+	// Active search and the column headers only need the rows, and the
+	// headers, page links and error message swapped in around them. Scrolling
+	// to the end of the rows appends the next page in place of the sentinel
+	trigger := r.Header.Get("HX-Trigger")
+	if r.Header.Get("HX-Request") == "true" && trigger == "load-more" {
+		err = app.Templates.Render(w, "row_list", data)
+	} else if trigger == "search" || strings.HasPrefix(trigger, "sort-") {
+		err = app.Templates.Render(w, "contact_head_oob", data)
+		if err == nil {
+			err = app.Templates.Render(w, "rows", data)
+		}
+		if err == nil {
+			err = app.Templates.Render(w, "pagination_oob", data)
+		}
+		if err == nil {
+			err = app.Templates.Render(w, "search_error_oob", data)
+		}
+	} else {
+		err = app.Templates.Render(w, "index", data)
 	}
-
-	// Search for specific contact
-	c, err := find_contact(id_int)
 	if err != nil {
-		http.Error(w, "Error, contact not found", http.StatusBadRequest)
-		log.Error("contact_query_handler: error in find_contact", "error", err)
-		return
-	}
-
-	// Show contact information
-	data := PageData{[]Contact{*c}, id_string, 0, myArchiver}
-	err = app.Templates.Render(w, "index", data)
-	if err != nil {
-		http.Error(w, "Error finding contact", http.StatusBadRequest)
+		http.Error(w, "Error providing contact information", http.StatusInternalServerError)
 		log.Error("contact_query_handler: error in app.Templates.Render()", "error", err)
 		return
 	}
@@ -214,20 +309,24 @@ func (app *App) contact_id_handler(w http.ResponseWriter, r *http.Request) {
 
 	if id_string == "" {
 
-		// Show first 10 contacts
-		page_string := r.URL.Query().Get("page")
-		page, _ := strconv.Atoi(page_string)
-		if page <= 0 {
-			page = 1
+		// Show a page of contacts
+		page, per_page := parse_page(r)
+
+		cs, total, err := app.get_contact_list(page, per_page)
+		if err != nil {
+			http.Error(w, "Error loading contacts", http.StatusInternalServerError)
+			log.Error("contact_id_handler: error in app.get_contact_list", "error", err)
+			return
 		}
+		data := PageData{Contacts: cs, Page: page, Archiver: user_archiver(r).Snapshot(), PerPage: per_page, Total: total}
+		data.Scroll = list_mode(w, r) == list_scroll
 
 		// Show contact information depending on trigger
-		var err error
 		if r.Header.Get("HX-Trigger") == "search" {
-			err = app.Templates.Render(w, "rows", PageData{get_contact_list(page), "", page, myArchiver})
+			err = app.Templates.Render(w, "rows", data)
 
 		} else {
-			err = app.Templates.Render(w, "index", PageData{get_contact_list(page), "", page, myArchiver})
+			err = app.Templates.Render(w, "index", data)
 		}
 		if err != nil {
 			http.Error(w, "Error providing contact information", http.StatusInternalServerError)
@@ -247,10 +346,15 @@ func (app *App) contact_id_handler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Search for specific contact
-	c, err := find_contact(id_int)
-	if err != nil {
+	c, err := app.Store.Get(id_int)
+	if errors.Is(err, ErrNotFound) {
 		http.Error(w, "Error, contact not found", http.StatusBadRequest)
-		log.Error("contact_id_handler: error in find_contact", "error", err)
+		log.Error("contact_id_handler: error in app.Store.Get", "error", err)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error loading contact", http.StatusInternalServerError)
+		log.Error("contact_id_handler: error in app.Store.Get", "error", err)
 		return
 	}
 
@@ -281,8 +385,8 @@ func (app *App) get_add_contact_handler(w http.ResponseWriter, r *http.Request)
 func (app *App) post_add_contact_handler(w http.ResponseWriter, r *http.Request) {
 
 	// Get form values
+	// The store assigns the id
 	c := Contact{
-		ID:     contacts[len(contacts)-1].ID + 1,
 		First:  r.FormValue("first_name"),
 		Last:   r.FormValue("last_name"),
 		Email:  r.FormValue("email"),
@@ -290,38 +394,32 @@ func (app *App) post_add_contact_handler(w http.ResponseWriter, r *http.Request)
 		Errors: make(map[string]string),
 	}
 
-	email_error := validate_email(-1, c.Email)
-	if email_error != "" {
-		// We must check this in order to keep the map length to zero when
-		// no errors are found
-		c.Errors["email"] = email_error
-	}
-	if c.First == "" {
-		c.Errors["first"] = "First name is required"
-	}
-	if c.Last == "" {
-		c.Errors["last"] = "Last name is required"
-	}
-	if c.Phone == "" {
-		c.Errors["phone"] = "Phone is required"
-	}
+	validate_contact(&c, app.validate_email(-1, c.Email))
 
 	w.Header().Set("Content-Type", "text/html")
 	if len(c.Errors) == 0 {
 		// Add contact to contacts
-		contacts = append(contacts, c)
-
-		log.Info("Contact added successfully")
+		created, err := app.Store.Create(c)
+		if errors.Is(err, ErrEmailTaken) {
+			// Taken by a concurrent request after validate_email checked it
+			c.Errors["email"] = email_taken_message
+		} else if err != nil {
+			http.Error(w, "Error, could not save contact", http.StatusInternalServerError)
+			log.Error("post_add_contact_handler: error in app.Store.Create", "error", err)
+			return
+		} else {
+			log.Info("Contact added successfully")
 
-		// Inform user
-		err := app.Templates.Render(w, "sucess-new", c)
-		if err != nil {
-			http.Error(w, "Error, could show success message", http.StatusInternalServerError)
-			log.Error("post_add_contact_handler: error in app.Templates.Render(w, \"sucess-new\", c)", "error", err)
+			// Inform user
+			err = app.Templates.Render(w, "sucess-new", created)
+			if err != nil {
+				http.Error(w, "Error, could show success message", http.StatusInternalServerError)
+				log.Error("post_add_contact_handler: error in app.Templates.Render(w, \"sucess-new\", c)", "error", err)
+				return
+			}
+			// w.Header().Set("HX-Redirect", "/contacts/"+strconv.Itoa(c.ID))
 			return
 		}
-		// w.Header().Set("HX-Redirect", "/contacts/"+strconv.Itoa(c.ID))
-		return
 	}
 
 	// We cannot add contact
@@ -347,10 +445,15 @@ func (app *App) get_edit_contact_handler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	// Search for contact to edit
-	c, err := find_contact(id_int)
-	if err != nil {
+	c, err := app.Store.Get(id_int)
+	if errors.Is(err, ErrNotFound) {
 		http.Error(w, "Error, contact not found", http.StatusBadRequest)
-		log.Error("edit_contact_get_handler: error in find_contact", "error", err)
+		log.Error("edit_contact_get_handler: error in app.Store.Get", "error", err)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error loading contact", http.StatusInternalServerError)
+		log.Error("edit_contact_get_handler: error in app.Store.Get", "error", err)
 		return
 	}
 
@@ -374,58 +477,51 @@ func (app *App) post_edit_contact_handler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	// Get form values
+	// Get form values, the version is the one the form was filled from. Forms
+	// without it save whatever the version
+	version, _ := strconv.Atoi(r.FormValue("version"))
 	c := Contact{
-		ID:     id_int,
-		First:  r.FormValue("first_name"),
-		Last:   r.FormValue("last_name"),
-		Email:  r.FormValue("email"),
-		Phone:  r.FormValue("phone"),
-		Errors: make(map[string]string),
+		ID:      id_int,
+		First:   r.FormValue("first_name"),
+		Last:    r.FormValue("last_name"),
+		Email:   r.FormValue("email"),
+		Phone:   r.FormValue("phone"),
+		Version: version,
+		Errors:  make(map[string]string),
 	}
 
-	email_error := validate_email(id_int, c.Email)
-	if email_error != "" {
-		// We must check this in order to keep the map length to zero when
-		// no errors are found
-		c.Errors["email"] = email_error
-	}
-	if c.First == "" {
-		c.Errors["first"] = "First name is required"
-	}
-	if c.Last == "" {
-		c.Errors["last"] = "Last name is required"
-	}
-	if c.Phone == "" {
-		c.Errors["phone"] = "Phone is required"
-	}
+	validate_contact(&c, app.validate_email(id_int, c.Email))
 
 	if len(c.Errors) == 0 {
-		// Search for c to edit
-		contact, err := find_contact(id_int)
-		if err != nil {
+		// Replace with editted data
+		edited, err := app.Store.Update(c)
+		if errors.Is(err, ErrEmailTaken) {
+			// Taken by a concurrent request after validate_email checked it
+			c.Errors["email"] = email_taken_message
+		} else if errors.Is(err, ErrNotFound) {
 			http.Error(w, "Error, contact not found", http.StatusBadRequest)
-			log.Error("post_edit_contact_handler: error in find_contact", "error", err)
+			log.Error("post_edit_contact_handler: error in app.Store.Update", "error", err)
 			return
-		}
-
-		// Replace with editted data
-		contact.Email = c.Email
-		contact.First = c.First
-		contact.Last = c.Last
-		contact.Phone = c.Phone
-		contact.Errors = c.Errors
-
-		log.Info("Contact edited successfully")
-		// Inform user
-		err = app.Templates.Render(w, "sucess-edit", c)
-		if err != nil {
-			http.Error(w, "Error, could show success message", http.StatusInternalServerError)
-			log.Error("post_edit_contact_handler: error in app.Templates.Render(w, \"sucess-edit\", c)", "error", err)
+		} else if errors.Is(err, ErrVersionChanged) {
+			log.Error("post_edit_contact_handler: error in app.Store.Update", "error", err)
+			app.render_edit_conflict(w, c)
+			return
+		} else if err != nil {
+			http.Error(w, "Error, could not save contact", http.StatusInternalServerError)
+			log.Error("post_edit_contact_handler: error in app.Store.Update", "error", err)
+			return
+		} else {
+			log.Info("Contact edited successfully")
+			// Inform user
+			err = app.Templates.Render(w, "sucess-edit", edited)
+			if err != nil {
+				http.Error(w, "Error, could show success message", http.StatusInternalServerError)
+				log.Error("post_edit_contact_handler: error in app.Templates.Render(w, \"sucess-edit\", c)", "error", err)
+				return
+			}
+			// w.Header().Set("HX-Redirect", "/contacts/"+strconv.Itoa(id_int))
 			return
 		}
-		// w.Header().Set("HX-Redirect", "/contacts/"+strconv.Itoa(id_int))
-		return
 	}
 
 	w.Header().Set("Content-Type", "text/html")
@@ -437,6 +533,38 @@ func (app *App) post_edit_contact_handler(w http.ResponseWriter, r *http.Request
 	}
 }
 
+// What post_edit_contact_handler shows when someone else saved the contact
+// while it was being edited
+type EditConflict struct {
+	// The contact as the form sent it and as it is stored now
+	Mine   Contact
+	Theirs Contact
+}
+
+// Show mine next to the stored contact, so the user picks which to keep
+func (app *App) render_edit_conflict(w http.ResponseWriter, mine Contact) {
+
+	theirs, err := app.Store.Get(mine.ID)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Error, contact not found", http.StatusBadRequest)
+		log.Error("render_edit_conflict: error in app.Store.Get", "error", err)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error loading contact", http.StatusInternalServerError)
+		log.Error("render_edit_conflict: error in app.Store.Get", "error", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(http.StatusConflict)
+	err = app.Templates.Render(w, "edit-conflict", EditConflict{Mine: mine, Theirs: theirs})
+	if err != nil {
+		log.Error("render_edit_conflict: error in app.Templates.Render(w, \"edit-conflict\", conflict)", "error", err)
+		return
+	}
+}
+
 // DELETE /contacts/{id}/edit
 func (app *App) delete_contact_handler(w http.ResponseWriter, r *http.Request) {
 
@@ -449,39 +577,47 @@ func (app *App) delete_contact_handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Delete contact
-	for i, c := range contacts {
-		if c.ID == id_int {
-			// Remove the contact at index i
-			contacts = append(contacts[:i], contacts[i+1:]...)
+	// Kept to render the success message once it is gone
+	c, err := app.Store.Get(id_int)
+	if err == nil {
+		err = app.Store.Delete(id_int)
+	}
+	if errors.Is(err, ErrNotFound) {
+		// We cannot delete contact, which should always be possible form this endpoint
+		http.Error(w, "Error deleting contact", http.StatusInternalServerError)
+		log.Error("delete_contact_handler: contact not found")
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error deleting contact", http.StatusInternalServerError)
+		log.Error("delete_contact_handler: error in app.Store.Delete", "error", err)
+		return
+	}
 
-			log.Info("Contact deleted successfully")
-			if r.Header.Get("HX-Trigger") == "delete-btn" {
-				err = app.Templates.Render(w, "sucess-delete", c)
-				if err != nil {
-					http.Error(w, "Error, could show success message", http.StatusInternalServerError)
-					log.Error("post_edit_contact_handler: error in app.Templates.Render(w, \"sucess-delete\", c)", "error", err)
-					return
-				}
-				// http.Redirect(w, r, "/contacts", http.StatusSeeOther)
-			}
-			// We do not want to render anything
+	log.Info("Contact deleted successfully")
+	if r.Header.Get("HX-Trigger") == "delete-btn" {
+		err = app.Templates.Render(w, "sucess-delete", c)
+		if err != nil {
+			http.Error(w, "Error, could show success message", http.StatusInternalServerError)
+			log.Error("post_edit_contact_handler: error in app.Templates.Render(w, \"sucess-delete\", c)", "error", err)
 			return
 		}
+		// http.Redirect(w, r, "/contacts", http.StatusSeeOther)
 	}
-
-	// We cannot delete contact, which should always be possible form this endpoint
-	http.Error(w, "Error deleting contact", http.StatusInternalServerError)
-	log.Error("delete_contact_handler: contact not found")
-
+	// We do not want to render anything
 }
 
 // /contacts/count
 func (app *App) count_contacts_handler(w http.ResponseWriter, r *http.Request) {
 
 	time.Sleep(1 * time.Second)
-	count := len(contacts)
-	_, err := w.Write([]byte(strconv.Itoa(count) + " total Contacts"))
+	count, err := app.Store.Count()
+	if err != nil {
+		http.Error(w, "Error counting contacts", http.StatusInternalServerError)
+		log.Error("count_contacts_handler: error in app.Store.Count", "error", err)
+		return
+	}
+	_, err = w.Write([]byte(strconv.Itoa(count) + " total Contacts"))
 	if err != nil {
 		http.Error(w, "Error, could not write response", http.StatusInternalServerError)
 		log.Error("count_contacts_handler: error in  w.Write()", "error", err)
@@ -517,18 +653,27 @@ func (app *App) delete_multiple_contacts_handler(w http.ResponseWriter, r *http.
 		ids_int = append(ids_int, id_int)
 	}
 
-	// Delete selected contacts
+	// Delete selected contacts, some may already be gone
 	for _, id_int := range ids_int {
-		for i, c := range contacts {
-			if c.ID == id_int {
-				// Remove the contact at index i
-				contacts = append(contacts[:i], contacts[i+1:]...)
-			}
+		err = app.Store.Delete(id_int)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			http.Error(w, "Error deleting contacts", http.StatusInternalServerError)
+			log.Error("delete_multiple_contacts_handler: error in app.Store.Delete", "error", err)
+			return
 		}
 	}
 
+	cs, total, err := app.get_contact_list(1, default_per_page)
+	if err != nil {
+		http.Error(w, "Error loading contacts", http.StatusInternalServerError)
+		log.Error("delete_multiple_contacts_handler: error in app.get_contact_list", "error", err)
+		return
+	}
+
 	w.Header().Set("Content-Type", "text/html")
-	err = app.Templates.Render(w, "index", PageData{get_contact_list(1), "", 1, myArchiver})
+	data := PageData{Contacts: cs, Page: 1, Archiver: user_archiver(r).Snapshot(), PerPage: default_per_page, Total: total}
+	data.Scroll = list_mode(w, r) == list_scroll
+	err = app.Templates.Render(w, "index", data)
 	if err != nil {
 		http.Error(w, "Error, could not render page", http.StatusInternalServerError)
 		log.Error("delete_multiple_contacts_handler: error in app.Templates.Render()", "error", err)
@@ -548,15 +693,20 @@ func (app *App) validate_email_handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	c, err := find_contact(id_int)
-	if err != nil {
+	c, err := app.Store.Get(id_int)
+	if errors.Is(err, ErrNotFound) {
 		http.Error(w, "Error, contact not found", http.StatusBadRequest)
-		log.Error("validate_email_handler: error in find_contact", "error", err)
+		log.Error("validate_email_handler: error in app.Store.Get", "error", err)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error loading contact", http.StatusInternalServerError)
+		log.Error("validate_email_handler: error in app.Store.Get", "error", err)
 		return
 	}
 	// Check email is unique
 	email := r.URL.Query().Get("email")
-	c.Errors["email"] = validate_email(id_int, email)
+	c.Errors["email"] = app.validate_email(id_int, email)
 
 	w.Header().Set("Content-Type", "text/html")
 	err = app.Templates.Render(w, "error_email", c)
@@ -570,19 +720,27 @@ func (app *App) validate_email_handler(w http.ResponseWriter, r *http.Request) {
 // /contacts/archive
 func (app *App) post_archive_handler(w http.ResponseWriter, r *http.Request) {
 
-	// Concurrent processing
-	var wg sync.WaitGroup
-	wg.Add(1)
+	myArchiver := user_archiver(r)
+	// Archive what the store holds right now
+	contacts, err := app.Store.List(0, -1)
+	if err != nil {
+		http.Error(w, "Error loading contacts", http.StatusInternalServerError)
+		log.Error("archive_post_handler: error in app.Store.List", "error", err)
+		return
+	}
 
-	go func() {
-		defer wg.Done()
-		myArchiver.Run()
-	}()
+	job, err := new_export(r.FormValue("format"), r.FormValue("delimiter"), contacts)
+	if err != nil {
+		http.Error(w, "Error, unsupported archive format", http.StatusBadRequest)
+		log.Error("archive_post_handler: error in new_export", "error", err)
+		return
+	}
 
-	time.Sleep(500 * time.Millisecond)
+	// Runs in the background, progress is pushed through archive_events_handler
+	myArchiver.Run(job)
 
 	w.Header().Set("Content-Type", "text/html")
-	err := app.Templates.Render(w, "archive_ui", myArchiver)
+	err = app.Templates.Render(w, "archive_ui", myArchiver.Snapshot())
 	if err != nil {
 		http.Error(w, "Error processing archive", http.StatusInternalServerError)
 		log.Error("archive_post_handler: error in app.Templates.Render()", "error", err)
@@ -593,7 +751,8 @@ func (app *App) post_archive_handler(w http.ResponseWriter, r *http.Request) {
 // /contacts/archive
 func (app *App) get_archive_handler(w http.ResponseWriter, r *http.Request) {
 
-	err := app.Templates.Render(w, "archive_ui", myArchiver)
+	myArchiver := user_archiver(r)
+	err := app.Templates.Render(w, "archive_ui", myArchiver.Snapshot())
 	if err != nil {
 		http.Error(w, "Error processing archive", http.StatusInternalServerError)
 		log.Error("archive_get_handler: error in app.Templates.Render()", "error", err)
@@ -604,8 +763,9 @@ func (app *App) get_archive_handler(w http.ResponseWriter, r *http.Request) {
 // DELETE /contacts/archive
 func (app *App) delete_archive_handler(w http.ResponseWriter, r *http.Request) {
 
+	myArchiver := user_archiver(r)
 	myArchiver.Reset()
-	err := app.Templates.Render(w, "archive_ui", myArchiver)
+	err := app.Templates.Render(w, "archive_ui", myArchiver.Snapshot())
 	if err != nil {
 		http.Error(w, "Error processing archive", http.StatusInternalServerError)
 		log.Error("archive_delete_handler: error in app.Templates.Render()", "error", err)
@@ -613,299 +773,531 @@ func (app *App) delete_archive_handler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// /contacts/archive/file
-func (app *App) archive_file_handler(w http.ResponseWriter, r *http.Request) {
-
-	w.Header().Set("Content-Disposition", `attachment; filename="contacts.json"`)
+// POST /contacts/archive/cancel
+func (app *App) cancel_archive_handler(w http.ResponseWriter, r *http.Request) {
 
-	// Serve the file
-	http.ServeFile(w, r, "contacts.json")
+	myArchiver := user_archiver(r)
+	myArchiver.Cancel()
+	err := app.Templates.Render(w, "archive_ui", myArchiver.Snapshot())
+	if err != nil {
+		http.Error(w, "Error processing archive", http.StatusInternalServerError)
+		log.Error("cancel_archive_handler: error in app.Templates.Render()", "error", err)
+		return
+	}
 }
 
-//------------------------------------------------------------------------------
-// JSON Api
-//------------------------------------------------------------------------------
+// GET /contacts/archive/events
+// Server-Sent Events: a "progress" event with the rendered progress bar while
+// the archive is being created, then a single "done" event telling the page to
+// fetch the final archive_ui
+func (app *App) archive_events_handler(w http.ResponseWriter, r *http.Request) {
 
-type success_response struct {
-	Message string `json:"message"`
-}
+	myArchiver := user_archiver(r)
 
-type error_response struct {
-	Message string            `json:"message"`
-	Errors  map[string]string `json:"errors"`
+	// The stream outlives the server's WriteTimeout
+	rc := http.NewResponseController(w)
+	err := rc.SetWriteDeadline(time.Time{})
+	if err != nil {
+		log.Error("archive_events_handler: error in rc.SetWriteDeadline", "error", err)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	updates, unsubscribe := myArchiver.Subscribe()
+	defer unsubscribe()
+
+	// Proxies drop connections that stay silent for too long
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		var buf bytes.Buffer
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-keepalive.C:
+			buf.WriteString(": keepalive\n\n")
+
+		case a := <-updates:
+			if a.Status == archiver.StatusRunning {
+				err = app.Templates.Render(&buf, "archive_progress", a)
+				if err != nil {
+					log.Error("archive_events_handler: error in app.Templates.Render()", "error", err)
+					return
+				}
+				write_sse_event(&buf, "progress", buf.String())
+			} else {
+				write_sse_event(&buf, "done", string(a.Status))
+			}
+		}
+
+		_, err = w.Write(buf.Bytes())
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			log.Error("archive_events_handler: error writing event", "error", err)
+			return
+		}
+
+		// Nothing more to report, the page closes its side on "done" too
+		if bytes.HasPrefix(buf.Bytes(), []byte("event: done")) {
+			return
+		}
+	}
 }
 
-// GET /api/v1/contacts
-func get_contacts_handler(w http.ResponseWriter, r *http.Request) {
+// /contacts/archive/file
+func (app *App) archive_file_handler(w http.ResponseWriter, r *http.Request) {
+
+	myArchiver := user_archiver(r)
+	a := myArchiver.Snapshot()
+	if a.Status != archiver.StatusComplete {
+		http.Error(w, "Error, no archive is ready", http.StatusNotFound)
+		log.Error("archive_file_handler: archive not complete", "status", a.Status)
+		return
+	}
 
-	jsonData, err := json.Marshal(contacts)
+	// Cleared between the snapshot and now
+	f, err := os.Open(a.FilePath)
 	if err != nil {
-		http.Error(w, "Error converting contacts into JSON", http.StatusInternalServerError)
-		log.Error("get_contacts_handler: error in json.Marshal(contacts)", "error", err)
+		http.Error(w, "Error, no archive is ready", http.StatusNotFound)
+		log.Error("archive_file_handler: error in os.Open", "error", err)
 		return
 	}
+	defer f.Close()
 
-	w.Header().Set("Content-Type", "application/json")
-	_, err = w.Write(jsonData)
+	stat, err := f.Stat()
 	if err != nil {
-		http.Error(w, "Error writing response", http.StatusInternalServerError)
-		log.Error("get_contacts_handler: error in w.Write(jsonData)", "error", err)
+		http.Error(w, "Error reading archive", http.StatusInternalServerError)
+		log.Error("archive_file_handler: error in f.Stat", "error", err)
 		return
 	}
+
+	// Stream the file
+	w.Header().Set("Content-Type", a.ContentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": a.FileName}))
+	http.ServeContent(w, r, a.FileName, stat.ModTime(), f)
 }
 
-// POST /api/v1/contacts
-func post_contacts_handler(w http.ResponseWriter, r *http.Request) {
+//------------------------------------------------------------------------------
+// JSON Api
+//------------------------------------------------------------------------------
 
-	// Get form values
-	c := Contact{
-		ID:     contacts[len(contacts)-1].ID + 1,
-		First:  r.FormValue("first_name"),
-		Last:   r.FormValue("last_name"),
-		Email:  r.FormValue("email"),
-		Phone:  r.FormValue("phone"),
-		Errors: make(map[string]string),
-	}
+// GET /api/v1/contacts?q={query}&sort={fields}&dir={asc|desc}&page={n}&per_page={n}
+// GET /api/v1/contacts?q={query}&sort={fields}&dir={asc|desc}&cursor={cursor}&limit={n}
+func (app *App) get_contacts_handler(w http.ResponseWriter, r *http.Request) {
 
-	email_error := validate_email(-1, c.Email)
-	if email_error != "" {
-		// We must check this in order to keep the map length to zero when
-		// no errors are found
-		c.Errors["email"] = email_error
-	}
-	if c.First == "" {
-		c.Errors["first"] = "First name is required"
-	}
-	if c.Last == "" {
-		c.Errors["last"] = "Last name is required"
-	}
-	if c.Phone == "" {
-		c.Errors["phone"] = "Phone is required"
+	query, err := parse_query(r.URL.Query().Get("q"))
+	if err != nil {
+		qe, _ := err.(*QueryError)
+		p := problem_invalid_query.problem(qe.Message)
+		p.Errors = map[string]string{"q": qe.Message}
+		p.Position = &qe.Position
+		write_problem(w, r, p)
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
+	order, err := parse_sort(r.URL.Query().Get("sort"), r.URL.Query().Get("dir"), request_language(r))
+	if err != nil {
+		p := problem_invalid_sort.problem(err.Error())
+		p.Errors = map[string]string{"sort": err.Error()}
+		write_problem(w, r, p)
+		return
+	}
 
-	if len(c.Errors) == 0 {
-		contacts = append(contacts, c)
+	// A cursor or a limit pages through by cursor, which stays stable while
+	// contacts are created and deleted. page and per_page number the pages
+	var res any
+	if r.URL.Query().Has("cursor") || r.URL.Query().Has("limit") {
 
-		// Inform about the request's success
-		log.Info("Contact added successfully")
-		s := success_response{
-			"Contact added successfully",
+		limit := parse_limit(r)
+		list := list_fingerprint(r.URL.Query().Get("q"), order)
+		var cur *cursor
+		if s := r.URL.Query().Get("cursor"); s != "" {
+			c, err := decode_cursor(s, list)
+			if err != nil {
+				p := problem_invalid_cursor.problem(err.Error())
+				p.Errors = map[string]string{"cursor": err.Error()}
+				write_problem(w, r, p)
+				return
+			}
+			cur = &c
 		}
-		json_success_response, _ := json.Marshal(s)
-		_, err := w.Write(json_success_response)
+
+		page, err := app.cursor_contact_list(query, order, list, cur, limit)
 		if err != nil {
-			http.Error(w, "Could not show error on screen", http.StatusInternalServerError)
-			log.Error("post_contacts_handler: error in w.Write(json_success_response)", "error", err)
+			write_problem(w, r, problem_internal.problem("Error loading contacts"))
+			log.Error("get_contacts_handler: error in app.cursor_contact_list", "error", err)
 			return
 		}
-		return
+		res = contact_cursor_response{page.Contacts, page.Total, limit, cursor_links(r.URL, page, limit)}
 
 	} else {
 
-		// Inform about the response's failure
-		e := error_response{
-			"Could not add contact due to incorrect format",
-			c.Errors,
-		}
-
-		json_error_response, _ := json.Marshal(e)
-		w.WriteHeader(http.StatusBadRequest)
-		_, err := w.Write(json_error_response)
+		page, per_page := parse_page(r)
+		contacts, total, err := app.search_contact_list(query, order, page, per_page)
 		if err != nil {
-			http.Error(w, "Could not show error on screen", http.StatusBadRequest)
-			log.Error("post_contacts_handler: error in w.Write(json_error_response)", "error", err)
+			write_problem(w, r, problem_internal.problem("Error loading contacts"))
+			log.Error("get_contacts_handler: error in app.search_contact_list", "error", err)
 			return
 		}
+		// An empty list rather than null
+		if contacts == nil {
+			contacts = []Contact{}
+		}
 
-		log.Error("post_contacts_handler: wrong contact format: ", "errors", json_error_response)
+		pages := page_count(total, per_page)
+		res = contact_page_response{contacts, total, page, per_page, pages, page_links(r.URL, page, pages)}
 	}
 
+	write_json(w, r, http.StatusOK, res)
 }
 
-// /GET /api/v1/contacts/{id}
-func get_contact_handler(w http.ResponseWriter, r *http.Request) {
-
-	id_string := r.PathValue("id")
+// POST /api/v1/contacts
+// 201 with the stored contact and its URL in Location, 422 with the errors by
+// field when it is not valid, 409 when another contact has the email
+func (app *App) post_contacts_handler(w http.ResponseWriter, r *http.Request) {
 
-	// Parse id
-	id_int, err := strconv.Atoi(id_string)
+	// The store assigns the id
+	c, err := read_contact_body(w, r)
 	if err != nil {
-		http.Error(w, "Error, id must be an integer", http.StatusBadRequest)
-		log.Error("get_contact_handler: error in strconv.Atoi(id)", "error", err)
+		write_body_error(w, r, err)
+		log.Error("post_contacts_handler: error in read_contact_body", "error", err)
 		return
 	}
+	c.Errors = make(map[string]string)
 
-	// Search for specific contact
-	c, err := find_contact(id_int)
-	if err != nil {
-		http.Error(w, "Error, contact not found", http.StatusBadRequest)
-		log.Error("get_contact_handler: error in find_contact", "error", err)
+	validate_contact(&c, app.validate_email(-1, c.Email))
+	if len(c.Errors) > 0 {
+		write_problem(w, r, contact_problem("Could not add contact due to incorrect format", c.Errors))
+		log.Error("post_contacts_handler: wrong contact format", "errors", c.Errors)
 		return
 	}
 
-	// Show contact information
-	w.Header().Set("Content-Type", "application/json")
-
-	jsonData, _ := json.Marshal(c)
-	w.WriteHeader(http.StatusCreated)
-	_, err = w.Write(jsonData)
+	created, err := app.Store.Create(c)
+	if errors.Is(err, ErrEmailTaken) {
+		// Taken by a concurrent request after validate_email checked it
+		c.Errors["email"] = email_taken_message
+		write_problem(w, r, contact_problem("Could not add contact due to incorrect format", c.Errors))
+		log.Error("post_contacts_handler: error in app.Store.Create", "error", err)
+		return
+	}
 	if err != nil {
-		http.Error(w, "Error showing contact information", http.StatusInternalServerError)
-		log.Error("get_contact_handler: error in w.Write(jsonData)", "error", err)
+		write_problem(w, r, problem_internal.problem("Error, could not save contact"))
+		log.Error("post_contacts_handler: error in app.Store.Create", "error", err)
 		return
 	}
+
+	log.Info("Contact added successfully", "id", created.ID)
+	w.Header().Set("Location", "/api/v1/contacts/"+strconv.Itoa(created.ID))
+	w.Header().Set("ETag", contact_etag(created))
+	write_json(w, r, http.StatusCreated, created)
 }
 
-// PUT /api/v1/contacts
-func put_contact_handler(w http.ResponseWriter, r *http.Request) {
+// GET /api/v1/contacts/{id}
+// The ETag is the contact's version, see etag.go
+func (app *App) get_contact_handler(w http.ResponseWriter, r *http.Request) {
 
-	id_string := r.PathValue("id")
-	// Parse id
-	id_int, err := strconv.Atoi(id_string)
+	id_int, ok := api_contact_id(w, r)
+	if !ok {
+		return
+	}
+
+	// Search for specific contact
+	c, err := app.Store.Get(id_int)
+	if errors.Is(err, ErrNotFound) {
+		write_problem(w, r, problem_not_found.problem("No contact has id "+strconv.Itoa(id_int)))
+		return
+	}
 	if err != nil {
-		http.Error(w, "Error, id must be an integer", http.StatusBadRequest)
-		log.Error("put_contact_handler: error in strconv.Atoi(id)", "error", err)
+		write_problem(w, r, problem_internal.problem("Error loading contact"))
+		log.Error("get_contact_handler: error in app.Store.Get", "error", err)
 		return
 	}
 
-	// Get form values
-	c := Contact{
-		ID:     id_int,
-		First:  r.FormValue("first_name"),
-		Last:   r.FormValue("last_name"),
-		Email:  r.FormValue("email"),
-		Phone:  r.FormValue("phone"),
-		Errors: make(map[string]string),
+	w.Header().Set("ETag", contact_etag(c))
+	write_json(w, r, http.StatusOK, c)
+}
+
+// PUT /api/v1/contacts/{id}
+// 200 with the stored contact, 404 when there is none with id, 422 and 409
+// like POST, 412 when If-Match does not name the stored version. Every field
+// is replaced, see PATCH for changing only some
+func (app *App) put_contact_handler(w http.ResponseWriter, r *http.Request) {
+
+	id_int, ok := api_contact_id(w, r)
+	if !ok {
+		return
 	}
 
-	email_error := validate_email(-1, c.Email)
-	if email_error != "" {
-		c.Errors["email"] = email_error
+	c, err := read_contact_body(w, r)
+	if err != nil {
+		write_body_error(w, r, err)
+		log.Error("put_contact_handler: error in read_contact_body", "error", err)
+		return
 	}
-	if c.First == "" {
-		c.Errors["first"] = "First name is required"
+	c.ID = id_int
+
+	// A missing contact is reported as such, rather than its fields
+	stored, err := app.Store.Get(id_int)
+	if errors.Is(err, ErrNotFound) {
+		write_problem(w, r, problem_not_found.problem("No contact has id "+strconv.Itoa(id_int)))
+		return
 	}
-	if c.Last == "" {
-		c.Errors["last"] = "Last name is required"
+	if err != nil {
+		write_problem(w, r, problem_internal.problem("Error loading contact"))
+		log.Error("put_contact_handler: error in app.Store.Get", "error", err)
+		return
 	}
-	if c.Phone == "" {
-		c.Errors["phone"] = "Phone is required"
+	c.Version, ok = if_match_version(w, r, stored)
+	if !ok {
+		log.Error("put_contact_handler: If-Match does not match", "id", id_int, "version", stored.Version)
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
+	app.api_update_contact(w, r, c)
+}
 
-	if len(c.Errors) == 0 {
-		// Search for c to edit
-		contact, err := find_contact(id_int)
-		if err != nil {
-			http.Error(w, "Error, contact not found", http.StatusBadRequest)
-			log.Error("put_contact_handler: error in find_contact", "error", err)
-			return
-		}
+// PATCH /api/v1/contacts/{id}
+// The body is a JSON Merge Patch (RFC 7396) or a JSON Patch (RFC 6902) of the
+// contact's first, last, email and phone. Answers like PUT, 409 when a test
+// of a JSON Patch fails and 422 when it cannot be applied
+func (app *App) patch_contact_handler(w http.ResponseWriter, r *http.Request) {
 
-		// Replace with editted data
-		contact.Email = c.Email
-		contact.First = c.First
-		contact.Last = c.Last
-		contact.Phone = c.Phone
-		contact.Errors = c.Errors
+	id_int, ok := api_contact_id(w, r)
+	if !ok {
+		return
+	}
 
-		// Inform about the request's success
-		log.Info("Contact edited successfully")
+	c, err := app.Store.Get(id_int)
+	if errors.Is(err, ErrNotFound) {
+		write_problem(w, r, problem_not_found.problem("No contact has id "+strconv.Itoa(id_int)))
+		return
+	}
+	if err != nil {
+		write_problem(w, r, problem_internal.problem("Error loading contact"))
+		log.Error("patch_contact_handler: error in app.Store.Get", "error", err)
+		return
+	}
+	version, ok := if_match_version(w, r, c)
+	if !ok {
+		log.Error("patch_contact_handler: If-Match does not match", "id", id_int, "version", c.Version)
+		return
+	}
 
-		s := success_response{
-			"Contact edited successfully",
-		}
-		json_success_response, _ := json.Marshal(s)
-		w.WriteHeader(http.StatusBadRequest)
-		_, err = w.Write(json_success_response)
-		if err != nil {
-			http.Error(w, "Could not show error on screen", http.StatusInternalServerError)
-			log.Error("put_contacts_handler: error in w.Write(json_success_response)", "error", err)
-			return
+	c, err = read_contact_patch(w, r, c)
+	var pe *patch_error
+	var be *body_error
+	if errors.As(err, &pe) {
+		write_problem(w, r, pe.Type.problem(pe.Message))
+		log.Error("patch_contact_handler: error in read_contact_patch", "error", err)
+		return
+	}
+	if err != nil {
+		if errors.As(err, &be) && be.Type == problem_media_type {
+			w.Header().Set("Accept-Patch", accept_patch)
 		}
+		write_body_error(w, r, err)
+		log.Error("patch_contact_handler: error in read_contact_patch", "error", err)
 		return
+	}
+	c.Version = version
 
-	} else {
+	app.api_update_contact(w, r, c)
+}
 
-		// Inform about the response's failure
-		e := error_response{
-			"Could not edit contact due to incorrect format",
-			c.Errors,
-		}
+// Validate c and store it over the contact with its id, answering with the
+// stored contact or what kept it from being stored. For PUT and PATCH
+func (app *App) api_update_contact(w http.ResponseWriter, r *http.Request, c Contact) {
 
-		json_error_response, _ := json.Marshal(e)
-		w.WriteHeader(http.StatusBadRequest)
-		_, err := w.Write(json_error_response)
-		if err != nil {
-			http.Error(w, "Could not show error on screen", http.StatusBadRequest)
-			log.Error("put_contact_handler: error in w.Write(json_error_response)", "error", err)
-			return
-		}
+	c.Errors = make(map[string]string)
+	validate_contact(&c, app.validate_email(c.ID, c.Email))
+	if len(c.Errors) > 0 {
+		write_problem(w, r, contact_problem("Could not edit contact due to incorrect format", c.Errors))
+		log.Error("api_update_contact: wrong contact format", "errors", c.Errors)
+		return
+	}
 
-		log.Error("put_contact_handler: wrong contact format: ", "errors", json_error_response)
+	// Replace with editted data
+	updated, err := app.Store.Update(c)
+	if errors.Is(err, ErrEmailTaken) {
+		// Taken by a concurrent request after validate_email checked it
+		c.Errors["email"] = email_taken_message
+		write_problem(w, r, contact_problem("Could not edit contact due to incorrect format", c.Errors))
+		log.Error("api_update_contact: error in app.Store.Update", "error", err)
+		return
+	}
+	if errors.Is(err, ErrNotFound) {
+		// Deleted since it was looked up
+		write_problem(w, r, problem_not_found.problem("No contact has id "+strconv.Itoa(c.ID)))
+		return
+	}
+	if errors.Is(err, ErrVersionChanged) {
+		// Changed since If-Match was checked
+		write_version_changed(w, r, c.ID)
+		log.Error("api_update_contact: error in app.Store.Update", "error", err)
+		return
+	}
+	if err != nil {
+		write_problem(w, r, problem_internal.problem("Error, could not save contact"))
+		log.Error("api_update_contact: error in app.Store.Update", "error", err)
+		return
 	}
+
+	log.Info("Contact edited successfully", "id", updated.ID)
+	w.Header().Set("ETag", contact_etag(updated))
+	write_json(w, r, http.StatusOK, updated)
 }
 
 // DELETE /api/v1/contacts/{id}
-func delete_contact_handler(w http.ResponseWriter, r *http.Request) {
+// 204, or 404 when there is no contact with id, 412 when If-Match does not
+// name the stored version
+func (app *App) api_delete_contact_handler(w http.ResponseWriter, r *http.Request) {
 
-	id_string := r.PathValue("id")
-	// Parse id
-	id_int, err := strconv.Atoi(id_string)
-	if err != nil {
-		http.Error(w, "Error, id must be an integer", http.StatusBadRequest)
-		log.Error("delete_contact_handler: error in strconv.Atoi(id)", "error", err)
+	id_int, ok := api_contact_id(w, r)
+	if !ok {
 		return
 	}
 
-	// Delete contact
-	for i, c := range contacts {
-		if c.ID == id_int {
-			// Remove the contact at index i
-			contacts = append(contacts[:i], contacts[i+1:]...)
+	c, err := app.Store.Get(id_int)
+	if errors.Is(err, ErrNotFound) {
+		write_problem(w, r, problem_not_found.problem("No contact has id "+strconv.Itoa(id_int)))
+		return
+	}
+	if err != nil {
+		write_problem(w, r, problem_internal.problem("Error loading contact"))
+		log.Error("api_delete_contact_handler: error in app.Store.Get", "error", err)
+		return
+	}
+	version, ok := if_match_version(w, r, c)
+	if !ok {
+		log.Error("api_delete_contact_handler: If-Match does not match", "id", id_int, "version", c.Version)
+		return
+	}
 
-			// Inform the user of the request's success
-			log.Info("Contact deleted succesfully")
-			s := success_response{
-				"Contact deleted succesfully",
-			}
-			json_success_response, _ := json.Marshal(s)
-			w.WriteHeader(http.StatusBadRequest)
-			_, err := w.Write(json_success_response)
-			if err != nil {
-				http.Error(w, "Could not show error on screen", http.StatusBadRequest)
-				log.Error("delete_contact_handler: error in w.Write(json_success_response)", "error", err)
-				return
-			}
-			return
-		}
+	// Delete contact, as long as it is still at the version If-Match named
+	_, err = app.Store.Apply([]StoreOp{{Kind: OpDelete, Contact: Contact{ID: id_int, Version: version}}})
+	if errors.Is(err, ErrNotFound) {
+		write_problem(w, r, problem_not_found.problem("No contact has id "+strconv.Itoa(id_int)))
+		return
+	}
+	if errors.Is(err, ErrVersionChanged) {
+		write_version_changed(w, r, id_int)
+		log.Error("api_delete_contact_handler: error in app.Store.Apply", "error", err)
+		return
+	}
+	if err != nil {
+		write_problem(w, r, problem_internal.problem("Error deleting contact"))
+		log.Error("api_delete_contact_handler: error in app.Store.Apply", "error", err)
+		return
 	}
 
-	// Inform about the response's failure
-	e := error_response{
-		"Could not delete contact",
-		nil,
+	log.Info("Contact deleted succesfully", "id", id_int)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// The {id} of an API request. An id that is not a number names no contact,
+// so it is answered with a 404 and ok is false
+func api_contact_id(w http.ResponseWriter, r *http.Request) (int, bool) {
+
+	id_int, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		p := problem_not_found.problem("No contact has id " + strconv.Quote(r.PathValue("id")))
+		p.Errors = map[string]string{"id": "id must be an integer"}
+		write_problem(w, r, p)
+		return 0, false
 	}
+	return id_int, true
+}
+
+// Answer with v as JSON. A successful GET gets an ETag, the one the handler
+// set or else one of the body, and a 304 when If-None-Match names it
+func write_json(w http.ResponseWriter, r *http.Request, status int, v any) {
 
-	json_error_response, _ := json.Marshal(e)
-	w.WriteHeader(http.StatusBadRequest)
-	_, err = w.Write(json_error_response)
+	jsonData, err := json.Marshal(v)
 	if err != nil {
-		http.Error(w, "Could not show error on screen", http.StatusInternalServerError)
-		log.Error("delete_contact_handler: error in w.Write(jsonData)", "error", err)
+		write_problem(w, r, problem_internal.problem("Error converting response into JSON"))
+		log.Error("write_json: error in json.Marshal(v)", "error", err)
 		return
 	}
-
-	http.Error(w, "Error deleting contact", http.StatusInternalServerError)
-	log.Error("delete_contact: contact not found")
+	if r.Method == http.MethodGet && status == http.StatusOK {
+		etag := w.Header().Get("ETag")
+		if etag == "" {
+			etag = body_etag(jsonData)
+			w.Header().Set("ETag", etag)
+		}
+		if not_modified(w, r, etag) {
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(jsonData)
+	if err != nil {
+		log.Error("write_json: error in w.Write(jsonData)", "error", err)
+	}
 }
 
 // -----------------------------------------------------------------------------
 // AUXILIARY FUNCTIONS
 
+// Replace the contents of buf with an SSE event, every line of data goes in
+// its own data field
+func write_sse_event(buf *bytes.Buffer, event string, data string) {
+
+	lines := strings.Split(strings.TrimSpace(data), "\n")
+	buf.Reset()
+	buf.WriteString("event: " + event + "\n")
+	for _, l := range lines {
+		buf.WriteString("data: " + l + "\n")
+	}
+	buf.WriteString("\n")
+}
+
+const session_cookie = "session_id"
+
+type session_key struct{}
+
+// Identify each browser with a cookie, so every visitor gets their own archiver
+func sessions(f http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var id string
+		cookie, err := r.Cookie(session_cookie)
+		if err == nil && uuid.Validate(cookie.Value) == nil {
+			id = cookie.Value
+		} else {
+			id = uuid.NewString()
+			http.SetCookie(w, &http.Cookie{
+				Name:     session_cookie,
+				Value:    id,
+				Path:     "/",
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+
+		ctx := context.WithValue(r.Context(), session_key{}, id)
+		f.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func user_archiver(r *http.Request) *archiver.Archiver {
+	id, _ := r.Context().Value(session_key{}).(string)
+	return archiver.GetArchiverForUser(id)
+}
+
+type request_id_key struct{}
+
+// The id logging gave r, empty when it did not see it
+func request_id(r *http.Request) string {
+	id, _ := r.Context().Value(request_id_key{}).(string)
+	return id
+}
+
 func logging(f http.Handler) http.Handler {
 
 	return (http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -917,59 +1309,84 @@ func logging(f http.Handler) http.Handler {
 			"remoteAddress", r.RemoteAddr)
 
 		ctx := context.WithValue(r.Context(), "log", log)
+		ctx = context.WithValue(ctx, request_id_key{}, id)
 		r = r.WithContext(ctx)
 		// Calls actual handler
 		f.ServeHTTP(w, r)
 	}))
 }
 
-func load_contacts() error {
+// A page of every contact, and how many there are
+func (app *App) get_contact_list(page, per_page int) ([]Contact, int, error) {
 
-	var err error
-	contacts_data, err = os.ReadFile("contacts.json")
+	p := page - 1
+	cs, err := app.Store.List(p*per_page, per_page)
 	if err != nil {
-		return fmt.Errorf("load_contacts: error in osReadFile: %w", err)
+		return nil, 0, err
 	}
-
-	err = json.Unmarshal(contacts_data, &contacts)
+	total, err := app.Store.Count()
 	if err != nil {
-		return fmt.Errorf("load_contacts: error in json.Unmarhsall: %w", err)
+		return nil, 0, err
 	}
-
-	return nil
+	return cs, total, nil
 }
 
-func find_contact(id int) (*Contact, error) {
+// A page of the contacts query matches, and how many it matches
+func (app *App) search_contact_list(query *Query, order *SortOrder, page, per_page int) ([]Contact, int, error) {
 
-	for i := range contacts {
-		if contacts[i].ID == id {
-			return &contacts[i], nil
-		}
-	}
-	return nil, fmt.Errorf("find_contact: error, contact not found")
+	p := page - 1
+	return app.Store.Search(query, order, p*per_page, per_page)
 }
 
-func get_contact_list(page int) []Contact {
+func (app *App) validate_email(id int, email string) string {
 
-	p := page - 1
-	limit := p*10 + 10
-	var contact_set []Contact
-	for i := p * 10; i < limit && i < len(contacts); i++ {
-		contact_set = append(contact_set, contacts[i])
+	if email == "" {
+		return check_email(email, nil)
 	}
-
-	return contact_set
+	other, err := app.Store.FindByEmail(email)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		log.Error("validate_email: error in app.Store.FindByEmail", "error", err)
+		return "Email could not be validated"
+	}
+	return check_email(email, func(email string) bool {
+		return err == nil && other.ID != id
+	})
 }
 
-func validate_email(id int, email string) string {
+const email_taken_message = "Email must be unique"
+
+// taken reports whether some other contact already uses email
+func check_email(email string, taken func(email string) bool) string {
 
 	if email == "" {
 		return "Email is empty"
 	}
-	for _, c := range contacts {
-		if c.ID != id && c.Email == email {
-			return "Email must be unique"
-		}
+	if taken(email) {
+		return email_taken_message
 	}
 	return ""
 }
+
+// The checks every contact goes through before it is stored, problems end up
+// in c.Errors by field. email_error is what validate_email (or check_email)
+// said about c.Email
+func validate_contact(c *Contact, email_error string) {
+
+	if c.Errors == nil {
+		c.Errors = make(map[string]string)
+	}
+	if email_error != "" {
+		// We must check this in order to keep the map length to zero when
+		// no errors are found
+		c.Errors["email"] = email_error
+	}
+	if c.First == "" {
+		c.Errors["first"] = "First name is required"
+	}
+	if c.Last == "" {
+		c.Errors["last"] = "Last name is required"
+	}
+	if c.Phone == "" {
+		c.Errors["phone"] = "Phone is required"
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// Contacts per page when per_page is not given, and the most it can ask for
+const (
+	default_per_page = 10
+	max_per_page     = 100
+)
+
+// How many page links are shown on either side of the current page
+const page_window = 2
+
+// How the contact list moves between pages: with page links, or by loading
+// the next page as the end of the list scrolls into view
+const (
+	list_pages  = "pages"
+	list_scroll = "scroll"
+)
+
+const list_mode_cookie = "list_mode"
+
+// The list mode the user picked. A mode parameter changes it, and is kept in
+// a cookie for the next lists. Call it before writing the body
+func list_mode(w http.ResponseWriter, r *http.Request) string {
+
+	mode := r.URL.Query().Get("mode")
+	if mode == list_pages || mode == list_scroll {
+		http.SetCookie(w, &http.Cookie{
+			Name:     list_mode_cookie,
+			Value:    mode,
+			Path:     "/",
+			MaxAge:   365 * 24 * 60 * 60,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+		return mode
+	}
+	cookie, err := r.Cookie(list_mode_cookie)
+	if err == nil && cookie.Value == list_scroll {
+		return list_scroll
+	}
+	return list_pages
+}
+
+// The page and per_page parameters of r. A missing or invalid page is the
+// first one, per_page is kept between 1 and max_per_page
+func parse_page(r *http.Request) (int, int) {
+
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page <= 0 {
+		page = 1
+	}
+	per_page, err := strconv.Atoi(r.URL.Query().Get("per_page"))
+	if err != nil || per_page <= 0 {
+		per_page = default_per_page
+	}
+	return page, min(per_page, max_per_page)
+}
+
+// The number of pages, an empty list still has one
+func page_count(total, per_page int) int {
+	return max(1, (total+per_page-1)/per_page)
+}
+
+func (d PageData) Pages() int {
+	return page_count(d.Total, d.PerPage)
+}
+
+// The positions of the first and last contact on the page, counting from 1
+func (d PageData) From() int {
+	return min((d.Page-1)*d.PerPage+1, d.Total)
+}
+
+func (d PageData) To() int {
+	return min(d.Page*d.PerPage, d.Total)
+}
+
+// The /contacts URL of page, with the same search, order and page size
+func (d PageData) PageURL(page int) string {
+
+	v := d.list_params()
+	v.Set("page", strconv.Itoa(page))
+	return "/contacts?" + v.Encode()
+}
+
+// The /contacts URL of the current page in another list mode
+func (d PageData) ModeURL(mode string) string {
+
+	v := d.list_params()
+	v.Set("page", strconv.Itoa(d.Page))
+	v.Set("mode", mode)
+	return "/contacts?" + v.Encode()
+}
+
+func (d PageData) list_params() url.Values {
+
+	v := url.Values{}
+	if d.Query != "" {
+		v.Set("q", d.Query)
+	}
+	d.Sort.set_params(v)
+	if d.PerPage != default_per_page {
+		v.Set("per_page", strconv.Itoa(d.PerPage))
+	}
+	return v
+}
+
+// A numbered link of the pagination, or a gap between them when Number is 0
+type PageLink struct {
+	Number  int
+	URL     string
+	Current bool
+}
+
+// Links to the pages around the current one, with gaps where pages are left
+// out before the first or after the last
+func (d PageData) PageLinks() []PageLink {
+
+	pages := d.Pages()
+	from := max(1, d.Page-page_window)
+	to := min(pages, d.Page+page_window)
+
+	var links []PageLink
+	if from > 1 {
+		links = append(links, PageLink{})
+	}
+	for n := from; n <= to; n++ {
+		links = append(links, PageLink{n, d.PageURL(n), n == d.Page})
+	}
+	if to < pages {
+		links = append(links, PageLink{})
+	}
+	return links
+}
+
+// The page sizes offered next to the pagination
+func (d PageData) PerPageOptions() []int {
+	return []int{10, 25, 50, 100}
+}
+
+// A sortable column header of the contact table
+type SortColumn struct {
+	Field string
+	Label string
+	// Sorts by the column, the other way round when the list already is
+	URL string
+	// asc or desc when the list is sorted by the column
+	Dir string
+}
+
+func (d PageData) Column(field, label string) SortColumn {
+
+	col := SortColumn{Field: field, Label: label}
+	next := "asc"
+	if d.Sort.Field() == field {
+		col.Dir = d.Sort.Dir()
+		if col.Dir == "asc" {
+			next = "desc"
+		}
+	}
+	v := d.list_params()
+	v.Set("sort", field)
+	v.Set("dir", next)
+	col.URL = "/contacts?" + v.Encode()
+	return col
+}
+
+//------------------------------------------------------------------------------
+// JSON API
+//------------------------------------------------------------------------------
+
+// A page of the contact list in the JSON API
+type contact_page_response struct {
+	Data    []Contact           `json:"data"`
+	Total   int                 `json:"total"`
+	Page    int                 `json:"page"`
+	PerPage int                 `json:"per_page"`
+	Pages   int                 `json:"pages"`
+	Links   page_links_response `json:"links"`
+}
+
+// Prev and Next are left out on the first and last page
+type page_links_response struct {
+	Self  string `json:"self"`
+	First string `json:"first"`
+	Last  string `json:"last"`
+	Prev  string `json:"prev,omitempty"`
+	Next  string `json:"next,omitempty"`
+}
+
+// Links to the pages of the list at u, keeping its other parameters
+func page_links(u *url.URL, page, pages int) page_links_response {
+
+	link := func(n int) string {
+		v := u.Query()
+		v.Set("page", strconv.Itoa(n))
+		return u.Path + "?" + v.Encode()
+	}
+	links := page_links_response{Self: link(page), First: link(1), Last: link(pages)}
+	if page > 1 {
+		links.Prev = link(min(page-1, pages))
+	}
+	if page < pages {
+		links.Next = link(page + 1)
+	}
+	return links
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// PATCH /api/v1/contacts/{id} changes some fields of a contact without
+// sending the others. The patch is applied to the contact as a JSON document
+// of the fields clients can send (see contact_body), and the result goes
+// through the same validation as a PUT
+
+const (
+	merge_patch_type = "application/merge-patch+json"
+	json_patch_type  = "application/json-patch+json"
+)
+
+// The patch types PATCH takes, for the Accept-Patch header
+const accept_patch = merge_patch_type + ", " + json_patch_type
+
+// Why a patch could not be applied, Type is the problem the API answers with
+type patch_error struct {
+	Type    problem_type
+	Message string
+}
+
+func (e *patch_error) Error() string {
+	return e.Message
+}
+
+// Apply the patch in r's body to c, errors are a *body_error when the body
+// could not be read and a *patch_error when it could not be applied
+func read_contact_patch(w http.ResponseWriter, r *http.Request, c Contact) (Contact, error) {
+
+	r.Body = http.MaxBytesReader(w, r.Body, contact_body_max_size)
+
+	media_type, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || (media_type != merge_patch_type && media_type != json_patch_type) {
+		return Contact{}, &body_error{problem_media_type, "PATCH takes " + accept_patch}
+	}
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		var max_err *http.MaxBytesError
+		if errors.As(err, &max_err) {
+			return Contact{}, &body_error{problem_body_too_large, fmt.Sprintf("Body is larger than %d bytes", max_err.Limit)}
+		}
+		return Contact{}, &body_error{problem_invalid_body, "Could not read the body"}
+	}
+
+	var doc any = map[string]any{"first": c.First, "last": c.Last, "email": c.Email, "phone": c.Phone}
+	if media_type == merge_patch_type {
+		var patch any
+		err = json.Unmarshal(data, &patch)
+		if err != nil {
+			return Contact{}, &body_error{problem_invalid_body, "Body is not valid JSON"}
+		}
+		doc = merge_patch(doc, patch)
+	} else {
+		// RFC 6902 section 4: members an operation does not define are ignored
+		var ops []json_patch_op
+		err = json.Unmarshal(data, &ops)
+		if err != nil {
+			return Contact{}, &body_error{problem_invalid_body, "Body is not a valid list of JSON Patch operations"}
+		}
+		doc, err = json_patch(doc, ops)
+		if err != nil {
+			return Contact{}, err
+		}
+	}
+
+	// The result must still be a contact
+	m, ok := doc.(map[string]any)
+	if !ok {
+		return Contact{}, &patch_error{problem_invalid_patch, "The patched contact is not an object"}
+	}
+	patched := Contact{ID: c.ID}
+	fields := map[string]*string{"first": &patched.First, "last": &patched.Last, "email": &patched.Email, "phone": &patched.Phone}
+	for k, v := range m {
+		f, ok := fields[k]
+		if !ok {
+			return Contact{}, &patch_error{problem_invalid_patch, fmt.Sprintf("Contacts have no field %q", k)}
+		}
+		s, ok := v.(string)
+		if !ok {
+			return Contact{}, &patch_error{problem_invalid_patch, fmt.Sprintf("Field %s must be a string", k)}
+		}
+		*f = s
+	}
+	return patched, nil
+}
+
+// RFC 7396: members of patch replace those of target, null ones remove them,
+// objects are merged recursively. A patch that is not an object replaces target
+func merge_patch(target, patch any) any {
+
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]any)
+	if !ok {
+		t = make(map[string]any)
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = merge_patch(t[k], v)
+		}
+	}
+	return t
+}
+
+// An operation of an RFC 6902 JSON Patch. Value is empty when it is missing,
+// which is not the same as null
+type json_patch_op struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// RFC 6902: apply ops to doc in order, all of them or none
+func json_patch(doc any, ops []json_patch_op) (any, error) {
+
+	for i, op := range ops {
+		var err error
+		doc, err = op.apply(doc)
+		if err != nil {
+			var pe *patch_error
+			if errors.As(err, &pe) {
+				pe.Message = fmt.Sprintf("Operation %d (%s %s): %s", i, op.Op, op.Path, pe.Message)
+				return nil, pe
+			}
+			return nil, &patch_error{problem_invalid_patch, fmt.Sprintf("Operation %d (%s %s): %s", i, op.Op, op.Path, err.Error())}
+		}
+	}
+	return doc, nil
+}
+
+func (op json_patch_op) apply(doc any) (any, error) {
+
+	path, err := parse_pointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var value any
+	switch op.Op {
+	case "add", "replace", "test":
+		if len(op.Value) == 0 {
+			return nil, errors.New("value is missing")
+		}
+		err = json.Unmarshal(op.Value, &value)
+		if err != nil {
+			return nil, errors.New("value is not valid JSON")
+		}
+	}
+
+	switch op.Op {
+	case "add":
+		return pointer_add(doc, path, value)
+	case "remove":
+		doc, _, err = pointer_remove(doc, path)
+		return doc, err
+	case "replace":
+		_, err = pointer_get(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if len(path) == 0 {
+			return value, nil
+		}
+		doc, _, err = pointer_remove(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		return pointer_add(doc, path, value)
+	case "move", "copy":
+		from, err := parse_pointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "move" {
+			if strings.HasPrefix(op.Path, op.From+"/") {
+				return nil, errors.New("cannot move a value into itself")
+			}
+			doc, value, err = pointer_remove(doc, from)
+		} else {
+			value, err = pointer_get(doc, from)
+			value = copy_json(value)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return pointer_add(doc, path, value)
+	case "test":
+		got, err := pointer_get(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(got, value) {
+			return nil, &patch_error{problem_patch_conflict, "value is not the one tested for"}
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("unknown op %q", op.Op)
+}
+
+// The reference tokens of an RFC 6901 JSON Pointer, none for the whole
+// document
+func parse_pointer(p string) ([]string, error) {
+
+	if p == "" {
+		return nil, nil
+	}
+	if p[0] != '/' {
+		return nil, fmt.Errorf("%q is not a JSON pointer", p)
+	}
+	tokens := strings.Split(p[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// The position token names in an array of length n. With end, "-" and n
+// itself name the position after the last element
+func array_index(token string, n int, end bool) (int, error) {
+
+	if end && token == "-" {
+		return n, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("%q is not an array index", token)
+	}
+	if i > n || (i == n && !end) {
+		return 0, fmt.Errorf("index %d is out of range", i)
+	}
+	return i, nil
+}
+
+func pointer_get(doc any, path []string) (any, error) {
+
+	for _, token := range path {
+		switch d := doc.(type) {
+		case map[string]any:
+			v, ok := d[token]
+			if !ok {
+				return nil, fmt.Errorf("there is no member %q", token)
+			}
+			doc = v
+		case []any:
+			i, err := array_index(token, len(d), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = d[i]
+		default:
+			return nil, fmt.Errorf("%q is not in an object or array", token)
+		}
+	}
+	return doc, nil
+}
+
+// doc with value added at path, arrays make room for it
+func pointer_add(doc any, path []string, value any) (any, error) {
+
+	if len(path) == 0 {
+		return value, nil
+	}
+	token, rest := path[0], path[1:]
+	switch d := doc.(type) {
+	case map[string]any:
+		if len(rest) == 0 {
+			d[token] = value
+			return d, nil
+		}
+		child, ok := d[token]
+		if !ok {
+			return nil, fmt.Errorf("there is no member %q", token)
+		}
+		child, err := pointer_add(child, rest, value)
+		if err != nil {
+			return nil, err
+		}
+		d[token] = child
+		return d, nil
+	case []any:
+		i, err := array_index(token, len(d), len(rest) == 0)
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) == 0 {
+			return append(d[:i], append([]any{value}, d[i:]...)...), nil
+		}
+		d[i], err = pointer_add(d[i], rest, value)
+		if err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+	return nil, fmt.Errorf("%q is not in an object or array", token)
+}
+
+// doc without the value at path, and that value
+func pointer_remove(doc any, path []string) (any, any, error) {
+
+	if len(path) == 0 {
+		return nil, nil, errors.New("cannot remove the whole contact")
+	}
+	token, rest := path[0], path[1:]
+	switch d := doc.(type) {
+	case map[string]any:
+		child, ok := d[token]
+		if !ok {
+			return nil, nil, fmt.Errorf("there is no member %q", token)
+		}
+		if len(rest) == 0 {
+			delete(d, token)
+			return d, child, nil
+		}
+		child, removed, err := pointer_remove(child, rest)
+		if err != nil {
+			return nil, nil, err
+		}
+		d[token] = child
+		return d, removed, nil
+	case []any:
+		i, err := array_index(token, len(d), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(rest) == 0 {
+			removed := d[i]
+			return append(d[:i], d[i+1:]...), removed, nil
+		}
+		child, removed, err := pointer_remove(d[i], rest)
+		if err != nil {
+			return nil, nil, err
+		}
+		d[i] = child
+		return d, removed, nil
+	}
+	return nil, nil, fmt.Errorf("%q is not in an object or array", token)
+}
+
+// A copy of v sharing no maps or slices with it
+func copy_json(v any) any {
+
+	switch v := v.(type) {
+	case map[string]any:
+		c := make(map[string]any, len(v))
+		for k, e := range v {
+			c[k] = copy_json(e)
+		}
+		return c
+	case []any:
+		c := make([]any, len(v))
+		for i, e := range v {
+			c[i] = copy_json(e)
+		}
+		return c
+	}
+	return v
+}
@@ -0,0 +1,590 @@
+package main
+
+import "strings"
+
+// Double Metaphone (Lawrence Philips), which encodes a word by how it sounds so
+// "Carsen" and "Carson" or "Smith" and "Schmidt" get the same code. Words that
+// can be pronounced two ways get a primary and an alternate code
+
+const metaphone_length = 4
+
+type metaphone struct {
+	// Uppercase, accents already folded away
+	value              []rune
+	primary, alternate []rune
+	slavo_germanic     bool
+}
+
+// The primary and alternate codes of word, equal when there is only one way to
+// say it. Empty for words without letters
+func double_metaphone(word string) (string, string) {
+
+	m := metaphone{value: []rune(strings.ToUpper(strings.TrimSpace(word)))}
+	if len(m.value) == 0 {
+		return "", ""
+	}
+	s := string(m.value)
+	m.slavo_germanic = strings.ContainsAny(s, "WK") || strings.Contains(s, "CZ") || strings.Contains(s, "WITZ")
+
+	i := 0
+	if m.contains(0, 2, "GN", "KN", "PN", "WR", "PS") {
+		i = 1
+	}
+	for !m.complete() && i < len(m.value) {
+		switch m.at(i) {
+		case 'A', 'E', 'I', 'O', 'U', 'Y':
+			if i == 0 {
+				m.add("A")
+			}
+			i++
+		case 'B':
+			m.add("P")
+			i = m.skip_double(i, 'B')
+		case 'C':
+			i = m.handle_c(i)
+		case 'D':
+			i = m.handle_d(i)
+		case 'F':
+			m.add("F")
+			i = m.skip_double(i, 'F')
+		case 'G':
+			i = m.handle_g(i)
+		case 'H':
+			i = m.handle_h(i)
+		case 'J':
+			i = m.handle_j(i)
+		case 'K':
+			m.add("K")
+			i = m.skip_double(i, 'K')
+		case 'L':
+			i = m.handle_l(i)
+		case 'M':
+			m.add("M")
+			if m.condition_m0(i) {
+				i += 2
+			} else {
+				i++
+			}
+		case 'N':
+			m.add("N")
+			i = m.skip_double(i, 'N')
+		case 'P':
+			i = m.handle_p(i)
+		case 'Q':
+			m.add("K")
+			i = m.skip_double(i, 'Q')
+		case 'R':
+			i = m.handle_r(i)
+		case 'S':
+			i = m.handle_s(i)
+		case 'T':
+			i = m.handle_t(i)
+		case 'V':
+			m.add("F")
+			i = m.skip_double(i, 'V')
+		case 'W':
+			i = m.handle_w(i)
+		case 'X':
+			i = m.handle_x(i)
+		case 'Z':
+			i = m.handle_z(i)
+		default:
+			i++
+		}
+	}
+	return string(m.primary), string(m.alternate)
+}
+
+func (m *metaphone) at(i int) rune {
+
+	if i < 0 || i >= len(m.value) {
+		return 0
+	}
+	return m.value[i]
+}
+
+// Whether the length runes at start are one of options
+func (m *metaphone) contains(start, length int, options ...string) bool {
+
+	if start < 0 || start+length > len(m.value) {
+		return false
+	}
+	s := string(m.value[start : start+length])
+	for _, o := range options {
+		if s == o {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *metaphone) is_vowel(i int) bool {
+	return strings.ContainsRune("AEIOUY", m.at(i))
+}
+
+func (m *metaphone) complete() bool {
+	return len(m.primary) >= metaphone_length && len(m.alternate) >= metaphone_length
+}
+
+// Add to both codes, or primary and alternate when they differ
+func (m *metaphone) add(codes ...string) {
+
+	primary, alternate := codes[0], codes[0]
+	if len(codes) > 1 {
+		alternate = codes[1]
+	}
+	m.add_primary(primary)
+	m.add_alternate(alternate)
+}
+
+func (m *metaphone) add_primary(code string) {
+	m.primary = append_code(m.primary, code)
+}
+
+func (m *metaphone) add_alternate(code string) {
+	m.alternate = append_code(m.alternate, code)
+}
+
+func append_code(code []rune, s string) []rune {
+
+	for _, r := range s {
+		if len(code) == metaphone_length {
+			break
+		}
+		code = append(code, r)
+	}
+	return code
+}
+
+// Where to continue after the letter at i, skipping it if it is doubled
+func (m *metaphone) skip_double(i int, r rune) int {
+
+	if m.at(i+1) == r {
+		return i + 2
+	}
+	return i + 1
+}
+
+func (m *metaphone) germanic() bool {
+	return m.contains(0, 4, "VAN ", "VON ") || m.contains(0, 3, "SCH")
+}
+
+func (m *metaphone) handle_c(i int) int {
+
+	switch {
+	case m.condition_c0(i):
+		m.add("K")
+		return i + 2
+	case i == 0 && m.contains(i, 6, "CAESAR"):
+		m.add("S")
+		return i + 2
+	case m.contains(i, 2, "CH"):
+		return m.handle_ch(i)
+	case m.contains(i, 2, "CZ") && !m.contains(i-2, 4, "WICZ"):
+		m.add("S", "X")
+		return i + 2
+	case m.contains(i+1, 3, "CIA"):
+		m.add("X")
+		return i + 3
+	case m.contains(i, 2, "CC") && !(i == 1 && m.at(0) == 'M'):
+		return m.handle_cc(i)
+	case m.contains(i, 2, "CK", "CG", "CQ"):
+		m.add("K")
+		return i + 2
+	case m.contains(i, 2, "CI", "CE", "CY"):
+		if m.contains(i, 3, "CIO", "CIE", "CIA") {
+			m.add("S", "X")
+		} else {
+			m.add("S")
+		}
+		return i + 2
+	}
+	m.add("K")
+	switch {
+	case m.contains(i+1, 2, " C", " Q", " G"):
+		return i + 3
+	case m.contains(i+1, 1, "C", "K", "Q") && !m.contains(i+1, 2, "CE", "CI"):
+		return i + 2
+	}
+	return i + 1
+}
+
+func (m *metaphone) handle_cc(i int) int {
+
+	if m.contains(i+2, 1, "I", "E", "H") && !m.contains(i+2, 2, "HU") {
+		if (i == 1 && m.at(i-1) == 'A') || m.contains(i-1, 5, "UCCEE", "UCCES") {
+			m.add("KS")
+		} else {
+			m.add("X")
+		}
+		return i + 3
+	}
+	m.add("K")
+	return i + 2
+}
+
+func (m *metaphone) handle_ch(i int) int {
+
+	switch {
+	case i > 0 && m.contains(i, 4, "CHAE"):
+		m.add("K", "X")
+	case m.condition_ch0(i), m.condition_ch1(i):
+		m.add("K")
+	case i > 0 && m.contains(0, 2, "MC"):
+		m.add("K")
+	case i > 0:
+		m.add("X", "K")
+	default:
+		m.add("X")
+	}
+	return i + 2
+}
+
+func (m *metaphone) condition_c0(i int) bool {
+
+	if m.contains(i, 4, "CHIA") {
+		return true
+	}
+	if i <= 1 || m.is_vowel(i-2) || !m.contains(i-1, 3, "ACH") {
+		return false
+	}
+	c := m.at(i + 2)
+	return (c != 'I' && c != 'E') || m.contains(i-2, 6, "BACHER", "MACHER")
+}
+
+func (m *metaphone) condition_ch0(i int) bool {
+
+	if i != 0 {
+		return false
+	}
+	if !m.contains(i+1, 5, "HARAC", "HARIS") && !m.contains(i+1, 3, "HOR", "HYM", "HIA", "HEM") {
+		return false
+	}
+	return !m.contains(0, 5, "CHORE")
+}
+
+func (m *metaphone) condition_ch1(i int) bool {
+
+	return m.germanic() ||
+		m.contains(i-2, 6, "ORCHES", "ARCHIT", "ORCHID") ||
+		m.contains(i+2, 1, "T", "S") ||
+		((m.contains(i-1, 1, "A", "O", "U", "E") || i == 0) &&
+			(m.contains(i+2, 1, "L", "R", "N", "M", "B", "H", "F", "V", "W", " ") || i+1 == len(m.value)-1))
+}
+
+func (m *metaphone) handle_d(i int) int {
+
+	switch {
+	case m.contains(i, 2, "DG"):
+		if m.contains(i+2, 1, "I", "E", "Y") {
+			m.add("J")
+			return i + 3
+		}
+		m.add("TK")
+		return i + 2
+	case m.contains(i, 2, "DT", "DD"):
+		m.add("T")
+		return i + 2
+	}
+	m.add("T")
+	return i + 1
+}
+
+func (m *metaphone) handle_g(i int) int {
+
+	switch {
+	case m.at(i+1) == 'H':
+		return m.handle_gh(i)
+	case m.at(i+1) == 'N':
+		switch {
+		case i == 1 && m.is_vowel(0) && !m.slavo_germanic:
+			m.add("KN", "N")
+		case !m.contains(i+2, 2, "EY") && m.at(i+1) != 'Y' && !m.slavo_germanic:
+			m.add("N", "KN")
+		default:
+			m.add("KN")
+		}
+		return i + 2
+	case m.contains(i+1, 2, "LI") && !m.slavo_germanic:
+		m.add("KL", "L")
+		return i + 2
+	case i == 0 && (m.at(i+1) == 'Y' || m.contains(i+1, 2, "ES", "EP", "EB", "EL", "EY", "IB", "IL", "IN", "IE", "EI", "ER")):
+		m.add("K", "J")
+		return i + 2
+	case (m.contains(i+1, 2, "ER") || m.at(i+1) == 'Y') &&
+		!m.contains(0, 6, "DANGER", "RANGER", "MANGER") &&
+		!m.contains(i-1, 1, "E", "I") &&
+		!m.contains(i-1, 3, "RGY", "OGY"):
+		m.add("K", "J")
+		return i + 2
+	case m.contains(i+1, 1, "E", "I", "Y") || m.contains(i-1, 4, "AGGI", "OGGI"):
+		switch {
+		case m.germanic() || m.contains(i+1, 2, "ET"):
+			m.add("K")
+		case m.contains(i+1, 3, "IER"):
+			m.add("J")
+		default:
+			m.add("J", "K")
+		}
+		return i + 2
+	case m.at(i+1) == 'G':
+		m.add("K")
+		return i + 2
+	}
+	m.add("K")
+	return i + 1
+}
+
+func (m *metaphone) handle_gh(i int) int {
+
+	switch {
+	case i > 0 && !m.is_vowel(i-1):
+		m.add("K")
+	case i == 0:
+		if m.at(i+2) == 'I' {
+			m.add("J")
+		} else {
+			m.add("K")
+		}
+	case (i > 1 && m.contains(i-2, 1, "B", "H", "D")) ||
+		(i > 2 && m.contains(i-3, 1, "B", "H", "D")) ||
+		(i > 3 && m.contains(i-4, 1, "B", "H")):
+		// Silent, as in "bough" or "night"
+	case i > 2 && m.at(i-1) == 'U' && m.contains(i-3, 1, "C", "G", "L", "R", "T"):
+		m.add("F")
+	case i > 0 && m.at(i-1) != 'I':
+		m.add("K")
+	}
+	return i + 2
+}
+
+func (m *metaphone) handle_h(i int) int {
+
+	// Only pronounced between vowels or at the start before one
+	if (i == 0 || m.is_vowel(i-1)) && m.is_vowel(i+1) {
+		m.add("H")
+		return i + 2
+	}
+	return i + 1
+}
+
+func (m *metaphone) handle_j(i int) int {
+
+	if m.contains(i, 4, "JOSE") || m.contains(0, 4, "SAN ") {
+		if (i == 0 && m.at(i+4) == ' ') || len(m.value) == 4 || m.contains(0, 4, "SAN ") {
+			m.add("H")
+		} else {
+			m.add("J", "H")
+		}
+		return i + 1
+	}
+	switch {
+	case i == 0 && !m.contains(i, 4, "JOSE"):
+		m.add("J", "A")
+	case m.is_vowel(i-1) && !m.slavo_germanic && (m.at(i+1) == 'A' || m.at(i+1) == 'O'):
+		m.add("J", "H")
+	case i == len(m.value)-1:
+		m.add("J", " ")
+	case !m.contains(i+1, 1, "L", "T", "K", "S", "N", "M", "B", "Z") && !m.contains(i-1, 1, "S", "K", "L"):
+		m.add("J")
+	}
+	return m.skip_double(i, 'J')
+}
+
+func (m *metaphone) handle_l(i int) int {
+
+	if m.at(i+1) == 'L' {
+		if m.condition_l0(i) {
+			// Spanish, as in "cabrillo"
+			m.add_primary("L")
+		} else {
+			m.add("L")
+		}
+		return i + 2
+	}
+	m.add("L")
+	return i + 1
+}
+
+func (m *metaphone) condition_l0(i int) bool {
+
+	n := len(m.value)
+	if i == n-3 && m.contains(i-1, 4, "ILLO", "ILLA", "ALLE") {
+		return true
+	}
+	return (m.contains(n-2, 2, "AS", "OS") || m.contains(n-1, 1, "A", "O")) && m.contains(i-1, 4, "ALLE")
+}
+
+func (m *metaphone) condition_m0(i int) bool {
+
+	if m.at(i+1) == 'M' {
+		return true
+	}
+	return m.contains(i-1, 3, "UMB") && (i+1 == len(m.value)-1 || m.contains(i+2, 2, "ER"))
+}
+
+func (m *metaphone) handle_p(i int) int {
+
+	if m.at(i+1) == 'H' {
+		m.add("F")
+		return i + 2
+	}
+	m.add("P")
+	if m.contains(i+1, 1, "P", "B") {
+		return i + 2
+	}
+	return i + 1
+}
+
+func (m *metaphone) handle_r(i int) int {
+
+	// French, as in "rogier"
+	if i == len(m.value)-1 && !m.slavo_germanic && m.contains(i-2, 2, "IE") && !m.contains(i-4, 2, "ME", "MA") {
+		m.add_alternate("R")
+	} else {
+		m.add("R")
+	}
+	return m.skip_double(i, 'R')
+}
+
+func (m *metaphone) handle_s(i int) int {
+
+	switch {
+	case m.contains(i-1, 3, "ISL", "YSL"):
+		// Silent, as in "island"
+		return i + 1
+	case i == 0 && m.contains(i, 5, "SUGAR"):
+		m.add("X", "S")
+		return i + 1
+	case m.contains(i, 2, "SH"):
+		if m.contains(i+1, 4, "HEIM", "HOEK", "HOLM", "HOLZ") {
+			m.add("S")
+		} else {
+			m.add("X")
+		}
+		return i + 2
+	case m.contains(i, 3, "SIO", "SIA") || m.contains(i, 4, "SIAN"):
+		if m.slavo_germanic {
+			m.add("S")
+		} else {
+			m.add("S", "X")
+		}
+		return i + 3
+	case (i == 0 && m.contains(i+1, 1, "M", "N", "L", "W")) || m.contains(i+1, 1, "Z"):
+		m.add("S", "X")
+		if m.contains(i+1, 1, "Z") {
+			return i + 2
+		}
+		return i + 1
+	case m.contains(i, 2, "SC"):
+		return m.handle_sc(i)
+	}
+	// French, as in "resnais"
+	if i == len(m.value)-1 && m.contains(i-2, 2, "AI", "OI") {
+		m.add_alternate("S")
+	} else {
+		m.add("S")
+	}
+	if m.contains(i+1, 1, "S", "Z") {
+		return i + 2
+	}
+	return i + 1
+}
+
+func (m *metaphone) handle_sc(i int) int {
+
+	switch {
+	case m.at(i+2) == 'H':
+		switch {
+		case m.contains(i+3, 2, "ER", "EN"):
+			m.add("X", "SK")
+		case m.contains(i+3, 2, "OO", "UY", "ED", "EM"):
+			m.add("SK")
+		case i == 0 && !m.is_vowel(3) && m.at(3) != 'W':
+			m.add("X", "S")
+		default:
+			m.add("X")
+		}
+	case m.contains(i+2, 1, "I", "E", "Y"):
+		m.add("S")
+	default:
+		m.add("SK")
+	}
+	return i + 3
+}
+
+func (m *metaphone) handle_t(i int) int {
+
+	switch {
+	case m.contains(i, 4, "TION"), m.contains(i, 3, "TIA", "TCH"):
+		m.add("X")
+		return i + 3
+	case m.contains(i, 2, "TH") || m.contains(i, 3, "TTH"):
+		if m.contains(i+2, 2, "OM", "AM") || m.germanic() {
+			m.add("T")
+		} else {
+			m.add("0", "T")
+		}
+		return i + 2
+	}
+	m.add("T")
+	if m.contains(i+1, 1, "T", "D") {
+		return i + 2
+	}
+	return i + 1
+}
+
+func (m *metaphone) handle_w(i int) int {
+
+	switch {
+	case m.contains(i, 2, "WR"):
+		m.add("R")
+		return i + 2
+	case i == 0 && (m.is_vowel(i+1) || m.contains(i, 2, "WH")):
+		if m.is_vowel(i + 1) {
+			m.add("A", "F")
+		} else {
+			m.add("A")
+		}
+		return i + 1
+	case (i == len(m.value)-1 && m.is_vowel(i-1)) ||
+		m.contains(i-1, 5, "EWSKI", "EWSKY", "OWSKI", "OWSKY") || m.contains(0, 3, "SCH"):
+		m.add_alternate("F")
+		return i + 1
+	case m.contains(i, 4, "WICZ", "WITZ"):
+		m.add("TS", "FX")
+		return i + 4
+	}
+	return i + 1
+}
+
+func (m *metaphone) handle_x(i int) int {
+
+	if i == 0 {
+		m.add("S")
+		return i + 1
+	}
+	// French, as in "breaux"
+	silent := i == len(m.value)-1 && (m.contains(i-3, 3, "IAU", "EAU") || m.contains(i-2, 2, "AU", "OU"))
+	if !silent {
+		m.add("KS")
+	}
+	if m.contains(i+1, 1, "C", "X") {
+		return i + 2
+	}
+	return i + 1
+}
+
+func (m *metaphone) handle_z(i int) int {
+
+	if m.at(i+1) == 'H' {
+		m.add("J")
+		return i + 2
+	}
+	if m.contains(i+1, 2, "ZO", "ZI", "ZA") || (m.slavo_germanic && i > 0 && m.at(i-1) != 'T') {
+		m.add("S", "TS")
+	} else {
+		m.add("S")
+	}
+	return m.skip_double(i, 'Z')
+}
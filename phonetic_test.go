@@ -0,0 +1,49 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestDoubleMetaphone(t *testing.T) {
+
+	tests := []struct{ word, primary, alternate string }{
+		{"smith", "SM0", "XMT"},
+		{"schmidt", "XMT", "SMT"},
+		{"catherine", "K0RN", "KTRN"},
+		{"kathryn", "K0RN", "KTRN"},
+		{"gross", "KRS", "KRS"},
+		{"muller", "MLR", "MLR"},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		primary, alternate := double_metaphone(tt.word)
+		if primary != tt.primary || alternate != tt.alternate {
+			t.Errorf("double_metaphone(%q) = %q, %q, want %q, %q", tt.word, primary, alternate, tt.primary, tt.alternate)
+		}
+	}
+}
+
+// Names spelled differently that search finds for each other by sound
+func TestSoundsAlike(t *testing.T) {
+
+	tests := []struct {
+		a, b  string
+		alike bool
+	}{
+		{"Smith", "Schmidt", true},
+		{"Catherine", "Kathryn", true},
+		{"Gross", "Groß", true},
+		{"Müller", "Muller", true},
+		{"Carson", "Carsen", true},
+		{"Smith", "Jones", false},
+		{"Gross", "Grant", false},
+	}
+	for _, tt := range tests {
+		a, b := sound_codes(fold(tt.a)), sound_codes(fold(tt.b))
+		alike := slices.ContainsFunc(a, func(code string) bool { return slices.Contains(b, code) })
+		if alike != tt.alike {
+			t.Errorf("%s %v and %s %v sound alike: %t, want %t", tt.a, a, tt.b, b, alike, tt.alike)
+		}
+	}
+}
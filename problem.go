@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Every /api/v1 failure is answered with an RFC 9457 problem details
+// document, so clients handle them all the same way. type tells what kind of
+// problem it is, instance is the request id the server logged it under
+
+const problem_content_type = "application/problem+json"
+
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	// What is wrong with each field, for invalid contacts and parameters
+	Errors map[string]string `json:"errors,omitempty"`
+	// Character of q an invalid query is wrong at, counting from 0
+	Position *int `json:"position,omitempty"`
+	// What was wrong with each operation of a batch that was not applied
+	Results []batch_result `json:"results,omitempty"`
+}
+
+// A kind of problem, the same for every request it happens to
+type problem_type struct {
+	URI    string
+	Title  string
+	Status int
+}
+
+var (
+	problem_not_found               = problem_type{"/problems/not-found", "Contact not found", http.StatusNotFound}
+	problem_no_route                = problem_type{"about:blank", "Not Found", http.StatusNotFound}
+	problem_method_not_allowed      = problem_type{"about:blank", "Method Not Allowed", http.StatusMethodNotAllowed}
+	problem_invalid_contact         = problem_type{"/problems/invalid-contact", "The contact is not valid", http.StatusUnprocessableEntity}
+	problem_email_taken             = problem_type{"/problems/email-taken", "Another contact has the email", http.StatusConflict}
+	problem_invalid_body            = problem_type{"/problems/invalid-body", "The request body could not be read", http.StatusBadRequest}
+	problem_body_too_large          = problem_type{"/problems/body-too-large", "The request body is too large", http.StatusRequestEntityTooLarge}
+	problem_media_type              = problem_type{"/problems/unsupported-media-type", "The request body has an unsupported content type", http.StatusUnsupportedMediaType}
+	problem_invalid_query           = problem_type{"/problems/invalid-query", "The search query is not valid", http.StatusBadRequest}
+	problem_invalid_sort            = problem_type{"/problems/invalid-sort", "The sort order is not valid", http.StatusBadRequest}
+	problem_invalid_cursor          = problem_type{"/problems/invalid-cursor", "The cursor is not valid", http.StatusBadRequest}
+	problem_invalid_import          = problem_type{"/problems/invalid-import", "The import file could not be read", http.StatusBadRequest}
+	problem_import_mapping          = problem_type{"/problems/import-mapping", "The import columns could not be mapped", http.StatusUnprocessableEntity}
+	problem_import_conflict         = problem_type{"/problems/import-conflict", "The import clashes with contacts saved meanwhile", http.StatusConflict}
+	problem_invalid_patch           = problem_type{"/problems/invalid-patch", "The patch cannot be applied to the contact", http.StatusUnprocessableEntity}
+	problem_patch_conflict          = problem_type{"/problems/patch-test-failed", "A test in the patch failed", http.StatusConflict}
+	problem_precondition_failed     = problem_type{"/problems/precondition-failed", "The contact was changed since it was read", http.StatusPreconditionFailed}
+	problem_invalid_batch           = problem_type{"/problems/invalid-batch", "The batch is not valid", http.StatusBadRequest}
+	problem_batch_failed            = problem_type{"/problems/batch-failed", "Some operations of the batch cannot be applied, none was", http.StatusUnprocessableEntity}
+	problem_invalid_idempotency_key = problem_type{"/problems/invalid-idempotency-key", "The Idempotency-Key is not valid", http.StatusBadRequest}
+	problem_idempotency_mismatch    = problem_type{"/problems/idempotency-key-reused", "The Idempotency-Key was used for another request", http.StatusUnprocessableEntity}
+	problem_idempotency_in_progress = problem_type{"/problems/idempotency-key-in-progress", "A request with the Idempotency-Key is still being processed", http.StatusConflict}
+	problem_internal                = problem_type{"about:blank", "Internal Server Error", http.StatusInternalServerError}
+)
+
+func (t problem_type) problem(detail string) *problem {
+	return &problem{Type: t.URI, Title: t.Title, Status: t.Status, Detail: detail}
+}
+
+// Answer r with p, naming the request in it
+func write_problem(w http.ResponseWriter, r *http.Request, p *problem) {
+
+	if id := request_id(r); id != "" {
+		p.Instance = "urn:uuid:" + id
+	}
+	json_problem, err := json.Marshal(p)
+	if err != nil {
+		log.Error("write_problem: error in json.Marshal(p)", "error", err)
+		return
+	}
+	w.Header().Set("Content-Type", problem_content_type)
+	w.WriteHeader(p.Status)
+	_, err = w.Write(json_problem)
+	if err != nil {
+		log.Error("write_problem: error in w.Write(json_problem)", "error", err)
+	}
+}
+
+// For the contacts a problem_invalid_contact or, when the email being taken
+// is all that is wrong, a problem_email_taken
+func contact_problem(detail string, errs map[string]string) *problem {
+
+	t := problem_invalid_contact
+	if len(errs) == 1 && errs["email"] == email_taken_message {
+		t = problem_email_taken
+	}
+	p := t.problem(detail)
+	p.Errors = errs
+	return p
+}
+
+// Catches requests under /api/v1 that no route takes, so they get a problem
+// too rather than the mux's plain text
+func api_not_found_handler(w http.ResponseWriter, r *http.Request) {
+	write_problem(w, r, problem_no_route.problem("No API endpoint at "+r.URL.Path))
+}
+
+// Catches the methods a path has no route for, allow lists the ones it has
+func api_method_not_allowed(allow string) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", allow)
+		write_problem(w, r, problem_method_not_allowed.problem(r.Method+" is not allowed here, use "+allow))
+	}
+}
@@ -0,0 +1,795 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The search box query language:
+//
+//	carson                  any field contains carson
+//	last:gross              the last name contains gross
+//	"carson gross"          a phrase, also matches first and last name together
+//	email:*@example.com     * and ? are wildcards, the whole field must match
+//	-phone:empty            negation, empty matches an empty field
+//	gross OR -email:empty   terms are ANDed unless joined by OR, ( ) group
+//
+// Fields are first, last, name (first and last), email and phone. Comparisons
+// ignore case and accents, phone numbers also match by their digits alone when
+// a term is written like one. Words that aren't negated also find names and
+// emails with a typo or that sound alike ("carsen gros"), results come best
+// match first
+
+var query_fields = []string{"first", "last", "name", "email", "phone"}
+
+// A problem with a query, Position is the character (not byte) it was found at
+type QueryError struct {
+	Position int    `json:"position"`
+	Message  string `json:"message"`
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("at character %d: %s", e.Position+1, e.Message)
+}
+
+// A parsed query, Match is the predicate it compiles to
+type Query struct {
+	Text string
+	// Nil for a query that matches everything
+	root *query_node
+	// The terms that aren't negated, what Highlight marks
+	terms []*query_term
+}
+
+// A contact's fields the way queries compare them
+type folded_contact struct {
+	first, last, name, email, phone, phone_digits string
+}
+
+type query_node struct {
+	// How well f matches, 0 when it does not
+	score func(f *folded_contact) int
+	// The contacts that may match, nil when the index can't tell
+	candidates func(ix *search_index) id_set
+}
+
+// Parse text into a Query. An empty text matches every contact
+func parse_query(text string) (*Query, error) {
+
+	tokens, err := lex_query(text)
+	if err != nil {
+		return nil, err
+	}
+	p := query_parser{tokens: tokens, end: utf8.RuneCountInString(text)}
+	if len(tokens) == 0 {
+		return &Query{Text: text}, nil
+	}
+
+	root, err := p.parse_or()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t != nil {
+		// Only a ) the parser did not open can stop it early
+		return nil, &QueryError{t.pos, "unexpected )"}
+	}
+	return &Query{Text: text, root: &root, terms: p.terms}, nil
+}
+
+// Whether c is one of the contacts the query asks for
+func (q *Query) Match(c Contact) bool {
+	return q.Score(c) > 0
+}
+
+// How well c matches, higher is better and 0 is not at all. Every contact
+// matches an empty query equally
+func (q *Query) Score(c Contact) int {
+
+	if q.root == nil {
+		return 1
+	}
+	f := folded_contact{
+		first:        fold(c.First),
+		last:         fold(c.Last),
+		email:        fold(c.Email),
+		phone:        fold(c.Phone),
+		phone_digits: normalize_phone(c.Phone),
+	}
+	f.name = f.first + " " + f.last
+	return q.root.score(&f)
+}
+
+// Up to limit of the contacts in cs that q matches starting at offset, in
+// order, or best matches first when order is nil, and how many it matches.
+// Ties keep the order of cs. A negative limit returns all of them
+func (q *Query) rank(cs []Contact, order *SortOrder, offset, limit int) ([]Contact, int) {
+
+	type scored struct {
+		c     Contact
+		score int
+	}
+	var found []scored
+	if q.root == nil {
+		found = make([]scored, len(cs))
+		for i, c := range cs {
+			found[i] = scored{c, 1}
+		}
+	} else {
+		for _, c := range cs {
+			if score := q.Score(c); score > 0 {
+				found = append(found, scored{c, score})
+			}
+		}
+		slices.SortStableFunc(found, func(a, b scored) int { return b.score - a.score })
+	}
+	out := make([]Contact, len(found))
+	for i, s := range found {
+		out[i] = s.c
+	}
+	if order != nil {
+		order.sort(out)
+	}
+
+	offset = min(max(offset, 0), len(out))
+	end := len(out)
+	if limit >= 0 {
+		end = min(end, offset+limit)
+	}
+	return out[offset:end], len(out)
+}
+
+// c's fields as HTML with what the query found in them marked
+func (q *Query) Highlight(c Contact) Highlighted {
+
+	first, last := new_marked_text(c.First), new_marked_text(c.Last)
+	email, phone := new_marked_text(c.Email), new_marked_text(c.Phone)
+	// Phrases can run from the first name into the last
+	name := new_marked_text(c.First + " " + c.Last)
+
+	if q != nil {
+		texts := map[string][]*marked_text{
+			"":      {name, email, phone},
+			"first": {first},
+			"last":  {last},
+			"name":  {name},
+			"email": {email},
+			"phone": {phone},
+		}
+		for _, t := range q.terms {
+			for _, m := range texts[t.field] {
+				t.mark(m)
+			}
+			if t.digits != "" {
+				phone.mark_digits(t.digits)
+			}
+		}
+	}
+
+	n := len(first.marks)
+	for i, marked := range name.marks[:n] {
+		first.marks[i] = first.marks[i] || marked
+	}
+	for i, marked := range name.marks[n+1:] {
+		last.marks[i] = last.marks[i] || marked
+	}
+	return Highlighted{first.html(), last.html(), phone.html(), email.html()}
+}
+
+// A contact's fields as HTML, see Query.Highlight
+type Highlighted struct {
+	First, Last, Phone, Email template.HTML
+}
+
+// A superset of the contacts in ix that Match accepts, nil if that may be any
+// of them
+func (q *Query) candidates(ix *search_index) id_set {
+
+	if q.root == nil {
+		return nil
+	}
+	return q.root.candidates(ix)
+}
+
+//------------------------------------------------------------------------------
+// Lexer
+//------------------------------------------------------------------------------
+
+type query_token_kind int
+
+const (
+	token_term query_token_kind = iota
+	token_or
+	token_not
+	token_open
+	token_close
+)
+
+type query_token struct {
+	kind query_token_kind
+	// Character offset in the query
+	pos int
+	// For terms, empty field means any field
+	field string
+	value string
+	// Phrases are taken literally, no wildcards or empty
+	quoted bool
+}
+
+func lex_query(text string) ([]query_token, error) {
+
+	rs := []rune(text)
+	var tokens []query_token
+	i := 0
+	for i < len(rs) {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, query_token{kind: token_open, pos: i})
+			i++
+		case r == ')':
+			tokens = append(tokens, query_token{kind: token_close, pos: i})
+			i++
+		case r == '-':
+			if i+1 == len(rs) || unicode.IsSpace(rs[i+1]) || rs[i+1] == ')' {
+				return nil, &QueryError{i, "- must be followed by a term"}
+			}
+			tokens = append(tokens, query_token{kind: token_not, pos: i})
+			i++
+		default:
+			t, next, err := lex_term(rs, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, t)
+			i = next
+		}
+	}
+	return tokens, nil
+}
+
+// Read [field:]value starting at rs[start], returns the token and where the
+// next one starts
+func lex_term(rs []rune, start int) (query_token, int, error) {
+
+	t := query_token{kind: token_term, pos: start}
+	i := start
+
+	// A field is letters followed by a colon, "10:30" is just a value
+	j := i
+	for j < len(rs) && unicode.IsLetter(rs[j]) {
+		j++
+	}
+	if j > i && j < len(rs) && rs[j] == ':' {
+		field := strings.ToLower(string(rs[i:j]))
+		known := false
+		for _, f := range query_fields {
+			known = known || f == field
+		}
+		if !known {
+			return t, 0, &QueryError{i, fmt.Sprintf("unknown field %q, use %s", field, strings.Join(query_fields, ", "))}
+		}
+		t.field = field
+		i = j + 1
+		if i == len(rs) || unicode.IsSpace(rs[i]) || rs[i] == ')' {
+			return t, 0, &QueryError{start, "missing value after " + field + ":"}
+		}
+	}
+
+	if rs[i] == '"' {
+		end := i + 1
+		for end < len(rs) && rs[end] != '"' {
+			end++
+		}
+		if end == len(rs) {
+			return t, 0, &QueryError{i, "missing closing quote"}
+		}
+		t.value = string(rs[i+1 : end])
+		t.quoted = true
+		return t, end + 1, nil
+	}
+
+	end := i
+	for end < len(rs) && !unicode.IsSpace(rs[end]) && rs[end] != '(' && rs[end] != ')' && rs[end] != '"' {
+		end++
+	}
+	t.value = string(rs[i:end])
+	if t.field == "" && t.value == "OR" {
+		t.kind = token_or
+	}
+	return t, end, nil
+}
+
+//------------------------------------------------------------------------------
+// Parser
+//------------------------------------------------------------------------------
+
+// Recursive descent over the tokens, following
+//
+//	or   = and { OR and }
+//	and  = not { not }
+//	not  = [-] atom
+//	atom = term | ( or )
+type query_parser struct {
+	tokens []query_token
+	i      int
+	// Position reported for errors at the end of the query
+	end int
+	// How many - the term being parsed is under
+	negated int
+	terms   []*query_term
+}
+
+func (p *query_parser) peek() *query_token {
+
+	if p.i == len(p.tokens) {
+		return nil
+	}
+	return &p.tokens[p.i]
+}
+
+func (p *query_parser) parse_or() (query_node, error) {
+
+	left, err := p.parse_and()
+	if err != nil {
+		return query_node{}, err
+	}
+	for {
+		t := p.peek()
+		if t == nil || t.kind != token_or {
+			return left, nil
+		}
+		p.i++
+		if next := p.peek(); next == nil || next.kind == token_close {
+			return query_node{}, &QueryError{t.pos, "OR needs a term on both sides"}
+		}
+		right, err := p.parse_and()
+		if err != nil {
+			return query_node{}, err
+		}
+		l := left
+		left = query_node{
+			score:      func(f *folded_contact) int { return max(l.score(f), right.score(f)) },
+			candidates: func(ix *search_index) id_set { return union_ids(l.candidates(ix), right.candidates(ix)) },
+		}
+	}
+}
+
+func (p *query_parser) parse_and() (query_node, error) {
+
+	left, err := p.parse_not()
+	if err != nil {
+		return query_node{}, err
+	}
+	for {
+		t := p.peek()
+		if t == nil || t.kind == token_or || t.kind == token_close {
+			return left, nil
+		}
+		right, err := p.parse_not()
+		if err != nil {
+			return query_node{}, err
+		}
+		l := left
+		left = query_node{
+			score: func(f *folded_contact) int {
+				a := l.score(f)
+				if a == 0 {
+					return 0
+				}
+				b := right.score(f)
+				if b == 0 {
+					return 0
+				}
+				return a + b
+			},
+			candidates: func(ix *search_index) id_set { return intersect_ids(l.candidates(ix), right.candidates(ix)) },
+		}
+	}
+}
+
+func (p *query_parser) parse_not() (query_node, error) {
+
+	t := p.peek()
+	if t != nil && t.kind == token_not {
+		p.i++
+		p.negated++
+		n, err := p.parse_atom()
+		p.negated--
+		if err != nil {
+			return query_node{}, err
+		}
+		// The index only knows what contacts have, not what they lack
+		return query_node{
+			score: func(f *folded_contact) int {
+				if n.score(f) > 0 {
+					return 0
+				}
+				return 1
+			},
+			candidates: func(ix *search_index) id_set { return nil },
+		}, nil
+	}
+	return p.parse_atom()
+}
+
+func (p *query_parser) parse_atom() (query_node, error) {
+
+	t := p.peek()
+	switch {
+	case t == nil:
+		return query_node{}, &QueryError{p.end, "missing a term at the end"}
+	case t.kind == token_or:
+		return query_node{}, &QueryError{t.pos, "OR needs a term on both sides"}
+	case t.kind == token_close:
+		return query_node{}, &QueryError{t.pos, "unexpected )"}
+	case t.kind == token_open:
+		p.i++
+		n, err := p.parse_or()
+		if err != nil {
+			return query_node{}, err
+		}
+		closing := p.peek()
+		if closing == nil || closing.kind != token_close {
+			return query_node{}, &QueryError{t.pos, "missing )"}
+		}
+		p.i++
+		return n, nil
+	}
+	p.i++
+	term := new_query_term(*t)
+	if p.negated == 0 {
+		p.terms = append(p.terms, term)
+	} else {
+		// -smith leaves out Smith, not everyone who sounds like him
+		term.word, term.sounds = "", nil
+	}
+	return term.node(), nil
+}
+
+//------------------------------------------------------------------------------
+// Terms
+//------------------------------------------------------------------------------
+
+// How well a term matches, the score of a contact is the sum over the terms
+// it has to match
+const (
+	// The whole field
+	score_equal = 100
+	// A whole word of it
+	score_word = 90
+	// The start of a word
+	score_prefix = 70
+	// Anywhere else, and wildcard, empty and phone digit matches
+	score_inside = 50
+	// Minus 10 for each edit
+	score_typo = 40
+	// A word that sounds the same
+	score_sound = 25
+)
+
+type query_term_kind int
+
+const (
+	term_text query_term_kind = iota
+	term_empty
+	term_glob
+)
+
+type query_term struct {
+	kind query_term_kind
+	// Empty for any field
+	field string
+	// Folded
+	value string
+	// The digits of value, to find phone numbers however they are written
+	digits string
+	// value when it is a single word long enough to match with typos, and
+	// how it sounds
+	word   string
+	sounds []string
+	// fuzzy_score by word, the same names come up again and again. A Query
+	// is only ever used by one request
+	fuzzy_scores map[string]int
+	typos        typo_table
+}
+
+func new_query_term(t query_token) *query_term {
+
+	term := &query_term{field: t.field, value: fold(t.value)}
+	switch {
+	case !t.quoted && t.field != "" && term.value == "empty":
+		term.kind = term_empty
+	case !t.quoted && strings.ContainsAny(term.value, "*?"):
+		term.kind = term_glob
+	default:
+		// "555 0102" and "555-0102" are the same number. Terms for any field
+		// only look at the digits when they are written like a number, x1 is
+		// not the 1 in every phone
+		if t.field == "phone" || t.field == "" && phone_shaped(term.value) {
+			term.digits = normalize_phone(term.value)
+		}
+		// Phrases are meant as they are written
+		tokens := index_tokens(term.value)
+		if !t.quoted && t.field != "phone" && len(tokens) == 1 && tokens[0] == term.value &&
+			utf8.RuneCountInString(term.value) >= sound_min_length {
+			term.word = term.value
+			term.sounds = sound_codes(term.value)
+			term.fuzzy_scores = make(map[string]int)
+		}
+	}
+	return term
+}
+
+// Whether s has digits and otherwise only what phone numbers are written with
+func phone_shaped(s string) bool {
+
+	digits := false
+	for _, r := range s {
+		switch {
+		case r >= '0' && r <= '9':
+			digits = true
+		case !strings.ContainsRune(" +-./()", r):
+			return false
+		}
+	}
+	return digits
+}
+
+func (t *query_term) node() query_node {
+	return query_node{score: t.score, candidates: t.candidates}
+}
+
+func (t *query_term) fields(f *folded_contact) []string {
+
+	switch t.field {
+	case "first":
+		return []string{f.first}
+	case "last":
+		return []string{f.last}
+	case "name":
+		return []string{f.first, f.last, f.name}
+	case "email":
+		return []string{f.email}
+	case "phone":
+		return []string{f.phone}
+	}
+	return []string{f.first, f.last, f.name, f.email, f.phone}
+}
+
+// The fields whose words typos and sounds are matched against
+func (t *query_term) fuzzy_fields(f *folded_contact) []string {
+
+	switch t.field {
+	case "first":
+		return []string{f.first}
+	case "last":
+		return []string{f.last}
+	case "name":
+		return []string{f.first, f.last}
+	case "email":
+		return []string{f.email}
+	}
+	return []string{f.first, f.last, f.email}
+}
+
+// The index keys of the term's field, name is first and last together, which
+// also covers either of them alone
+func (t *query_term) index_fields() []string {
+
+	switch t.field {
+	case "first":
+		return []string{index_first}
+	case "last":
+		return []string{index_last}
+	case "name":
+		return []string{index_first, index_last}
+	case "email":
+		return []string{index_email}
+	case "phone":
+		return []string{index_phone}
+	}
+	return []string{index_first, index_last, index_email}
+}
+
+func (t *query_term) score(f *folded_contact) int {
+
+	switch t.kind {
+	case term_empty:
+		for _, s := range t.fields(f) {
+			if strings.TrimSpace(s) != "" {
+				return 0
+			}
+		}
+		return score_inside
+	case term_glob:
+		for _, s := range t.fields(f) {
+			if glob_match(t.value, s) {
+				return score_inside
+			}
+		}
+		return 0
+	}
+
+	best := 0
+	for _, s := range t.fields(f) {
+		best = max(best, text_score(s, t.value))
+	}
+	if t.digits != "" && strings.Contains(f.phone_digits, t.digits) {
+		best = max(best, score_inside)
+	}
+	if best > 0 || t.word == "" {
+		return best
+	}
+	for _, s := range t.fuzzy_fields(f) {
+		for _, w := range index_tokens(s) {
+			best = max(best, t.fuzzy_score(w))
+		}
+	}
+	return best
+}
+
+// How well value is found in s, where words start counts
+func text_score(s, value string) int {
+
+	if s == value {
+		return score_equal
+	}
+	best := 0
+	for i := 0; i+len(value) <= len(s); i++ {
+		j := strings.Index(s[i:], value)
+		if j < 0 {
+			break
+		}
+		i += j
+		before, _ := utf8.DecodeLastRuneInString(s[:i])
+		after, _ := utf8.DecodeRuneInString(s[i+len(value):])
+		starts := i == 0 || !is_word_rune(before)
+		ends := i+len(value) == len(s) || !is_word_rune(after)
+		switch {
+		case starts && ends:
+			best = max(best, score_word)
+		case starts:
+			best = max(best, score_prefix)
+		default:
+			best = max(best, score_inside)
+		}
+	}
+	return best
+}
+
+// How well word w matches the term's word by typos or sound, 0 if it doesn't
+func (t *query_term) fuzzy_score(w string) int {
+
+	if score, ok := t.fuzzy_scores[w]; ok {
+		return score
+	}
+	score := t.fuzzy_score_uncached(w)
+	t.fuzzy_scores[w] = score
+	return score
+}
+
+func (t *query_term) fuzzy_score_uncached(w string) int {
+
+	best := 0
+	if d := t.typos.distance(t.word, w); d >= 0 {
+		best = score_typo - 10*d
+	}
+	if best < score_sound {
+		for _, code := range sound_codes(w) {
+			if slices.Contains(t.sounds, code) {
+				return score_sound
+			}
+		}
+	}
+	return best
+}
+
+func (t *query_term) candidates(ix *search_index) id_set {
+
+	switch t.kind {
+	case term_empty:
+		return nil
+	case term_glob:
+		// What is between the wildcards is in the field as it is
+		return t.text_candidates(ix, strings.Map(func(r rune) rune {
+			if r == '*' || r == '?' {
+				return ' '
+			}
+			return r
+		}, t.value))
+	}
+
+	found := t.text_candidates(ix, t.value)
+	if t.digits != "" {
+		found = union_ids(found, ix.phone_candidates(t.digits))
+	}
+	if t.word != "" {
+		found = union_ids(found, ix.fuzzy_candidates(t.word, t.index_fields()...))
+	}
+	return found
+}
+
+func (t *query_term) text_candidates(ix *search_index, value string) id_set {
+
+	if t.field == "" {
+		return union_ids(union_ids(
+			ix.text_candidates(value, index_first, index_last),
+			ix.text_candidates(value, index_email)),
+			ix.text_candidates(value, index_phone))
+	}
+	return ix.text_candidates(value, t.index_fields()...)
+}
+
+// Mark what the term finds in m
+func (t *query_term) mark(m *marked_text) {
+
+	switch t.kind {
+	case term_empty:
+		return
+	case term_glob:
+		if glob_match(t.value, m.folded) {
+			m.mark(0, len(m.folded))
+		}
+		return
+	}
+
+	if t.value != "" {
+		for i := 0; ; {
+			j := strings.Index(m.folded[i:], t.value)
+			if j < 0 {
+				break
+			}
+			m.mark(i+j, i+j+len(t.value))
+			i += j + len(t.value)
+		}
+	}
+	if t.word != "" {
+		for _, span := range token_spans(m.folded) {
+			if t.fuzzy_score(m.folded[span[0]:span[1]]) > 0 {
+				m.mark(span[0], span[1])
+			}
+		}
+	}
+}
+
+// Whether all of s matches pattern, where * is any run of characters and ? is
+// a single one
+func glob_match(pattern, s string) bool {
+
+	px, sx := 0, 0
+	// Where to resume after the last * when what followed it did not match
+	star_px, star_sx := -1, 0
+	for sx < len(s) {
+		if px < len(pattern) {
+			pr, psize := utf8.DecodeRuneInString(pattern[px:])
+			sr, ssize := utf8.DecodeRuneInString(s[sx:])
+			switch {
+			case pr == '*':
+				star_px, star_sx = px, sx
+				px += psize
+				continue
+			case pr == '?' || pr == sr:
+				px += psize
+				sx += ssize
+				continue
+			}
+		}
+		if star_px < 0 {
+			return false
+		}
+		// Let the * take one more character
+		_, ssize := utf8.DecodeRuneInString(s[star_sx:])
+		star_sx += ssize
+		px, sx = star_px+1, star_sx
+	}
+	for px < len(pattern) && pattern[px] == '*' {
+		px++
+	}
+	return px == len(pattern)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"html/template"
+	"slices"
+	"testing"
+)
+
+var query_test_contacts = []Contact{
+	{ID: 1, First: "Carson", Last: "Gross", Email: "carson@example.com", Phone: "123-456-7890"},
+	{ID: 2, First: "Joe", Last: "Blow", Email: "joe@example.com", Phone: "555-0100"},
+	{ID: 3, First: "Jürgen", Last: "Groß", Email: "jurgen@beispiel.de", Phone: ""},
+	{ID: 4, First: "Katherine", Last: "Smith", Email: "kathy@example.org", Phone: "555-0199"},
+}
+
+func TestParseQueryErrors(t *testing.T) {
+
+	tests := []struct {
+		text     string
+		position int
+		message  string
+	}{
+		{`"carson`, 0, "missing closing quote"},
+		{`last:"carson`, 5, "missing closing quote"},
+		{`city:paris`, 0, `unknown field "city", use first, last, name, email, phone`},
+		{`last:`, 0, "missing value after last:"},
+		{`last: gross`, 0, "missing value after last:"},
+		{`gross -`, 6, "- must be followed by a term"},
+		{`(gross`, 0, "missing )"},
+		{`gross)`, 5, "unexpected )"},
+		{`()`, 1, "unexpected )"},
+		{`OR gross`, 0, "OR needs a term on both sides"},
+		{`gross OR`, 6, "OR needs a term on both sides"},
+		{`(gross OR)`, 7, "OR needs a term on both sides"},
+		// Positions count characters, not bytes
+		{`müller groß)`, 11, "unexpected )"},
+	}
+	for _, tt := range tests {
+		_, err := parse_query(tt.text)
+		var qe *QueryError
+		if !errors.As(err, &qe) {
+			t.Errorf("parse_query(%q) = %v, want a QueryError", tt.text, err)
+			continue
+		}
+		if qe.Position != tt.position || qe.Message != tt.message {
+			t.Errorf("parse_query(%q) = %d %q, want %d %q", tt.text, qe.Position, qe.Message, tt.position, tt.message)
+		}
+	}
+}
+
+// Match, and Search through the index, find the same contacts
+func TestQueryMatch(t *testing.T) {
+
+	tests := []struct {
+		text string
+		ids  []int
+	}{
+		{``, []int{1, 2, 3, 4}},
+		{`carson`, []int{1}},
+		{`CARSON`, []int{1}},
+		// ß folds to ss
+		{`last:gross`, []int{1, 3}},
+		{`first:gross`, nil},
+		{`"carson gross"`, []int{1}},
+		{`"gross carson"`, nil},
+		{`name:"joe blow"`, []int{2}},
+		{`email:"example.com"`, []int{1, 2}},
+		{`first:joe email:example`, []int{2}},
+		{`phone:empty`, []int{3}},
+		{`-phone:empty`, []int{1, 2, 4}},
+		{`email:*@example.com`, []int{1, 2}},
+		{`email:???@example.com`, []int{2}},
+		{`gross OR blow`, []int{1, 2, 3}},
+		{`(gross OR blow) -carson`, []int{2, 3}},
+		{`gross OR blow -carson`, []int{1, 2, 3}},
+		// Typos and sounds
+		{`carsen`, []int{1}},
+		{`smyth`, []int{4}},
+		{`kathryn`, []int{4}},
+		// Only what is typed is left out, not what sounds like it
+		{`-smyth`, []int{1, 2, 3, 4}},
+		{`-smith`, []int{1, 2, 3}},
+		// Phone numbers by their digits
+		{`5550100`, []int{2}},
+		{`"555 0100"`, []int{2}},
+		{`phone:0199`, []int{4}},
+		{`555-01`, []int{2, 4}},
+		// Letters and digits are no number, unless phone: says so. joe1 is
+		// only a typo of Joe, not the 1 in every phone
+		{`joe1`, []int{2}},
+		{`x1`, nil},
+		{`phone:x1`, []int{1, 2, 4}},
+	}
+	store := newMemoryStore(query_test_contacts)
+	for _, tt := range tests {
+		q, err := parse_query(tt.text)
+		if err != nil {
+			t.Errorf("parse_query(%q): %v", tt.text, err)
+			continue
+		}
+		var ids []int
+		for _, c := range query_test_contacts {
+			if q.Match(c) {
+				ids = append(ids, c.ID)
+			}
+		}
+		if !slices.Equal(ids, tt.ids) {
+			t.Errorf("%q matches %v, want %v", tt.text, ids, tt.ids)
+		}
+
+		found, _, err := store.Search(q, nil, 0, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = nil
+		for _, c := range found {
+			ids = append(ids, c.ID)
+		}
+		slices.Sort(ids)
+		if !slices.Equal(ids, tt.ids) {
+			t.Errorf("%q finds %v, want %v", tt.text, ids, tt.ids)
+		}
+	}
+}
+
+// Better matches score higher: the whole field, a word, the start of a word,
+// inside a word, a typo, a sound
+func TestQueryScore(t *testing.T) {
+
+	lasts := []string{"Gross", "Gross Blow", "Grossmann", "Engross", "Grass", "Groce", "Blow"}
+	q, err := parse_query("last:gross")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := -1
+	for i, last := range lasts {
+		score := q.Score(Contact{First: "Joe", Last: last})
+		if i > 0 && score >= prev {
+			t.Errorf("%s scores %d, not less than %s with %d", last, score, lasts[i-1], prev)
+		}
+		prev = score
+	}
+	if prev != 0 {
+		t.Errorf("Blow scores %d, want 0", prev)
+	}
+
+	// Every term of an AND counts
+	both, err := parse_query("carson gross")
+	if err != nil {
+		t.Fatal(err)
+	}
+	one, err := parse_query("gross")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := query_test_contacts[0]; both.Score(c) <= one.Score(c) {
+		t.Errorf("carson gross scores %d, not more than gross alone with %d", both.Score(c), one.Score(c))
+	}
+}
+
+func TestHighlight(t *testing.T) {
+
+	tests := []struct {
+		text string
+		c    Contact
+		want Highlighted
+	}{
+		{`gross`, Contact{First: "Carson", Last: "Gross", Email: "c@example.com"},
+			Highlighted{"Carson", "<mark>Gross</mark>", "", "c@example.com"}},
+		// A phrase runs from the first name into the last
+		{`"carson gross"`, Contact{First: "Carson", Last: "Gross"},
+			Highlighted{"<mark>Carson</mark>", "<mark>Gross</mark>", "", ""}},
+		// Offsets are in characters, ß folds to two
+		{`ss`, Contact{First: "Jürgen", Last: "Großmann"},
+			Highlighted{"Jürgen", "Gro<mark>ß</mark>mann", "", ""}},
+		{`gen`, Contact{First: "Jürgen", Last: "Groß"},
+			Highlighted{"Jür<mark>gen</mark>", "Groß", "", ""}},
+		{`muller`, Contact{First: "Ann", Last: "Müller-Lüdenscheid"},
+			Highlighted{"Ann", "<mark>Müller</mark>-Lüdenscheid", "", ""}},
+		{`ürg`, Contact{First: "Jürgen", Last: "Groß"},
+			Highlighted{"J<mark>ürg</mark>en", "Groß", "", ""}},
+		// Typos mark the whole word
+		{`carsen`, Contact{First: "Carson", Last: "Gross"},
+			Highlighted{"<mark>Carson</mark>", "Gross", "", ""}},
+		// Digits across the separators of the number
+		{`5550100`, Contact{First: "Joe", Phone: "555-0100"},
+			Highlighted{"Joe", "", "<mark>555-0100</mark>", ""}},
+		// Only the field asked for, and nothing for negated terms
+		{`first:blow`, Contact{First: "Joe", Last: "Blow"},
+			Highlighted{"Joe", "Blow", "", ""}},
+		{`-joe blow`, Contact{First: "Joe", Last: "Blow"},
+			Highlighted{"Joe", "<mark>Blow</mark>", "", ""}},
+		// The rest is escaped
+		{`brien`, Contact{First: "O'Brien & Co", Last: "<b>"},
+			Highlighted{"O&#39;<mark>Brien</mark> &amp; Co", "&lt;b&gt;", "", ""}},
+	}
+	for _, tt := range tests {
+		q, err := parse_query(tt.text)
+		if err != nil {
+			t.Errorf("parse_query(%q): %v", tt.text, err)
+			continue
+		}
+		if got := q.Highlight(tt.c); got != tt.want {
+			t.Errorf("%q highlights %+v, want %+v", tt.text, got, tt.want)
+		}
+	}
+
+	var q *Query
+	if got := q.Highlight(Contact{First: "<Joe>"}); got.First != template.HTML("&lt;Joe&gt;") {
+		t.Errorf("nil query highlights %q", got.First)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"html/template"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Letters that don't decompose into a base letter and an accent
+var fold_replacer = strings.NewReplacer("ß", "ss", "æ", "ae", "œ", "oe", "ø", "o", "ł", "l", "đ", "d", "ð", "d", "þ", "th", "ı", "i")
+
+// The form of s searches compare: lowercase and without accents, so "Müller",
+// "MULLER" and "muller" are all "muller"
+func fold(s string) string {
+
+	ascii := true
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return strings.ToLower(s)
+	}
+
+	// Decomposed, accents are separate combining marks we can drop
+	s = strings.Map(func(r rune) rune {
+		if unicode.Is(unicode.Mn, r) {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, norm.NFD.String(s))
+	return fold_replacer.Replace(norm.NFC.String(s))
+}
+
+// Words shorter than these are only matched as they are typed, fuzzy matching
+// them finds too much
+const (
+	sound_min_length = 3
+	typo_min_length  = 4
+)
+
+// Most edits a word of n characters may have to be a typo of a token
+func typo_max_edits(n int) int {
+
+	switch {
+	case n >= 8:
+		return 2
+	case n >= typo_min_length:
+		return 1
+	}
+	return 0
+}
+
+// The edit distance (counting a swap of two neighbours as one edit) between
+// word and token if it is small enough for word to be a typo of token, -1
+// otherwise
+func typo_distance(word, token string) int {
+
+	var d typo_table
+	return d.distance(word, token)
+}
+
+// What typo_distance works with, kept so one caller comparing a word against
+// many tokens allocates it only once
+type typo_table struct {
+	a, b []rune
+	// The last three rows of the table
+	rows [3][]int
+}
+
+func (d *typo_table) distance(word, token string) int {
+
+	d.a, d.b = d.a[:0], d.b[:0]
+	for _, r := range word {
+		d.a = append(d.a, r)
+	}
+	for _, r := range token {
+		d.b = append(d.b, r)
+	}
+	a, b := d.a, d.b
+	max_edits := typo_max_edits(len(a))
+	if max_edits == 0 || len(a)-len(b) > max_edits || len(b)-len(a) > max_edits {
+		return -1
+	}
+
+	for k := range d.rows {
+		d.rows[k] = slices.Grow(d.rows[k][:0], len(b)+1)[:len(b)+1]
+	}
+	// cur[j] is the distance between a[:i] and b[:j], prev and prev2 are the
+	// rows for i-1 and i-2
+	prev2, prev, cur := d.rows[0], d.rows[1], d.rows[2]
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		row_min := i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+			row_min = min(row_min, cur[j])
+		}
+		if row_min > max_edits {
+			return -1
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	if prev[len(b)] > max_edits {
+		return -1
+	}
+	return prev[len(b)]
+}
+
+// The distinct Double Metaphone codes of word
+func sound_codes(word string) []string {
+
+	primary, alternate := double_metaphone(word)
+	alternate = strings.TrimSpace(alternate)
+	switch {
+	case primary == "":
+		return nil
+	case alternate == "" || alternate == primary:
+		return []string{primary}
+	}
+	return []string{primary, alternate}
+}
+
+// Letters and digits make up words, everything else separates them
+func is_word_rune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// Where the words of s start and end
+func token_spans(s string) [][2]int {
+
+	var spans [][2]int
+	start := -1
+	for i, r := range s {
+		switch {
+		case is_word_rune(r) && start < 0:
+			start = i
+		case !is_word_rune(r) && start >= 0:
+			spans = append(spans, [2]int{start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		spans = append(spans, [2]int{start, len(s)})
+	}
+	return spans
+}
+
+// Text to highlight, folded the way queries compare so what they find can be
+// mapped back to the characters it came from
+type marked_text struct {
+	runes  []rune
+	folded string
+	// The index in runes of every byte of folded
+	source []int
+	marks  []bool
+}
+
+func new_marked_text(s string) *marked_text {
+
+	m := &marked_text{runes: []rune(s)}
+	m.marks = make([]bool, len(m.runes))
+	var b strings.Builder
+	for i, r := range m.runes {
+		f := fold(string(r))
+		b.WriteString(f)
+		for range len(f) {
+			m.source = append(m.source, i)
+		}
+	}
+	m.folded = b.String()
+	return m
+}
+
+// Mark the characters bytes start to end of folded come from
+func (m *marked_text) mark(start, end int) {
+
+	for _, i := range m.source[start:end] {
+		m.marks[i] = true
+	}
+}
+
+// Mark the characters with digits in the text's digits, and what is between
+// them
+func (m *marked_text) mark_digits(digits string) {
+
+	var positions []int
+	for i, r := range m.runes {
+		if r >= '0' && r <= '9' {
+			positions = append(positions, i)
+		}
+	}
+	all := normalize_phone(string(m.runes))
+	for i := 0; ; {
+		j := strings.Index(all[i:], digits)
+		if j < 0 {
+			return
+		}
+		i += j
+		for k := positions[i]; k <= positions[i+len(digits)-1]; k++ {
+			m.marks[k] = true
+		}
+		i += len(digits)
+	}
+}
+
+func (m *marked_text) html() template.HTML {
+
+	var b strings.Builder
+	for i := 0; i < len(m.runes); {
+		j := i
+		for j < len(m.runes) && m.marks[j] == m.marks[i] {
+			j++
+		}
+		text := template.HTMLEscapeString(string(m.runes[i:j]))
+		if m.marks[i] {
+			text = "<mark>" + text + "</mark>"
+		}
+		b.WriteString(text)
+		i = j
+	}
+	return template.HTML(b.String())
+}
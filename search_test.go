@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+func TestTypoDistance(t *testing.T) {
+
+	tests := []struct {
+		word, token string
+		want        int
+	}{
+		{"gross", "gross", 0},
+		// Substitution, deletion, insertion and a swap of neighbours
+		{"grass", "gross", 1},
+		{"gros", "gross", 1},
+		{"grosss", "gross", 1},
+		{"gorss", "gross", 1},
+		{"grsos", "gross", 1},
+		// One edit is all a word shorter than 8 gets
+		{"gorsss", "gross", -1},
+		{"katherin", "catherine", 2},
+		{"jonathan", "jonahtna", 2},
+		{"katherine", "kathryn", -1},
+		// Too short for typos at all
+		{"grs", "gross", -1},
+		{"abc", "abd", -1},
+		// Characters, not bytes
+		{"müller", "muller", 1},
+		{"grossmann", "grossmann", 0},
+		{"grossmann", "gross", -1},
+	}
+	// One table for all of them, as fuzzy_candidates uses it
+	var d typo_table
+	for _, tt := range tests {
+		if got := typo_distance(tt.word, tt.token); got != tt.want {
+			t.Errorf("typo_distance(%q, %q) = %d, want %d", tt.word, tt.token, got, tt.want)
+		}
+		if got := d.distance(tt.word, tt.token); got != tt.want {
+			t.Errorf("reused table distance(%q, %q) = %d, want %d", tt.word, tt.token, got, tt.want)
+		}
+	}
+}
+
+func TestFold(t *testing.T) {
+
+	tests := []struct{ s, want string }{
+		{"Müller", "muller"},
+		{"MULLER", "muller"},
+		{"Groß", "gross"},
+		{"Ærø", "aero"},
+		{"José", "jose"},
+	}
+	for _, tt := range tests {
+		if got := fold(tt.s); got != tt.want {
+			t.Errorf("fold(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
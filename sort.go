@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+)
+
+// The fields contact lists can be sorted by, in the order ties are broken
+var sort_fields = []string{"last", "first", "email", "phone"}
+
+// Languages names can be collated in, matched against Accept-Language
+var collation_matcher = language.NewMatcher(collate.Supported())
+
+type sort_key struct {
+	field string
+	desc  bool
+}
+
+// How to order a list of contacts: by the fields asked for, then the rest of
+// sort_fields ascending. Names are compared the way the user's language orders
+// them, so "Ärzte" comes before "Bauer" in German but after "Zahn" in Swedish.
+// Like its collator a SortOrder is used by one request at a time
+type SortOrder struct {
+	keys []sort_key
+	// How many of keys were asked for, the rest break ties
+	asked    int
+	lang     language.Tag
+	collator *collate.Collator
+}
+
+// Parse the sort and dir parameters. sort is a comma separated list of fields,
+// dir is asc or desc for each of them or a single one for all. An empty sort
+// gives a nil SortOrder, which leaves contacts in the order they come in
+func parse_sort(sort, dir string, lang language.Tag) (*SortOrder, error) {
+
+	if sort == "" {
+		return nil, nil
+	}
+	fields := strings.Split(sort, ",")
+	dirs := strings.Split(dir, ",")
+	if dir == "" {
+		dirs = []string{"asc"}
+	}
+	if len(dirs) != 1 && len(dirs) != len(fields) {
+		return nil, errors.New("dir needs one direction for every sort field or a single one")
+	}
+
+	o := &SortOrder{lang: lang, collator: collate.New(lang, collate.IgnoreCase)}
+	for i, field := range fields {
+		field = strings.TrimSpace(field)
+		if !slices.Contains(sort_fields, field) {
+			return nil, fmt.Errorf("cannot sort by %q, use %s", field, strings.Join(sort_fields, ", "))
+		}
+		if slices.ContainsFunc(o.keys, func(k sort_key) bool { return k.field == field }) {
+			return nil, fmt.Errorf("%s is in sort twice", field)
+		}
+		d := strings.TrimSpace(dirs[min(i, len(dirs)-1)])
+		if d != "asc" && d != "desc" {
+			return nil, fmt.Errorf("dir must be asc or desc, not %q", d)
+		}
+		o.keys = append(o.keys, sort_key{field, d == "desc"})
+	}
+	o.asked = len(o.keys)
+	for _, field := range sort_fields {
+		if !slices.ContainsFunc(o.keys, func(k sort_key) bool { return k.field == field }) {
+			o.keys = append(o.keys, sort_key{field, false})
+		}
+	}
+	return o, nil
+}
+
+// The language to collate names in for r
+func request_language(r *http.Request) language.Tag {
+
+	tag, _ := language.MatchStrings(collation_matcher, r.Header.Get("Accept-Language"))
+	return tag
+}
+
+// The field and direction asked for first, empty for a nil SortOrder
+func (o *SortOrder) Field() string {
+
+	if o == nil {
+		return ""
+	}
+	return o.keys[0].field
+}
+
+func (o *SortOrder) Dir() string {
+
+	if o == nil {
+		return ""
+	}
+	if o.keys[0].desc {
+		return "desc"
+	}
+	return "asc"
+}
+
+// Put the sort and dir parameters that give o in v
+func (o *SortOrder) set_params(v url.Values) {
+
+	if o == nil {
+		return
+	}
+	var fields, dirs []string
+	for _, key := range o.keys[:o.asked] {
+		fields = append(fields, key.field)
+		if key.desc {
+			dirs = append(dirs, "desc")
+		} else {
+			dirs = append(dirs, "asc")
+		}
+	}
+	v.Set("sort", strings.Join(fields, ","))
+	v.Set("dir", strings.Join(dirs, ","))
+}
+
+// Sort cs in place, keeping the order of contacts that compare equal.
+// Contacts without a field come after the ones with it in either direction
+func (o *SortOrder) sort(cs []Contact) {
+
+	// Comparing collation keys is much cheaper than collating the names
+	// every time two contacts are compared
+	var buf collate.Buffer
+	keys := make(map[int][][]byte, len(cs))
+	for _, c := range cs {
+		keys[c.ID] = o.sort_keys(&buf, c)
+	}
+
+	slices.SortStableFunc(cs, func(a, b Contact) int {
+		return o.compare_keys(keys[a.ID], keys[b.ID])
+	})
+}
+
+// What c is compared by for each of o's keys, they stay valid until buf is
+// reset
+func (o *SortOrder) sort_keys(buf *collate.Buffer, c Contact) [][]byte {
+
+	k := make([][]byte, len(o.keys))
+	for i, key := range o.keys {
+		k[i] = o.sort_value(buf, key.field, c)
+	}
+	return k
+}
+
+// Compare two contacts by their sort_keys
+func (o *SortOrder) compare_keys(ka, kb [][]byte) int {
+
+	for i, key := range o.keys {
+		switch {
+		case len(ka[i]) == 0 && len(kb[i]) == 0:
+			continue
+		case len(ka[i]) == 0:
+			return 1
+		case len(kb[i]) == 0:
+			return -1
+		}
+		n := bytes.Compare(ka[i], kb[i])
+		if key.desc {
+			n = -n
+		}
+		if n != 0 {
+			return n
+		}
+	}
+	return 0
+}
+
+// What field of c is compared by, empty when c doesn't have it
+func (o *SortOrder) sort_value(buf *collate.Buffer, field string, c Contact) []byte {
+
+	var s string
+	switch field {
+	case "first":
+		s = c.First
+	case "last":
+		s = c.Last
+	case "email":
+		return []byte(strings.ToLower(strings.TrimSpace(c.Email)))
+	case "phone":
+		// Numbers as they are dialled, however they are written
+		return []byte(normalize_phone(c.Phone))
+	}
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil
+	}
+	return o.collator.KeyFromString(buf, s)
+}
@@ -0,0 +1,744 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+var ErrNotFound = errors.New("contact not found")
+
+// Returned by Create and Update when another contact already has the email
+var ErrEmailTaken = errors.New("email already in use")
+
+// Returned by Update and Apply when the contact was changed since the version
+// the caller read
+var ErrVersionChanged = errors.New("contact was changed by someone else")
+
+// ContactStore is where handlers read and write contacts, so the HTTP code does
+// not depend on how (or whether) they are persisted. Implementations are safe
+// for concurrent use and return copies, a Contact obtained from a store is
+// never changed by later calls
+type ContactStore interface {
+	// Get returns the contact with the given id or ErrNotFound
+	Get(id int) (Contact, error)
+	// List returns up to limit contacts starting at offset, a negative limit
+	// returns every contact from offset on
+	List(offset, limit int) ([]Contact, error)
+	// Create assigns c a new id and version 1, stores it and returns the stored
+	// contact. The email must be unique, ErrEmailTaken otherwise
+	Create(c Contact) (Contact, error)
+	// Update replaces the contact with c.ID and increments its version, or
+	// returns ErrNotFound, or ErrEmailTaken when another contact has its email.
+	// Unless c.Version is 0 it must be the stored version, ErrVersionChanged
+	// otherwise
+	Update(c Contact) (Contact, error)
+	// Delete removes the contact with the given id or returns ErrNotFound
+	Delete(id int) error
+	Count() (int, error)
+	// FindByEmail returns the contact with the given email or ErrNotFound
+	FindByEmail(email string) (Contact, error)
+	// Search returns up to limit contacts, starting at offset, among those
+	// query matches, and how many it matches in all. They come in order, or
+	// best matches first when order is nil. A negative limit returns all of
+	// them
+	Search(query *Query, order *SortOrder, offset, limit int) ([]Contact, int, error)
+	// Matches calls f with every contact query matches and its score, in no
+	// particular order. c is the store's own, f clones it to keep it and must
+	// not call the store
+	Matches(query *Query, f func(c Contact, score int)) error
+	// Apply performs ops in order as a single change: either all of them
+	// succeed or the store is left untouched. Returns the stored contact for
+	// every op (a zero Contact for deletes), or an *OpError naming the op that
+	// failed with the same errors Create, Update and Delete return
+	Apply(ops []StoreOp) ([]Contact, error)
+}
+
+// One change in a ContactStore.Apply
+type StoreOp struct {
+	// OpCreate, OpUpdate or OpDelete
+	Kind string
+	// The contact to create or update, only its ID matters for deletes. Its
+	// Version is checked for updates and deletes, as Update does
+	Contact Contact
+}
+
+const (
+	OpCreate = "create"
+	OpUpdate = "update"
+	OpDelete = "delete"
+)
+
+// Returned by Apply, Index is the position of the op that failed
+type OpError struct {
+	Index int
+	Err   error
+}
+
+func (e *OpError) Error() string {
+	return fmt.Sprintf("op %d: %v", e.Index, e.Err)
+}
+
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+// Select a store by name, this is what the -store flag accepts
+func open_store(kind string, contacts_path string, db_path string) (ContactStore, error) {
+
+	switch kind {
+	case "memory":
+		f, err := read_contacts_file(contacts_path)
+		if err != nil {
+			return nil, fmt.Errorf("open_store: %w", err)
+		}
+		s := newMemoryStore(f.Contacts)
+		s.last_id = f.LastID
+		return s, nil
+	case "json":
+		return newJSONStore(contacts_path)
+	case "sqlite":
+		return newSQLStore(db_path, contacts_path)
+	}
+	return nil, fmt.Errorf("open_store: error, unknown store %q", kind)
+}
+
+//------------------------------------------------------------------------------
+// Memory store
+//------------------------------------------------------------------------------
+
+// MemoryStore keeps contacts in a slice, in insertion order
+type MemoryStore struct {
+	mu       sync.RWMutex
+	contacts []Contact
+	// Position of every contact in contacts by id
+	pos map[int]int
+	ix  *search_index
+	// Highest id ever given out. Ids are never reused, so a deleted
+	// contact's id and version (its ETag) never name another contact
+	last_id int
+
+	// Called with the new contact list and last_id before they replace the
+	// current ones, a non nil error aborts the change. Nil for a purely
+	// in-memory store
+	persist func(next []Contact, last_id int) error
+}
+
+func newMemoryStore(cs []Contact) *MemoryStore {
+
+	s := &MemoryStore{contacts: first_versions(cs), last_id: max_id(cs)}
+	s.build_index()
+	return s
+}
+
+func (s *MemoryStore) Get(id int) (Contact, error) {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	i := s.index(id)
+	if i < 0 {
+		return Contact{}, ErrNotFound
+	}
+	return clone_contact(s.contacts[i]), nil
+}
+
+func (s *MemoryStore) List(offset, limit int) ([]Contact, error) {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if offset < 0 {
+		offset = 0
+	}
+	if offset >= len(s.contacts) {
+		return nil, nil
+	}
+	end := len(s.contacts)
+	if limit >= 0 && offset+limit < end {
+		end = offset + limit
+	}
+	return clone_contacts(s.contacts[offset:end]), nil
+}
+
+func (s *MemoryStore) Create(c Contact) (Contact, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.email_taken(-1, c.Email) {
+		return Contact{}, ErrEmailTaken
+	}
+
+	c = clone_contact(c)
+	c.ID = s.last_id + 1
+	c.Version = 1
+
+	err := s.commit(func(cs []Contact) []Contact { return append(cs, c) }, c.ID, nil, []Contact{c})
+	if err != nil {
+		return Contact{}, err
+	}
+	return clone_contact(c), nil
+}
+
+func (s *MemoryStore) Update(c Contact) (Contact, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.index(c.ID)
+	if i < 0 {
+		return Contact{}, ErrNotFound
+	}
+	if s.email_taken(c.ID, c.Email) {
+		return Contact{}, ErrEmailTaken
+	}
+	version, err := next_version(s.contacts[i], c.Version)
+	if err != nil {
+		return Contact{}, err
+	}
+
+	c = clone_contact(c)
+	c.Version = version
+
+	err = s.commit(func(cs []Contact) []Contact { cs[i] = c; return cs }, s.last_id, []Contact{s.contacts[i]}, []Contact{c})
+	if err != nil {
+		return Contact{}, err
+	}
+	return clone_contact(c), nil
+}
+
+func (s *MemoryStore) Delete(id int) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.index(id)
+	if i < 0 {
+		return ErrNotFound
+	}
+	return s.commit(func(cs []Contact) []Contact { return slices.Delete(cs, i, i+1) }, s.last_id, []Contact{s.contacts[i]}, nil)
+}
+
+func (s *MemoryStore) Count() (int, error) {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.contacts), nil
+}
+
+func (s *MemoryStore) FindByEmail(email string) (Contact, error) {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	id := s.ix.email_owner(-1, email)
+	if id < 0 {
+		return Contact{}, ErrNotFound
+	}
+	return clone_contact(s.contacts[s.pos[id]]), nil
+}
+
+func (s *MemoryStore) Search(query *Query, order *SortOrder, offset, limit int) ([]Contact, int, error) {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// Only the contacts the index can't rule out are matched, in the order
+	// they are stored
+	contacts := s.contacts
+	if ids := query.candidates(s.ix); ids != nil {
+		positions := make([]int, 0, len(ids))
+		for id := range ids {
+			positions = append(positions, s.pos[id])
+		}
+		slices.Sort(positions)
+		contacts = make([]Contact, len(positions))
+		for i, p := range positions {
+			contacts[i] = s.contacts[p]
+		}
+	}
+
+	found, total := query.rank(contacts, order, offset, limit)
+	return clone_contacts(found), total, nil
+}
+
+func (s *MemoryStore) Matches(query *Query, f func(c Contact, score int)) error {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	match := func(c Contact) {
+		if score := query.Score(c); score > 0 {
+			f(c, score)
+		}
+	}
+	ids := query.candidates(s.ix)
+	if ids == nil {
+		for _, c := range s.contacts {
+			match(c)
+		}
+		return nil
+	}
+	for id := range ids {
+		match(s.contacts[s.pos[id]])
+	}
+	return nil
+}
+
+func (s *MemoryStore) Apply(ops []StoreOp) ([]Contact, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Every op sees the result of the ones before it. Only the contacts they
+	// touch are staged, the rest are looked up through the index
+	b := s.new_batch()
+	out := make([]Contact, len(ops))
+	for i, op := range ops {
+		c := clone_contact(op.Contact)
+		switch op.Kind {
+		case OpCreate:
+			if b.email_owner(-1, c.Email) >= 0 {
+				return nil, &OpError{i, ErrEmailTaken}
+			}
+			b.last_id++
+			c.ID = b.last_id
+			c.Version = 1
+			b.put(c)
+			b.created = append(b.created, c.ID)
+			out[i] = clone_contact(c)
+		case OpUpdate:
+			stored, ok := b.get(c.ID)
+			if !ok {
+				return nil, &OpError{i, ErrNotFound}
+			}
+			if b.email_owner(c.ID, c.Email) >= 0 {
+				return nil, &OpError{i, ErrEmailTaken}
+			}
+			version, err := next_version(stored, c.Version)
+			if err != nil {
+				return nil, &OpError{i, err}
+			}
+			c.Version = version
+			b.put(c)
+			out[i] = clone_contact(c)
+		case OpDelete:
+			stored, ok := b.get(c.ID)
+			if !ok {
+				return nil, &OpError{i, ErrNotFound}
+			}
+			_, err := next_version(stored, c.Version)
+			if err != nil {
+				return nil, &OpError{i, err}
+			}
+			b.delete(c.ID)
+		default:
+			return nil, &OpError{i, fmt.Errorf("unknown op %q", op.Kind)}
+		}
+	}
+
+	removed, added := b.changes()
+	err := s.commit(b.apply, b.last_id, removed, added)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// The contacts an Apply changed so far, over those of the store
+type store_batch struct {
+	s *MemoryStore
+	// By id, the contacts as the ops left them. Deleted ones are in deleted
+	staged  map[int]Contact
+	deleted map[int]bool
+	// Ids of the contacts created, in order
+	created []int
+	// Emails the ops gave to a contact or took from one (-1), they are no
+	// longer where the index has them
+	emails  map[string]int
+	last_id int
+}
+
+func (s *MemoryStore) new_batch() *store_batch {
+	return &store_batch{s: s, staged: make(map[int]Contact), deleted: make(map[int]bool), emails: make(map[string]int), last_id: s.last_id}
+}
+
+func (b *store_batch) get(id int) (Contact, bool) {
+
+	if b.deleted[id] {
+		return Contact{}, false
+	}
+	if c, ok := b.staged[id]; ok {
+		return c, true
+	}
+	i := b.s.index(id)
+	if i < 0 {
+		return Contact{}, false
+	}
+	return b.s.contacts[i], true
+}
+
+// The id of the contact other than id with email, or -1
+func (b *store_batch) email_owner(id int, email string) int {
+
+	owner, ok := b.emails[email]
+	if !ok {
+		return b.s.ix.email_owner(id, email)
+	}
+	if owner == id {
+		return -1
+	}
+	return owner
+}
+
+func (b *store_batch) put(c Contact) {
+
+	if old, ok := b.get(c.ID); ok && old.Email != c.Email {
+		b.emails[old.Email] = -1
+	}
+	b.emails[c.Email] = c.ID
+	b.staged[c.ID] = c
+}
+
+func (b *store_batch) delete(id int) {
+
+	if old, ok := b.get(id); ok {
+		b.emails[old.Email] = -1
+	}
+	b.deleted[id] = true
+}
+
+// The contacts the batch takes out, as they are stored, and puts in
+func (b *store_batch) changes() (removed, added []Contact) {
+
+	for id := range b.deleted {
+		if i := b.s.index(id); i >= 0 {
+			removed = append(removed, b.s.contacts[i])
+		}
+	}
+	for id, c := range b.staged {
+		if b.deleted[id] {
+			continue
+		}
+		if i := b.s.index(id); i >= 0 {
+			removed = append(removed, b.s.contacts[i])
+		}
+		added = append(added, c)
+	}
+	return removed, added
+}
+
+// Make the batch's changes to cs, the store's contacts or a copy of them
+func (b *store_batch) apply(cs []Contact) []Contact {
+
+	for id, c := range b.staged {
+		if i := b.s.index(id); i >= 0 {
+			cs[i] = c
+		}
+	}
+	if len(b.deleted) > 0 {
+		cs = slices.DeleteFunc(cs, func(c Contact) bool { return b.deleted[c.ID] })
+	}
+	for _, id := range b.created {
+		if !b.deleted[id] {
+			cs = append(cs, b.staged[id])
+		}
+	}
+	return cs
+}
+
+// The helpers below expect s.mu to be held by the caller
+
+func (s *MemoryStore) index(id int) int {
+
+	i, ok := s.pos[id]
+	if !ok {
+		return -1
+	}
+	return i
+}
+
+func (s *MemoryStore) email_taken(id int, email string) bool {
+	return s.ix.email_owner(id, email) >= 0
+}
+
+func max_id(cs []Contact) int {
+
+	id := 0
+	for _, c := range cs {
+		id = max(id, c.ID)
+	}
+	return id
+}
+
+// The version stored gets when it is changed by a caller that read version,
+// 0 when the caller does not care which one it read
+func next_version(stored Contact, version int) (int, error) {
+
+	if version != 0 && version != stored.Version {
+		return 0, ErrVersionChanged
+	}
+	return stored.Version + 1, nil
+}
+
+// Contacts saved before they had versions are at version 1
+func first_versions(cs []Contact) []Contact {
+
+	for i := range cs {
+		if cs[i].Version == 0 {
+			cs[i].Version = 1
+		}
+	}
+	return cs
+}
+
+// Make a change with edit, which changes the contacts it is given and returns
+// them. A store that persists first gets a copy to edit and save, so s is left
+// as it was when that fails, in memory the change is made in place without
+// copying every contact. Slices of s.contacts never leave the lock. removed
+// and added are the contacts the change takes out and puts in, for the index
+func (s *MemoryStore) commit(edit func([]Contact) []Contact, last_id int, removed, added []Contact) error {
+
+	if s.persist != nil {
+		err := s.persist(edit(slices.Clone(s.contacts)), last_id)
+		if err != nil {
+			return err
+		}
+	}
+	s.contacts = edit(s.contacts)
+	s.last_id = last_id
+	s.update_index(removed, added)
+	return nil
+}
+
+func (s *MemoryStore) build_index() {
+
+	s.ix = new_search_index(s.contacts)
+	s.pos = make(map[int]int, len(s.contacts))
+	for i, c := range s.contacts {
+		s.pos[c.ID] = i
+	}
+}
+
+// Bring the index up to date after the contacts in removed (as they were) were
+// replaced by the ones in added. Unless so many changed that building it anew is
+// cheaper only those are reindexed
+func (s *MemoryStore) update_index(removed, added []Contact) {
+
+	if len(removed)+len(added) > len(s.contacts)/8+16 {
+		s.build_index()
+		return
+	}
+	kept := make(map[int]bool, len(added))
+	for _, c := range added {
+		kept[c.ID] = true
+	}
+	moved := false
+	for _, c := range removed {
+		s.ix.remove(c)
+		moved = moved || !kept[c.ID]
+	}
+	for _, c := range added {
+		s.ix.add(c)
+	}
+
+	// Updates stay in place and creates are appended, only deletes move the
+	// contacts after them
+	if moved {
+		clear(s.pos)
+		for i, c := range s.contacts {
+			s.pos[c.ID] = i
+		}
+		return
+	}
+	for i := len(s.contacts) - 1; i >= 0; i-- {
+		if _, ok := s.pos[s.contacts[i].ID]; ok {
+			break
+		}
+		s.pos[s.contacts[i].ID] = i
+	}
+}
+
+// Contacts are values except for their Errors map, give callers their own
+func clone_contact(c Contact) Contact {
+
+	c.Errors = maps.Clone(c.Errors)
+	if c.Errors == nil {
+		c.Errors = make(map[string]string)
+	}
+	return c
+}
+
+func clone_contacts(cs []Contact) []Contact {
+
+	out := make([]Contact, len(cs))
+	for i, c := range cs {
+		out[i] = clone_contact(c)
+	}
+	return out
+}
+
+//------------------------------------------------------------------------------
+// JSON file store
+//------------------------------------------------------------------------------
+
+// JSONStore is a MemoryStore that writes every change back to a JSON file
+// before making it visible
+type JSONStore struct {
+	MemoryStore
+	path string
+}
+
+func newJSONStore(path string) (*JSONStore, error) {
+
+	// A crash in the middle of write_file_atomic can leave its temporary file
+	// behind, the contacts file itself is always either the old or the new
+	// version
+	leftovers, _ := filepath.Glob(path + ".tmp-*")
+	for _, f := range leftovers {
+		os.Remove(f)
+	}
+
+	f, err := read_contacts_file(path)
+	if err != nil {
+		return nil, fmt.Errorf("newJSONStore: %w", err)
+	}
+
+	s := &JSONStore{MemoryStore: MemoryStore{contacts: f.Contacts, last_id: f.LastID}, path: path}
+	s.build_index()
+	s.persist = s.save
+	return s, nil
+}
+
+func (s *JSONStore) save(next []Contact, last_id int) error {
+
+	data, err := json.MarshalIndent(contacts_file{LastID: last_id, Contacts: next}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("JSONStore.save: error in json.MarshalIndent: %w", err)
+	}
+
+	err = write_file_atomic(s.path, data, 0644)
+	if err != nil {
+		return fmt.Errorf("JSONStore.save: %w", err)
+	}
+	return nil
+}
+
+// A contacts file as the JSON store writes it. LastID is the highest id ever
+// given out, so the ids of deleted contacts are not given out again after a
+// restart. A file holding just the array of contacts is read too
+type contacts_file struct {
+	LastID   int       `json:"last_id"`
+	Contacts []Contact `json:"contacts"`
+}
+
+func read_contacts_file(path string) (contacts_file, error) {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return contacts_file{}, fmt.Errorf("read_contacts_file: error in os.ReadFile: %w", err)
+	}
+
+	var f contacts_file
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		err = json.Unmarshal(data, &f.Contacts)
+	} else {
+		err = json.Unmarshal(data, &f)
+	}
+	if err != nil {
+		return contacts_file{}, fmt.Errorf("read_contacts_file: error in json.Unmarshal: %w", err)
+	}
+	err = check_contacts(f.Contacts)
+	if err != nil {
+		return contacts_file{}, fmt.Errorf("read_contacts_file: %s: %w", path, err)
+	}
+
+	f.Contacts = first_versions(f.Contacts)
+	f.LastID = max(f.LastID, max_id(f.Contacts))
+	return f, nil
+}
+
+// Contacts read from a file must fit every store: the SQLite one can't take
+// two contacts with the same id or email, so none of them do
+func check_contacts(cs []Contact) error {
+
+	ids := make(map[int]bool, len(cs))
+	emails := make(map[string]int, len(cs))
+	for _, c := range cs {
+		if ids[c.ID] {
+			return fmt.Errorf("check_contacts: error, two contacts have id %d", c.ID)
+		}
+		ids[c.ID] = true
+		if other, ok := emails[c.Email]; ok {
+			return fmt.Errorf("check_contacts: error, contacts %d and %d both have email %q", other, c.ID, c.Email)
+		}
+		emails[c.Email] = c.ID
+	}
+	return nil
+}
+
+// Write data to a temporary file in the same directory, fsync it and rename it
+// over path. Readers (and a restarted server) see either the old or the new
+// content, never a partially written file. An error means path still has the
+// old content
+func write_file_atomic(path string, data []byte, perm os.FileMode) error {
+
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("write_file_atomic: error in os.CreateTemp: %w", err)
+	}
+	// Only does something if we fail before the rename
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("write_file_atomic: error in tmp.Write: %w", err)
+	}
+	err = tmp.Sync()
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("write_file_atomic: error in tmp.Sync: %w", err)
+	}
+	err = tmp.Close()
+	if err != nil {
+		return fmt.Errorf("write_file_atomic: error in tmp.Close: %w", err)
+	}
+	err = os.Chmod(tmp.Name(), perm)
+	if err != nil {
+		return fmt.Errorf("write_file_atomic: error in os.Chmod: %w", err)
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return fmt.Errorf("write_file_atomic: error in os.Rename: %w", err)
+	}
+
+	// Make the rename itself durable. Past the rename the new content is what
+	// everyone reads, failing now would have the caller believe it is not
+	err = sync_dir(dir)
+	if err != nil {
+		log.Warn("write_file_atomic: the rename may not survive a crash", "path", path, "error", err)
+	}
+	return nil
+}
+
+// fsync the directory dir, a variable so tests can make it fail
+var sync_dir = func(dir string) error {
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("sync_dir: error in os.Open: %w", err)
+	}
+	defer d.Close()
+	return d.Sync()
+}
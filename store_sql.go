@@ -0,0 +1,392 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+// SQLStore keeps contacts in an embedded SQLite database (pure Go driver, no
+// cgo needed)
+type SQLStore struct {
+	db *sql.DB
+}
+
+const sql_schema = `
+CREATE TABLE IF NOT EXISTS contacts (
+	id    INTEGER PRIMARY KEY AUTOINCREMENT,
+	first TEXT NOT NULL DEFAULT '',
+	last  TEXT NOT NULL DEFAULT '',
+	email TEXT NOT NULL DEFAULT '',
+	phone TEXT NOT NULL DEFAULT '',
+	version INTEGER NOT NULL DEFAULT 1
+);
+CREATE UNIQUE INDEX IF NOT EXISTS contacts_email ON contacts (email)`
+
+// Open (or create) the database at path. A new, empty database is seeded with
+// the contacts in seed_path so switching backends does not lose the demo data
+func newSQLStore(path string, seed_path string) (*SQLStore, error) {
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("newSQLStore: error in sql.Open: %w", err)
+	}
+	// SQLite allows a single writer, serialize in database/sql instead of
+	// getting SQLITE_BUSY back
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(sql_schema)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("newSQLStore: error creating schema: %w", err)
+	}
+	err = add_version_column(db)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("newSQLStore: %w", err)
+	}
+
+	s := &SQLStore{db: db}
+
+	n, err := s.Count()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("newSQLStore: %w", err)
+	}
+	if n == 0 && seed_path != "" {
+		err = s.seed(seed_path)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("newSQLStore: %w", err)
+		}
+	}
+
+	return s, nil
+}
+
+// Databases created before contacts had versions lack the column, their
+// contacts start at version 1
+func add_version_column(db *sql.DB) error {
+
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('contacts') WHERE name = 'version'`).Scan(&n)
+	if err != nil {
+		return fmt.Errorf("add_version_column: error in db.QueryRow: %w", err)
+	}
+	if n > 0 {
+		return nil
+	}
+	_, err = db.Exec(`ALTER TABLE contacts ADD COLUMN version INTEGER NOT NULL DEFAULT 1`)
+	if err != nil {
+		return fmt.Errorf("add_version_column: error in db.Exec: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLStore) seed(path string) error {
+
+	f, err := read_contacts_file(path)
+	if err != nil {
+		return fmt.Errorf("SQLStore.seed: %w", err)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("SQLStore.seed: error in db.Begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, c := range f.Contacts {
+		_, err = tx.Exec(`INSERT INTO contacts (id, first, last, email, phone, version) VALUES (?, ?, ?, ?, ?, ?)`,
+			c.ID, c.First, c.Last, c.Email, c.Phone, c.Version)
+		if err != nil {
+			return fmt.Errorf("SQLStore.seed: error inserting contact %d: %w", c.ID, err)
+		}
+	}
+
+	// AUTOINCREMENT goes on after the highest id the file ever gave out, not
+	// just the highest one it still has
+	if f.LastID > 0 {
+		_, err = tx.Exec(`DELETE FROM sqlite_sequence WHERE name = 'contacts'`)
+		if err != nil {
+			return fmt.Errorf("SQLStore.seed: error in DELETE FROM sqlite_sequence: %w", err)
+		}
+		_, err = tx.Exec(`INSERT INTO sqlite_sequence (name, seq) VALUES ('contacts', ?)`, f.LastID)
+		if err != nil {
+			return fmt.Errorf("SQLStore.seed: error in INSERT INTO sqlite_sequence: %w", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("SQLStore.seed: error in tx.Commit: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLStore) Get(id int) (Contact, error) {
+
+	row := s.db.QueryRow(`SELECT id, first, last, email, phone, version FROM contacts WHERE id = ?`, id)
+	c, err := scan_contact(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Contact{}, ErrNotFound
+	}
+	if err != nil {
+		return Contact{}, fmt.Errorf("SQLStore.Get: %w", err)
+	}
+	return c, nil
+}
+
+func (s *SQLStore) List(offset, limit int) ([]Contact, error) {
+
+	if offset < 0 {
+		offset = 0
+	}
+	// LIMIT -1 means no limit in SQLite
+	if limit < 0 {
+		limit = -1
+	}
+	rows, err := s.db.Query(`SELECT id, first, last, email, phone, version FROM contacts ORDER BY id LIMIT ? OFFSET ?`,
+		limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("SQLStore.List: error in db.Query: %w", err)
+	}
+	return scan_contacts(rows)
+}
+
+func (s *SQLStore) Create(c Contact) (Contact, error) {
+
+	res, err := s.db.Exec(`INSERT INTO contacts (first, last, email, phone) VALUES (?, ?, ?, ?)`,
+		c.First, c.Last, c.Email, c.Phone)
+	if is_unique_violation(err) {
+		return Contact{}, ErrEmailTaken
+	}
+	if err != nil {
+		return Contact{}, fmt.Errorf("SQLStore.Create: error in db.Exec: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Contact{}, fmt.Errorf("SQLStore.Create: error in res.LastInsertId: %w", err)
+	}
+	c.ID = int(id)
+	c.Version = 1
+	return clone_contact(c), nil
+}
+
+func (s *SQLStore) Update(c Contact) (Contact, error) {
+
+	version, err := update_contact(s.db, c)
+	if err != nil {
+		return Contact{}, err
+	}
+	c.Version = version
+	return clone_contact(c), nil
+}
+
+func (s *SQLStore) Delete(id int) error {
+
+	res, err := s.db.Exec(`DELETE FROM contacts WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("SQLStore.Delete: error in db.Exec: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("SQLStore.Delete: error in res.RowsAffected: %w", err)
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLStore) Count() (int, error) {
+
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM contacts`).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("SQLStore.Count: %w", err)
+	}
+	return n, nil
+}
+
+func (s *SQLStore) FindByEmail(email string) (Contact, error) {
+
+	row := s.db.QueryRow(`SELECT id, first, last, email, phone, version FROM contacts WHERE email = ? LIMIT 1`, email)
+	c, err := scan_contact(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Contact{}, ErrNotFound
+	}
+	if err != nil {
+		return Contact{}, fmt.Errorf("SQLStore.FindByEmail: %w", err)
+	}
+	return c, nil
+}
+
+// The query and the collation run in Go, so every contact is read
+func (s *SQLStore) Search(query *Query, order *SortOrder, offset, limit int) ([]Contact, int, error) {
+
+	cs, err := s.List(0, -1)
+	if err != nil {
+		return nil, 0, fmt.Errorf("SQLStore.Search: %w", err)
+	}
+	found, total := query.rank(cs, order, offset, limit)
+	return found, total, nil
+}
+
+func (s *SQLStore) Matches(query *Query, f func(c Contact, score int)) error {
+
+	cs, err := s.List(0, -1)
+	if err != nil {
+		return fmt.Errorf("SQLStore.Matches: %w", err)
+	}
+	for _, c := range cs {
+		if score := query.Score(c); score > 0 {
+			f(c, score)
+		}
+	}
+	return nil
+}
+
+func (s *SQLStore) Apply(ops []StoreOp) ([]Contact, error) {
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("SQLStore.Apply: error in db.Begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	out := make([]Contact, len(ops))
+	for i, op := range ops {
+		c := op.Contact
+		var res sql.Result
+		switch op.Kind {
+		case OpCreate:
+			res, err = tx.Exec(`INSERT INTO contacts (first, last, email, phone) VALUES (?, ?, ?, ?)`,
+				c.First, c.Last, c.Email, c.Phone)
+		case OpUpdate:
+			c.Version, err = update_contact(tx, c)
+			if err != nil {
+				return nil, &OpError{i, err}
+			}
+			out[i] = clone_contact(c)
+			continue
+		case OpDelete:
+			res, err = tx.Exec(`DELETE FROM contacts WHERE id = ? AND (? = 0 OR version = ?)`, c.ID, c.Version, c.Version)
+		default:
+			return nil, &OpError{i, fmt.Errorf("unknown op %q", op.Kind)}
+		}
+		if is_unique_violation(err) {
+			return nil, &OpError{i, ErrEmailTaken}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("SQLStore.Apply: error in tx.Exec (op %d): %w", i, err)
+		}
+
+		if op.Kind == OpCreate {
+			id, err := res.LastInsertId()
+			if err != nil {
+				return nil, fmt.Errorf("SQLStore.Apply: error in res.LastInsertId: %w", err)
+			}
+			c.ID = int(id)
+			c.Version = 1
+			out[i] = clone_contact(c)
+		} else {
+			n, err := res.RowsAffected()
+			if err != nil {
+				return nil, fmt.Errorf("SQLStore.Apply: error in res.RowsAffected: %w", err)
+			}
+			if n == 0 {
+				return nil, &OpError{i, missing_or_changed(tx, c.ID)}
+			}
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("SQLStore.Apply: error in tx.Commit: %w", err)
+	}
+	return out, nil
+}
+
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
+
+// Either a *sql.DB or a *sql.Tx
+type sql_querier interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// Store c over the contact with its id, checking its version as
+// ContactStore.Update does. Returns the version it is stored with
+func update_contact(q sql_querier, c Contact) (int, error) {
+
+	var version int
+	err := q.QueryRow(`UPDATE contacts SET first = ?, last = ?, email = ?, phone = ?, version = version + 1
+		WHERE id = ? AND (? = 0 OR version = ?) RETURNING version`,
+		c.First, c.Last, c.Email, c.Phone, c.ID, c.Version, c.Version).Scan(&version)
+	if is_unique_violation(err) {
+		return 0, ErrEmailTaken
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, missing_or_changed(q, c.ID)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("update_contact: error in QueryRow: %w", err)
+	}
+	return version, nil
+}
+
+// Why a change to the contact with id matched no row: ErrNotFound when it is
+// not there, ErrVersionChanged when it is at another version
+func missing_or_changed(q sql_querier, id int) error {
+
+	var n int
+	err := q.QueryRow(`SELECT COUNT(*) FROM contacts WHERE id = ?`, id).Scan(&n)
+	if err != nil {
+		return fmt.Errorf("missing_or_changed: error in QueryRow: %w", err)
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return ErrVersionChanged
+}
+
+// The contacts_email index rejects a duplicate email. Matching on the message
+// keeps us independent of the driver's error types
+func is_unique_violation(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
+
+type row_scanner interface {
+	Scan(dest ...any) error
+}
+
+func scan_contact(row row_scanner) (Contact, error) {
+
+	c := Contact{Errors: make(map[string]string)}
+	err := row.Scan(&c.ID, &c.First, &c.Last, &c.Email, &c.Phone, &c.Version)
+	return c, err
+}
+
+func scan_contacts(rows *sql.Rows) ([]Contact, error) {
+
+	defer rows.Close()
+
+	var cs []Contact
+	for rows.Next() {
+		c, err := scan_contact(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan_contacts: error in rows.Scan: %w", err)
+		}
+		cs = append(cs, c)
+	}
+	err := rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("scan_contacts: error in rows.Err: %w", err)
+	}
+	return cs, nil
+}
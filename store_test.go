@@ -0,0 +1,419 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Every store, each on its own file under a temporary directory
+func test_stores(t *testing.T) map[string]ContactStore {
+
+	dir := t.TempDir()
+	json_path := filepath.Join(dir, "contacts.json")
+	err := os.WriteFile(json_path, []byte("[]"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	js, err := newJSONStore(json_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, err := newSQLStore(filepath.Join(dir, "contacts.db"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ss.Close() })
+	return map[string]ContactStore{"memory": newMemoryStore(nil), "json": js, "sqlite": ss}
+}
+
+// Create, edit, delete, list and search from many goroutines at once, go test
+// -race checks the stores are synchronized
+func TestStoreConcurrent(t *testing.T) {
+
+	const workers = 8
+	const rounds = 20
+
+	for name, s := range test_stores(t) {
+		t.Run(name, func(t *testing.T) {
+			query, err := parse_query("worker")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var wg sync.WaitGroup
+			errs := make(chan error, workers)
+			for w := range workers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := range rounds {
+						email := fmt.Sprintf("w%d-%d@example.com", w, i)
+						c, err := s.Create(Contact{First: "Worker", Last: fmt.Sprint(w), Email: email, Phone: "1"})
+						if err != nil {
+							errs <- fmt.Errorf("Create: %w", err)
+							return
+						}
+						c.Phone = "2"
+						_, err = s.Update(c)
+						if err != nil {
+							errs <- fmt.Errorf("Update: %w", err)
+							return
+						}
+						// Every other contact goes again
+						if i%2 == 0 {
+							err = s.Delete(c.ID)
+							if err != nil {
+								errs <- fmt.Errorf("Delete: %w", err)
+								return
+							}
+						}
+						_, err = s.List(0, -1)
+						if err != nil {
+							errs <- fmt.Errorf("List: %w", err)
+							return
+						}
+						_, _, err = s.Search(query, nil, 0, 10)
+						if err != nil {
+							errs <- fmt.Errorf("Search: %w", err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Error(err)
+			}
+
+			cs, err := s.List(0, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n, err := s.Count()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != len(cs) || n != workers*rounds/2 {
+				t.Errorf("Count %d and List %d, want %d", n, len(cs), workers*rounds/2)
+			}
+			ids := make(map[int]bool)
+			for _, c := range cs {
+				if ids[c.ID] {
+					t.Errorf("id %d is listed twice", c.ID)
+				}
+				ids[c.ID] = true
+				if c.Phone != "2" || c.Version != 2 {
+					t.Errorf("contact %d lost its update: %+v", c.ID, c)
+				}
+			}
+
+			if js, ok := s.(*JSONStore); ok {
+				reloaded, err := read_contacts_file(js.path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !same_contacts(cs, reloaded.Contacts) {
+					t.Errorf("the file has %d contacts, not the %d listed", len(reloaded.Contacts), len(cs))
+				}
+			}
+		})
+	}
+}
+
+func same_contacts(a, b []Contact) bool {
+
+	key := func(c Contact) string {
+		return fmt.Sprint(c.ID, c.First, c.Last, c.Email, c.Phone, c.Version)
+	}
+	ka := make([]string, len(a))
+	for i, c := range a {
+		ka[i] = key(c)
+	}
+	kb := make([]string, len(b))
+	for i, c := range b {
+		kb[i] = key(c)
+	}
+	slices.Sort(ka)
+	slices.Sort(kb)
+	return slices.Equal(ka, kb)
+}
+
+func TestStoreVersions(t *testing.T) {
+
+	for name, s := range test_stores(t) {
+		t.Run(name, func(t *testing.T) {
+			c, err := s.Create(Contact{First: "Ann", Last: "Lee", Email: "ann@example.com", Phone: "1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = s.Update(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// c is at version 1 still
+			_, err = s.Update(c)
+			if !errors.Is(err, ErrVersionChanged) {
+				t.Errorf("Update of a stale version: %v, want ErrVersionChanged", err)
+			}
+			_, err = s.Apply([]StoreOp{{OpDelete, c}})
+			if !errors.Is(err, ErrVersionChanged) {
+				t.Errorf("delete of a stale version: %v, want ErrVersionChanged", err)
+			}
+		})
+	}
+}
+
+// Every op of an Apply sees the ones before it, also contacts it created and
+// emails it freed, and a failing op leaves the store as it was
+func TestStoreApply(t *testing.T) {
+
+	for name, s := range test_stores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, email := range []string{"a@example.com", "b@example.com"} {
+				_, err := s.Create(Contact{First: "X", Last: "Y", Email: email, Phone: "1"})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			// 1 and 2 swap emails through a third one, which is free again
+			// for a new contact
+			_, err := s.Apply([]StoreOp{
+				{OpUpdate, Contact{ID: 1, First: "X", Last: "Y", Email: "tmp@example.com", Phone: "1"}},
+				{OpUpdate, Contact{ID: 2, First: "X", Last: "Y", Email: "a@example.com", Phone: "1"}},
+				{OpUpdate, Contact{ID: 1, First: "X", Last: "Y", Email: "b@example.com", Phone: "1"}},
+				{OpCreate, Contact{First: "Z", Last: "Y", Email: "tmp@example.com", Phone: "1"}},
+				{OpUpdate, Contact{ID: 3, Version: 1, First: "Z", Last: "Y", Email: "tmp@example.com", Phone: "9"}},
+				{OpDelete, Contact{ID: 2}},
+				{OpCreate, Contact{First: "W", Last: "Y", Email: "a@example.com", Phone: "1"}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]Contact{
+				"b@example.com":   {ID: 1, Version: 3, Phone: "1"},
+				"tmp@example.com": {ID: 3, Version: 2, Phone: "9"},
+				"a@example.com":   {ID: 4, Version: 1, Phone: "1"},
+			}
+			check := func() {
+				t.Helper()
+				for email, w := range want {
+					c, err := s.FindByEmail(email)
+					if err != nil || c.ID != w.ID || c.Version != w.Version || c.Phone != w.Phone {
+						t.Errorf("%s has %+v, %v, want %+v", email, c, err, w)
+					}
+				}
+				if n, _ := s.Count(); n != len(want) {
+					t.Errorf("%d contacts, want %d", n, len(want))
+				}
+			}
+			check()
+
+			_, err = s.Apply([]StoreOp{
+				{OpCreate, Contact{First: "V", Last: "Y", Email: "v@example.com", Phone: "1"}},
+				{OpUpdate, Contact{ID: 1, First: "X", Last: "Y", Email: "tmp@example.com", Phone: "1"}},
+			})
+			var oe *OpError
+			if !errors.As(err, &oe) || oe.Index != 1 || !errors.Is(err, ErrEmailTaken) {
+				t.Errorf("Apply taking an email: %v, want ErrEmailTaken at op 1", err)
+			}
+			check()
+			if _, err := s.FindByEmail("v@example.com"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("the create of a failed Apply was kept: %v", err)
+			}
+		})
+	}
+}
+
+// A deleted contact's id is not given out again, or a request for it with
+// its old ETag would change the new contact. Not even after a restart
+func TestStoreNeverReusesIDs(t *testing.T) {
+
+	for name, s := range test_stores(t) {
+		t.Run(name, func(t *testing.T) {
+			a, err := s.Create(Contact{First: "Ann", Last: "Lee", Email: "ann@example.com", Phone: "1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := s.Create(Contact{First: "Bob", Last: "Ray", Email: "bob@example.com", Phone: "2"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = s.Delete(b.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := s.Create(Contact{First: "Cy", Last: "Fox", Email: "cy@example.com", Phone: "3"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.ID == b.ID || c.ID == a.ID {
+				t.Errorf("Create gave out id %d again", c.ID)
+			}
+			err = s.Delete(c.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := s.Apply([]StoreOp{{OpCreate, Contact{First: "Di", Last: "Gray", Email: "di@example.com", Phone: "4"}}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out[0].ID <= c.ID {
+				t.Errorf("Apply gave out id %d after %d", out[0].ID, c.ID)
+			}
+
+			js, ok := s.(*JSONStore)
+			if !ok {
+				return
+			}
+			err = js.Delete(out[0].ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reopened, err := newJSONStore(js.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			e, err := reopened.Create(Contact{First: "Ed", Last: "Hale", Email: "ed@example.com", Phone: "5"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.ID <= out[0].ID {
+				t.Errorf("after a restart Create gave out id %d, %d was given out before", e.ID, out[0].ID)
+			}
+		})
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "contacts.json")
+	leftovers := func() []string {
+		files, _ := filepath.Glob(filepath.Join(dir, "*.tmp-*"))
+		return files
+	}
+	check := func(want string) {
+		t.Helper()
+		data, err := os.ReadFile(path)
+		if err != nil || string(data) != want {
+			t.Errorf("file holds %q, %v, want %q", data, err, want)
+		}
+		if files := leftovers(); len(files) > 0 {
+			t.Errorf("temporary files left: %v", files)
+		}
+	}
+
+	for _, data := range []string{"first", "second"} {
+		err := write_file_atomic(path, []byte(data), 0640)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(data)
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("mode %v, %v, want 0640", info.Mode().Perm(), err)
+	}
+
+	// Failing before the rename leaves the file as it was
+	err = write_file_atomic(filepath.Join(dir, "missing", "contacts.json"), []byte("third"), 0640)
+	if err == nil {
+		t.Error("no error writing into a missing directory")
+	}
+	taken := filepath.Join(dir, "taken")
+	err = os.MkdirAll(filepath.Join(taken, "child"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = write_file_atomic(taken, []byte("third"), 0640)
+	if err == nil {
+		t.Error("no error renaming over a directory")
+	}
+	check("second")
+
+	// Once renamed the new content is there, a directory that can't be
+	// synced doesn't undo that
+	synced := sync_dir
+	sync_dir = func(string) error { return errors.New("no fsync here") }
+	t.Cleanup(func() { sync_dir = synced })
+	err = write_file_atomic(path, []byte("third"), 0640)
+	if err != nil {
+		t.Errorf("error after the rename: %v", err)
+	}
+	check("third")
+
+	// Nor does the JSON store tell a change failed that is on disk
+	err = os.WriteFile(path, []byte("[]"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	js, err := newJSONStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = js.Create(Contact{First: "Ann", Last: "Lee", Email: "ann@example.com", Phone: "1"})
+	if err != nil {
+		t.Fatalf("Create when the directory can't be synced: %v", err)
+	}
+	cs, _ := js.List(0, -1)
+	reloaded, err := read_contacts_file(path)
+	if err != nil || !same_contacts(cs, reloaded.Contacts) {
+		t.Errorf("the store has %v, the file %v, %v", cs, reloaded.Contacts, err)
+	}
+}
+
+// Every store opens the same contacts file the same way, and rejects it the
+// same way when two contacts share an id or an email
+func TestOpenStoreSeed(t *testing.T) {
+
+	tests := []struct {
+		name, data, err string
+		// The id the next contact created gets
+		next int
+	}{
+		{"valid", `[{"id":1,"first":"Ann","last":"Lee","email":"ann@example.com","phone":"1"},{"id":5,"first":"Joe","last":"Blow","email":"joe@example.com","phone":"2"}]`, "", 6},
+		// As the JSON store writes it, ids up to last_id are taken
+		{"with last id", `{"last_id":9,"contacts":[{"id":1,"first":"Ann","last":"Lee","email":"ann@example.com","phone":"1"},{"id":5,"first":"Joe","last":"Blow","email":"joe@example.com","phone":"2"}]}`, "", 10},
+		{"duplicate email", `[{"id":1,"first":"Ann","email":"ann@example.com"},{"id":2,"first":"Annie","email":"ann@example.com"}]`, `contacts 1 and 2 both have email "ann@example.com"`, 0},
+		{"duplicate id", `[{"id":1,"first":"Ann","email":"ann@example.com"},{"id":1,"first":"Joe","email":"joe@example.com"}]`, "two contacts have id 1", 0},
+	}
+	for _, tt := range tests {
+		for _, kind := range []string{"memory", "json", "sqlite"} {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "contacts.json")
+			err := os.WriteFile(path, []byte(tt.data), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s, err := open_store(kind, path, filepath.Join(dir, "contacts.db"))
+			if tt.err != "" {
+				if err == nil || !strings.HasSuffix(err.Error(), tt.err) {
+					t.Errorf("%s %s: %v, want an error ending in %s", tt.name, kind, err, tt.err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%s %s: %v", tt.name, kind, err)
+				continue
+			}
+			cs, err := s.List(0, -1)
+			if err != nil || len(cs) != 2 || cs[1].ID != 5 || cs[1].Version != 1 {
+				t.Errorf("%s %s: listed %+v, %v", tt.name, kind, cs, err)
+			}
+			c, err := s.Create(Contact{First: "Bob", Last: "Ray", Email: "bob@example.com", Phone: "3"})
+			if err != nil || c.ID != tt.next {
+				t.Errorf("%s %s: created id %d, %v, want %d", tt.name, kind, c.ID, err, tt.next)
+			}
+			if ss, ok := s.(*SQLStore); ok {
+				ss.Close()
+			}
+		}
+	}
+}
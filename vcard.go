@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime/quotedprintable"
+	"strings"
+	"unicode/utf8"
+)
+
+// vCard (RFC 2426 / RFC 6350) encoding of contacts, and parsing of 2.1, 3.0
+// and 4.0 cards
+
+var vcard_escaper = strings.NewReplacer(`\`, `\\`, `,`, `\,`, `;`, `\;`, "\r\n", `\n`, "\n", `\n`)
+
+// Write c as a vCard, version is "3.0" or "4.0"
+func write_vcard(w io.Writer, c Contact, version string) error {
+
+	lines := []string{
+		"BEGIN:VCARD",
+		"VERSION:" + version,
+		"N:" + vcard_escape(c.Last) + ";" + vcard_escape(c.First) + ";;;",
+		"FN:" + vcard_escape(strings.TrimSpace(c.First+" "+c.Last)),
+	}
+	// 4.0 dropped the INTERNET email type, and expects a tel: uri for TEL
+	// unless told the value is free text
+	if c.Email != "" && version == "4.0" {
+		lines = append(lines, "EMAIL:"+vcard_escape(c.Email))
+	} else if c.Email != "" {
+		lines = append(lines, "EMAIL;TYPE=INTERNET:"+vcard_escape(c.Email))
+	}
+	if c.Phone != "" && version == "4.0" {
+		lines = append(lines, "TEL;VALUE=text;TYPE=voice:"+vcard_escape(c.Phone))
+	} else if c.Phone != "" {
+		lines = append(lines, "TEL;TYPE=VOICE:"+vcard_escape(c.Phone))
+	}
+	lines = append(lines, "END:VCARD")
+
+	for _, l := range lines {
+		_, err := io.WriteString(w, vcard_fold(l)+"\r\n")
+		if err != nil {
+			return fmt.Errorf("write_vcard: %w", err)
+		}
+	}
+	return nil
+}
+
+func vcard_escape(s string) string {
+	return vcard_escaper.Replace(s)
+}
+
+// Lines longer than 75 octets are split, continuation lines start with a space.
+// We never split inside a UTF-8 sequence
+func vcard_fold(line string) string {
+
+	var b strings.Builder
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+		// The leading space counts towards the next line's length
+		limit = 74
+	}
+	b.WriteString(line)
+	return b.String()
+}
+
+// A problem in an uploaded vCard file, safe to show to the user
+type vcard_parse_error struct {
+	Line    int
+	Message string
+}
+
+func (e *vcard_parse_error) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+// A content line split into its parts, the value is still encoded
+type vcard_property struct {
+	Name   string
+	Params map[string][]string
+	Value  string
+}
+
+// Parse every vCard in r. Returns the contacts and the line each card starts
+// on. Properties we have no field for are ignored, as are cards nested inside
+// another one (2.1 AGENT)
+func read_vcards(r io.Reader) ([]Contact, []int, error) {
+
+	lines, starts, err := vcard_unfold(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read_vcards: %w", err)
+	}
+
+	var (
+		contacts []Contact
+		begins   []int
+		depth    int
+		c        Contact
+		fn       string
+		// Whether the email and phone we have came with a preference
+		email_pref, phone_pref bool
+	)
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		p, ok := parse_vcard_line(line)
+		if !ok {
+			// Not a property, like 2.1 base64 data written without folding
+			continue
+		}
+
+		switch {
+		case p.Name == "BEGIN" && strings.EqualFold(p.Value, "VCARD"):
+			depth++
+			if depth == 1 {
+				c = Contact{Errors: make(map[string]string)}
+				fn, email_pref, phone_pref = "", false, false
+				begins = append(begins, starts[i])
+			}
+			continue
+		case p.Name == "END" && strings.EqualFold(p.Value, "VCARD"):
+			if depth == 0 {
+				return nil, nil, &vcard_parse_error{starts[i], "END:VCARD without BEGIN:VCARD"}
+			}
+			depth--
+			if depth == 0 {
+				if c.First == "" && c.Last == "" && fn != "" {
+					// No usable N, guess from the formatted name
+					c.First, c.Last = fn, ""
+					if j := strings.LastIndexByte(fn, ' '); j > 0 {
+						c.First, c.Last = fn[:j], fn[j+1:]
+					}
+				}
+				contacts = append(contacts, c)
+			}
+			continue
+		}
+		if depth != 1 {
+			continue
+		}
+
+		value, err := vcard_decode(p)
+		if err != nil {
+			return nil, nil, &vcard_parse_error{starts[i], err.Error()}
+		}
+		pref := vcard_pref(p)
+		switch p.Name {
+		case "N":
+			parts := vcard_split(value, ';')
+			c.Last = strings.TrimSpace(vcard_unescape(parts[0]))
+			if len(parts) > 1 {
+				c.First = strings.TrimSpace(vcard_unescape(parts[1]))
+			}
+		case "FN":
+			fn = strings.TrimSpace(vcard_unescape(value))
+		case "EMAIL":
+			if c.Email == "" || (pref && !email_pref) {
+				c.Email = strings.TrimSpace(vcard_unescape(value))
+				email_pref = pref
+			}
+		case "TEL":
+			if c.Phone == "" || (pref && !phone_pref) {
+				// 4.0 prefers tel: uris
+				c.Phone = strings.TrimPrefix(strings.TrimSpace(vcard_unescape(value)), "tel:")
+				phone_pref = pref
+			}
+		}
+	}
+
+	if depth > 0 {
+		return nil, nil, &vcard_parse_error{begins[len(begins)-1], "BEGIN:VCARD without END:VCARD"}
+	}
+	if len(contacts) == 0 {
+		return nil, nil, &vcard_parse_error{1, "no vCard found"}
+	}
+	return contacts, begins, nil
+}
+
+// Join folded lines back together and return them with the line each one
+// started on. Continuation lines start with a space or tab; 2.1 quoted
+// printable values instead end a line with = to continue on the next one
+func vcard_unfold(r io.Reader) ([]string, []int, error) {
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+
+	var lines []string
+	var starts []int
+	n := 0
+	soft_break := false
+	for sc.Scan() {
+		n++
+		line := strings.TrimSuffix(sc.Text(), "\r")
+		if n == 1 {
+			line = strings.TrimPrefix(line, "\ufeff")
+		}
+
+		switch {
+		case soft_break:
+			// Kept for the quoted-printable decoder, which drops it
+			lines[len(lines)-1] += "\r\n" + line
+		case len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")):
+			lines[len(lines)-1] += line[1:]
+		default:
+			lines = append(lines, line)
+			starts = append(starts, n)
+		}
+
+		last := lines[len(lines)-1]
+		soft_break = strings.HasSuffix(last, "=") && strings.Contains(strings.ToUpper(last), "QUOTED-PRINTABLE")
+	}
+	if err := sc.Err(); err != nil {
+		return nil, nil, fmt.Errorf("vcard_unfold: %w", err)
+	}
+	return lines, starts, nil
+}
+
+// Split a content line, [group.]NAME[;param...]:value, reports false if there
+// is no colon. Parameter values may be quoted and contain ; : or ,
+func parse_vcard_line(line string) (vcard_property, bool) {
+
+	colon := -1
+	quoted := false
+	for i := 0; i < len(line); i++ {
+		if line[i] == '"' {
+			quoted = !quoted
+		} else if line[i] == ':' && !quoted {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return vcard_property{}, false
+	}
+
+	head := vcard_split(line[:colon], ';')
+	name := strings.ToUpper(strings.TrimSpace(head[0]))
+	if dot := strings.LastIndexByte(name, '.'); dot >= 0 {
+		name = name[dot+1:]
+	}
+
+	p := vcard_property{Name: name, Params: make(map[string][]string), Value: line[colon+1:]}
+	for _, param := range head[1:] {
+		key, value, ok := strings.Cut(param, "=")
+		if !ok {
+			// 2.1 allows bare types, TEL;CELL;PREF:
+			key, value = "TYPE", param
+		}
+		key = strings.ToUpper(strings.TrimSpace(key))
+		for _, v := range strings.Split(value, ",") {
+			p.Params[key] = append(p.Params[key], strings.Trim(strings.TrimSpace(v), `"`))
+		}
+	}
+	return p, true
+}
+
+// Undo the property's ENCODING and CHARSET, the vCard escapes are left for the
+// caller since structured values are split first
+func vcard_decode(p vcard_property) (string, error) {
+
+	value := p.Value
+	for _, enc := range p.Params["ENCODING"] {
+		if strings.EqualFold(enc, "QUOTED-PRINTABLE") {
+			data, err := io.ReadAll(quotedprintable.NewReader(strings.NewReader(value)))
+			if err != nil {
+				return "", fmt.Errorf("invalid quoted-printable %s value", p.Name)
+			}
+			value = string(data)
+		}
+	}
+
+	for _, charset := range p.Params["CHARSET"] {
+		switch strings.ToUpper(charset) {
+		case "UTF-8", "US-ASCII":
+		case "ISO-8859-1", "LATIN1", "WINDOWS-1252":
+			// Every latin1 byte is the code point of the same value. The few
+			// windows-1252 extras (curly quotes and such) don't matter for us
+			var b strings.Builder
+			for _, c := range []byte(value) {
+				b.WriteRune(rune(c))
+			}
+			value = b.String()
+		default:
+			return "", fmt.Errorf("unsupported charset %s", charset)
+		}
+	}
+
+	if !utf8.ValidString(value) {
+		return "", fmt.Errorf("%s is not valid UTF-8, the card needs a CHARSET", p.Name)
+	}
+	return value, nil
+}
+
+// PREF as a 2.1 bare type, a 3.0 TYPE=pref or a 4.0 PREF=1
+func vcard_pref(p vcard_property) bool {
+
+	for _, t := range p.Params["TYPE"] {
+		if strings.EqualFold(t, "pref") {
+			return true
+		}
+	}
+	return p.Params["PREF"] != nil
+}
+
+// Split s at every sep not escaped with a backslash
+func vcard_split(s string, sep byte) []string {
+
+	var parts []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' {
+			i++
+		} else if s[i] == sep {
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func vcard_unescape(s string) string {
+
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i == len(s)-1 {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n', 'N':
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
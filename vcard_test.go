@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestReadVCards(t *testing.T) {
+
+	type card struct{ first, last, email, phone string }
+	tests := []struct {
+		name   string
+		data   string
+		cards  []card
+		begins []int
+	}{
+		{"3.0", "BEGIN:VCARD\r\nVERSION:3.0\r\nN:Gross;Carson;;;\r\nFN:Carson Gross\r\nEMAIL;TYPE=INTERNET:carson@example.com\r\nTEL;TYPE=VOICE:123-456-7890\r\nEND:VCARD\r\n",
+			[]card{{"Carson", "Gross", "carson@example.com", "123-456-7890"}}, []int{1}},
+		{"folded lines", "BEGIN:VCARD\nVERSION:3.0\nN:Gross;Car\n son;;;\nEMAIL:carson@exa\n\tmple.com\nEND:VCARD\n",
+			[]card{{"Carson", "Gross", "carson@example.com", ""}}, []int{1}},
+		{"quoted printable", "BEGIN:VCARD\r\nVERSION:2.1\r\nN;ENCODING=QUOTED-PRINTABLE;CHARSET=UTF-8:M=C3=BCller;J=C3=BCrgen\r\nEMAIL;INTERNET;ENCODING=QUOTED-PRINTABLE:jurgen@=\r\nexample.com\r\nEND:VCARD\r\n",
+			[]card{{"Jürgen", "Müller", "jurgen@example.com", ""}}, []int{1}},
+		{"latin1", "BEGIN:VCARD\r\nVERSION:2.1\r\nN;CHARSET=ISO-8859-1;ENCODING=QUOTED-PRINTABLE:M=FCller;J=FCrgen\r\nEND:VCARD\r\n",
+			[]card{{"Jürgen", "Müller", "", ""}}, []int{1}},
+		// The first of several, unless a later one is preferred
+		{"several emails and phones", "BEGIN:VCARD\nVERSION:3.0\nN:Blow;Joe\nEMAIL:joe@work.example\nEMAIL;TYPE=home,pref:joe@home.example\nEMAIL;TYPE=other:joe@other.example\nTEL;TYPE=cell:555-0100\nTEL;TYPE=home:555-0101\nEND:VCARD\n",
+			[]card{{"Joe", "Blow", "joe@home.example", "555-0100"}}, []int{1}},
+		{"2.1 bare pref", "BEGIN:VCARD\nVERSION:2.1\nN:Blow;Joe\nTEL;HOME:555-0101\nTEL;CELL;PREF:555-0100\nEND:VCARD\n",
+			[]card{{"Joe", "Blow", "", "555-0100"}}, []int{1}},
+		{"4.0 tel uri", "BEGIN:VCARD\nVERSION:4.0\nN:Blow;Joe;;;\nTEL;VALUE=uri;PREF=1:tel:+1-555-0100\nEND:VCARD\n",
+			[]card{{"Joe", "Blow", "", "+1-555-0100"}}, []int{1}},
+		{"escapes and groups", "BEGIN:VCARD\nVERSION:3.0\nitem1.N:O\\,Brien\\;Jr;Pat\nitem1.EMAIL:pat@example.com\nEND:VCARD\n",
+			[]card{{"Pat", "O,Brien;Jr", "pat@example.com", ""}}, []int{1}},
+		{"BOM, name from FN", "\ufeffBEGIN:VCARD\nVERSION:3.0\nFN:Mary Ann Lee\nEND:VCARD\n",
+			[]card{{"Mary Ann", "Lee", "", ""}}, []int{1}},
+		{"nested agent", "BEGIN:VCARD\nVERSION:2.1\nN:Boss;Bob\nAGENT:\nBEGIN:VCARD\nN:Helper;Hal\nEND:VCARD\nEMAIL:bob@example.com\nEND:VCARD\n",
+			[]card{{"Bob", "Boss", "bob@example.com", ""}}, []int{1}},
+		{"two cards", "BEGIN:VCARD\nN:Gross;Carson\nEND:VCARD\n\nBEGIN:VCARD\nN:Blow;Joe\nEND:VCARD\n",
+			[]card{{"Carson", "Gross", "", ""}, {"Joe", "Blow", "", ""}}, []int{1, 5}},
+	}
+	for _, tt := range tests {
+		cs, begins, err := read_vcards(strings.NewReader(tt.data))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		var got []card
+		for _, c := range cs {
+			got = append(got, card{c.First, c.Last, c.Email, c.Phone})
+		}
+		if len(got) != len(tt.cards) {
+			t.Errorf("%s: read %+v, want %+v", tt.name, got, tt.cards)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.cards[i] || begins[i] != tt.begins[i] {
+				t.Errorf("%s: card %d is %+v on line %d, want %+v on line %d", tt.name, i, got[i], begins[i], tt.cards[i], tt.begins[i])
+			}
+		}
+	}
+}
+
+func TestReadVCardsErrors(t *testing.T) {
+
+	tests := []struct {
+		name string
+		data string
+		line int
+		msg  string
+	}{
+		{"missing END", "BEGIN:VCARD\nVERSION:3.0\nN:Gross;Carson\n", 1, "BEGIN:VCARD without END:VCARD"},
+		{"second missing END", "BEGIN:VCARD\nN:Gross;Carson\nEND:VCARD\nBEGIN:VCARD\nN:Blow;Joe\n", 4, "BEGIN:VCARD without END:VCARD"},
+		{"END first", "END:VCARD\n", 1, "END:VCARD without BEGIN:VCARD"},
+		{"no card", "N:Gross;Carson\n", 1, "no vCard found"},
+		{"bad charset", "BEGIN:VCARD\nN;CHARSET=EBCDIC:Gross\nEND:VCARD\n", 2, "unsupported charset EBCDIC"},
+		{"not UTF-8", "BEGIN:VCARD\nN:Gr\xf6\xdf\nEND:VCARD\n", 2, "N is not valid UTF-8, the card needs a CHARSET"},
+	}
+	for _, tt := range tests {
+		_, _, err := read_vcards(strings.NewReader(tt.data))
+		var ve *vcard_parse_error
+		if !errors.As(err, &ve) {
+			t.Errorf("%s: %v, want a vcard_parse_error", tt.name, err)
+			continue
+		}
+		if ve.Line != tt.line || ve.Message != tt.msg {
+			t.Errorf("%s: line %d %q, want line %d %q", tt.name, ve.Line, ve.Message, tt.line, tt.msg)
+		}
+	}
+}
+
+// What write_vcard writes reads back as the same contact, with no line longer
+// than 75 octets
+func TestVCardRoundTrip(t *testing.T) {
+
+	c := Contact{
+		First: "Jürgen Maximilian Friedrich",
+		Last:  "Groß-Müller, von; der Lüdenscheid-Übelacker-Ömer",
+		Email: "jurgen@example.com",
+		Phone: "+49 (0)30 555 0100",
+	}
+	for _, version := range []string{"3.0", "4.0"} {
+		var buf bytes.Buffer
+		err := write_vcard(&buf, c, version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\r\n"), "\r\n") {
+			if len(line) > 75 {
+				t.Errorf("%s: line of %d octets: %q", version, len(line), line)
+			}
+		}
+		cs, _, err := read_vcards(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cs) != 1 || cs[0].First != c.First || cs[0].Last != c.Last || cs[0].Email != c.Email || cs[0].Phone != c.Phone {
+			t.Errorf("%s: read back %+v, want %+v", version, cs, c)
+		}
+	}
+}